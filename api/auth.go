@@ -0,0 +1,110 @@
+package api
+
+import (
+	stdcontext "context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/db"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	authorizationHeader   = "Authorization"
+	apiKeyHeader          = "X-API-Key"
+	bearerScheme          = "Bearer "
+	wwwAuthenticateHeader = "WWW-Authenticate"
+)
+
+// errNotOwned is returned when a tenant asks for a job created by another tenant.
+var errNotOwned = errors.New("job owned by another tenant")
+
+// tenantKey is the key of the authenticated tenant in the request context.
+type tenantKey struct{}
+
+// apiKey is a key that authenticates the requests of a tenant.
+type apiKey struct {
+	key    []byte
+	tenant string
+}
+
+func newAPIKeys(tenants []context.TenantConfig) []apiKey {
+	var keys []apiKey
+	for _, t := range tenants {
+		for _, k := range t.Keys {
+			keys = append(keys, apiKey{[]byte(k), t.Name})
+		}
+	}
+	return keys
+}
+
+// authenticate only calls the handler when the request has the key of a tenant,
+// in the Authorization header as a bearer token or in the X-API-Key header.
+// Requests are not authenticated when the server has no keys,
+// and they belong to the empty tenant.
+func (s *Server) authenticate(h httprouter.Handle) httprouter.Handle {
+	if len(s.keys) == 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		tenant, ok := s.lookupKey(requestKey(r))
+		if !ok {
+			slog.Warn("authenticationFailed", "remote", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set(wwwAuthenticateHeader, `Bearer realm="crawler"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r.WithContext(stdcontext.WithValue(r.Context(), tenantKey{}, tenant)), ps)
+	}
+}
+
+// lookupKey returns the tenant that owns a key.
+// It compares the key with all the keys in constant time,
+// so the time to reject a key doesn't tell how close it is to a valid one.
+func (s *Server) lookupKey(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	var tenant string
+	found := false
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(k.key, []byte(key)) == 1 {
+			tenant, found = k.tenant, true
+		}
+	}
+	return tenant, found
+}
+
+// ownedJob returns the status of a job when it belongs to the tenant of the request.
+func (s *Server) ownedJob(r *http.Request, jobUUID string) (*db.Info, error) {
+	info, err := s.context.Db.Status(jobUUID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Tenant != requestTenant(r) {
+		return nil, errNotOwned
+	}
+	return info, nil
+}
+
+func requestKey(r *http.Request) string {
+	a := r.Header.Get(authorizationHeader)
+	if len(a) > len(bearerScheme) && strings.EqualFold(a[:len(bearerScheme)], bearerScheme) {
+		return strings.TrimSpace(a[len(bearerScheme):])
+	}
+	return r.Header.Get(apiKeyHeader)
+}
+
+// requestTenant returns the tenant authenticated by the request,
+// empty when the server doesn't authenticate requests.
+func requestTenant(r *http.Request) string {
+	t, _ := r.Context().Value(tenantKey{}).(string)
+	return t
+}
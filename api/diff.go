@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/diff"
+	"github.com/calavera/crawler/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+const toParamName = "toUUID"
+
+// diff compares the images and the pages found by two jobs of the tenant, the old one first.
+func (s *Server) diff(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	from, to := ps.ByName(jobParamName), ps.ByName(toParamName)
+
+	for _, jobUUID := range []string{from, to} {
+		if _, err := s.ownedJob(r, jobUUID); err != nil {
+			logging.Job(jobUUID).Debug("diffError", logging.Err(err))
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	report, err := diff.Jobs(s.context.Db, from, to)
+	if err == db.ErrJobNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.Job(to).Error("diffError", "from", from, logging.Err(err))
+		http.Error(w, "Unable to compare the jobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonMediaType)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/calavera/crawler/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+// checkTimeout is the time that /readyz waits for every check.
+const checkTimeout = 5 * time.Second
+
+// Check returns an error when a dependency of the node is not ready to work.
+type Check func() error
+
+type check struct {
+	name string
+	fn   Check
+}
+
+// AddCheck adds a check to the readiness endpoint.
+// Servers check the storage and the queue in their context by default.
+// Checks must be added before the server starts receiving requests.
+func (s *Server) AddCheck(name string, fn Check) {
+	s.checks = append(s.checks, check{name, fn})
+}
+
+// healthz reports that the process is alive.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	fmt.Fprint(w, "ok")
+}
+
+// readyz runs all the checks at the same time, and it reports whether the node can take more work.
+// It responds with a line per check, and with the status 503 if any check fails.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	errs := make([]chan error, len(s.checks))
+	for i, c := range s.checks {
+		errs[i] = make(chan error, 1)
+		go func(fn Check, ch chan error) {
+			ch <- fn()
+		}(c.fn, errs[i])
+	}
+
+	expired := make(chan struct{})
+	t := time.AfterFunc(checkTimeout, func() { close(expired) })
+	defer t.Stop()
+
+	status := http.StatusOK
+	b := new(bytes.Buffer)
+
+	for i, c := range s.checks {
+		var err error
+		select {
+		case err = <-errs[i]:
+		case <-expired:
+			err = fmt.Errorf("timeout after %v", checkTimeout)
+		}
+
+		if err != nil {
+			slog.Warn("checkFailed", "check", c.name, logging.Err(err))
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(b, "[-]%s failed: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(b, "[+]%s ok\n", c.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	b.WriteTo(w)
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/schedule"
+	"github.com/julienschmidt/httprouter"
+)
+
+const scheduleParamName = "scheduleID"
+
+// scheduleRequest is the job template sent to create or replace a schedule.
+type scheduleRequest struct {
+	Cron     string   `json:"cron"`
+	Seeds    []string `json:"seeds"`
+	Priority string   `json:"priority"`
+	Sitemaps bool     `json:"sitemaps"`
+}
+
+// scheduleResponse is the representation of a schedule sent to clients.
+type scheduleResponse struct {
+	ID       string    `json:"id"`
+	Cron     string    `json:"cron"`
+	Seeds    []string  `json:"seeds"`
+	Priority string    `json:"priority"`
+	Sitemaps bool      `json:"sitemaps"`
+	Updated  time.Time `json:"updated"`
+	NextRun  time.Time `json:"nextRun"`
+}
+
+// runResponse is the representation of a run sent to clients.
+type runResponse struct {
+	JobUUID string    `json:"jobUUID,omitempty"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (s *Server) createSchedule(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sc := &db.Schedule{ID: queue.UUID(), Tenant: requestTenant(r)}
+	if !s.decodeSchedule(w, r, sc) {
+		return
+	}
+
+	if err := s.schedules.SaveSchedule(sc); err != nil {
+		slog.Error("saveScheduleError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		http.Error(w, "Unable to create the schedule", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("scheduleCreated", logging.ScheduleKey, sc.ID, logging.TenantKey, sc.Tenant, "cron", sc.Cron)
+
+	w.Header().Set("Location", fmt.Sprintf("/schedules/%s", sc.ID))
+	s.writeSchedule(w, http.StatusCreated, sc, nil)
+}
+
+func (s *Server) listSchedules(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	all, err := s.schedules.Schedules()
+	if err != nil {
+		slog.Error("schedulesError", logging.Err(err))
+		http.Error(w, "Unable to list the schedules", http.StatusInternalServerError)
+		return
+	}
+
+	schedules := []scheduleResponse{}
+	for _, sc := range all {
+		if sc.Tenant != requestTenant(r) {
+			continue
+		}
+
+		runs, err := s.runs(sc.ID)
+		if err != nil {
+			slog.Error("runsError", logging.ScheduleKey, sc.ID, logging.Err(err))
+			http.Error(w, "Unable to list the schedules", http.StatusInternalServerError)
+			return
+		}
+		schedules = append(schedules, newScheduleResponse(sc, runs))
+	}
+
+	w.Header().Set("Content-Type", jsonMediaType)
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func (s *Server) showSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sc, ok := s.ownedSchedule(w, r, ps)
+	if !ok {
+		return
+	}
+
+	runs, err := s.runs(sc.ID)
+	if err != nil {
+		slog.Error("runsError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		http.Error(w, "Unable to get the schedule", http.StatusInternalServerError)
+		return
+	}
+	s.writeSchedule(w, http.StatusOK, sc, runs)
+}
+
+func (s *Server) updateSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sc, ok := s.ownedSchedule(w, r, ps)
+	if !ok || !s.decodeSchedule(w, r, sc) {
+		return
+	}
+
+	if err := s.schedules.SaveSchedule(sc); err != nil {
+		slog.Error("saveScheduleError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		http.Error(w, "Unable to update the schedule", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("scheduleUpdated", logging.ScheduleKey, sc.ID, "cron", sc.Cron)
+
+	runs, _ := s.runs(sc.ID)
+	s.writeSchedule(w, http.StatusOK, sc, runs)
+}
+
+func (s *Server) deleteSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sc, ok := s.ownedSchedule(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := s.schedules.DeleteSchedule(sc.ID); err != nil {
+		slog.Error("deleteScheduleError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		http.Error(w, "Unable to delete the schedule", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("scheduleDeleted", logging.ScheduleKey, sc.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) scheduleRuns(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sc, ok := s.ownedSchedule(w, r, ps)
+	if !ok {
+		return
+	}
+
+	runs, err := s.runs(sc.ID)
+	if err != nil {
+		slog.Error("runsError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		http.Error(w, "Unable to get the runs", http.StatusInternalServerError)
+		return
+	}
+
+	res := []runResponse{}
+	for _, r := range runs {
+		res = append(res, runResponse{JobUUID: r.JobUUID, Time: r.Time, Error: r.Error})
+	}
+
+	w.Header().Set("Content-Type", jsonMediaType)
+	json.NewEncoder(w).Encode(res)
+}
+
+// withSchedules only calls the handler when the storage keeps schedules.
+func (s *Server) withSchedules(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.schedules == nil {
+			http.Error(w, "The storage doesn't support schedules", http.StatusNotImplemented)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// runs returns the history of a schedule, empty when the storage doesn't keep it.
+func (s *Server) runs(id string) ([]db.Run, error) {
+	rs, ok := db.AsRunStore(s.context.Db)
+	if !ok {
+		return nil, nil
+	}
+	return rs.Runs(id)
+}
+
+// ownedSchedule returns the schedule in the path when it belongs to the tenant of the request.
+// It writes the error response when it doesn't.
+func (s *Server) ownedSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*db.Schedule, bool) {
+	id := ps.ByName(scheduleParamName)
+
+	sc, err := s.schedules.Schedule(id)
+	if err == nil && sc.Tenant != requestTenant(r) {
+		err = errNotOwned
+	}
+
+	switch err {
+	case nil:
+		return sc, true
+	case db.ErrScheduleNotFound, errNotOwned:
+		slog.Debug("scheduleError", logging.ScheduleKey, id, logging.Err(err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+	default:
+		slog.Error("scheduleError", logging.ScheduleKey, id, logging.Err(err))
+		http.Error(w, "Unable to get the schedule", http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// decodeSchedule copies the template in the request body to the schedule.
+// The schedule is due again from now on.
+// It writes the error response when the template is not valid.
+func (s *Server) decodeSchedule(w http.ResponseWriter, r *http.Request, sc *db.Schedule) bool {
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	sc.Cron = req.Cron
+	sc.Seeds = req.Seeds
+	sc.Priority = req.Priority
+	sc.Sitemaps = req.Sitemaps
+	sc.Updated = time.Now().UTC()
+
+	if err := schedule.Validate(sc); err != nil {
+		http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeSchedule(w http.ResponseWriter, code int, sc *db.Schedule, runs []db.Run) {
+	w.Header().Set("Content-Type", jsonMediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(newScheduleResponse(sc, runs))
+}
+
+func newScheduleResponse(sc *db.Schedule, runs []db.Run) scheduleResponse {
+	var last *db.Run
+	if len(runs) > 0 {
+		last = &runs[0]
+	}
+
+	priority, _ := queue.ParsePriority(sc.Priority)
+	return scheduleResponse{
+		ID:       sc.ID,
+		Cron:     sc.Cron,
+		Seeds:    sc.Seeds,
+		Priority: priority.String(),
+		Sitemaps: sc.Sitemaps,
+		Updated:  sc.Updated,
+		NextRun:  schedule.Next(sc, last),
+	}
+}
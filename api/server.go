@@ -3,22 +3,37 @@ package api
 import (
 	"bufio"
 	"bytes"
+	stdcontext "context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/metrics"
 	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
 	"github.com/julienschmidt/httprouter"
 )
 
 const (
 	jobParamName   = "jobUUID"
+	jsonMediaType  = "application/json"
 	defaultPort    = ":3819"
 	crawlerPortKey = "CRAWLER_PORT"
 
+	traceparentHeader   = "traceparent"
+	traceresponseHeader = "traceresponse"
+
 	usage = `Image crawler usage:
 
 1. Send a list of URLs to /crawl via a POST message:
@@ -28,8 +43,10 @@ http://www.google.com/ http://www.docker.com/
 EOF
 
 The server status is 201 after the urls are queued. The header "Location" includes the path to the status.
+Add "?priority=high" for interactive crawls, or "?priority=low" for bulk crawls that can wait.
+Add "?sitemaps=true" to crawl the pages listed in the sitemaps of the sites too, from robots.txt or /sitemap.xml.
 
-2. Check the status of a specific job:
+2. Check the status of a specific job. Send the header "Accept: application/json" to get it in json:
 
 $ curl -X GET http://mycrawler.com/status/aaaa-bbbb-cccc-dddd
 - Processing: 2 URLs
@@ -44,30 +61,139 @@ $ curl -X GET http://mycrawler.com/results/aaaa-bbbb-cccc-dddd
 http://www.docker.com/static/img/bodybg.png
 http://www.docker.com/static/img/logo.png
 http://www.docker.com/static/img/padlock.png
+
+4. Cancel a specific job, so it doesn't crawl new pages:
+
+$ curl -X POST http://mycrawler.com/cancel/aaaa-bbbb-cccc-dddd
+
+5. Compare the results of two jobs, the old one first, to see the images and pages added, removed or changed:
+
+$ curl -X GET http://mycrawler.com/diff/aaaa-bbbb-cccc-dddd/eeee-ffff-gggg-hhhh
+{"from":"aaaa-bbbb-cccc-dddd","to":"eeee-ffff-gggg-hhhh","images":{"added":[...],"removed":[...],"changed":[],"unchanged":12},"pages":{...}}
+
+6. Check your quotas and how much of them you used today:
+
+$ curl -X GET http://mycrawler.com/quota
+- Active jobs: 1/5
+- Pages per job: 1000
+- Pages today: 120/10000
+- Bytes today: 2097152/unlimited
+
+7. Crawl the same urls every night with a schedule, in json. The cron expression is in UTC:
+
+$ curl -X POST -d '{"cron": "0 3 * * *", "seeds": ["http://www.docker.com/"], "priority": "low"}' http://mycrawler.com/schedules
+
+List your schedules in /schedules, see one in /schedules/:id, replace it with PUT, remove it with DELETE,
+and check the jobs that it created in /schedules/:id/runs.
+
+When the server requires api keys, send yours in every request.
+Jobs are only visible with the keys of the tenant that created them:
+
+$ curl -H "Authorization: Bearer my-api-key" -X GET http://mycrawler.com/status/aaaa-bbbb-cccc-dddd
 `
 )
 
 // Server is the structure that controls requests to the api.
-// It initializes the http handler when `StartServer` is called.
+// It initializes the http handler when `NewServer` or `StartServer` are called.
 type Server struct {
-	context context.Context
-	router  *httprouter.Router
+	context   context.Context
+	router    *httprouter.Router
+	http      *http.Server
+	checks    []check
+	keys      []apiKey
+	quota     *quota.Tracker
+	schedules db.ScheduleStore // nil when the storage doesn't keep schedules.
 }
 
 // StartServer creates a new server and initializes the http router to receive requests.
+// It exits the program if the server cannot listen in its port.
 func StartServer(cx context.Context) {
-	newServer(cx).start()
+	log.Fatal(NewServer(cx).ListenAndServe())
 }
 
-func (s *Server) start() {
+// NewServer creates a new server that listens in the port in the context configuration.
+// It uses the port in CRAWLER_PORT, or 3819, when the context is not configured.
+func NewServer(cx context.Context) *Server {
+	s := newServer(cx)
+	s.http = s.newHTTPServer(s.routes())
+	return s
+}
+
+// NewWorkerServer creates a new server for nodes that only crawl urls.
+// It doesn't expose the api, only the endpoints to operate the node.
+// It listens in the same port than the api server.
+func NewWorkerServer(cx context.Context) *Server {
+	s := newServer(cx)
+	s.http = s.newHTTPServer(s.workerRoutes())
+	return s
+}
+
+// ListenAndServe receives requests until the server is shut down.
+// It returns nil when the server stops because of a shutdown.
+func (s *Server) ListenAndServe() error {
+	slog.Info("serverListening", "addr", s.http.Addr)
+
+	err := s.http.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops receiving new requests and waits for the active ones to finish.
+// It closes the active requests when the timeout expires.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	cx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	err := s.http.Shutdown(cx)
+	if err == stdcontext.DeadlineExceeded {
+		slog.Warn("serverShutdownTimeout", "timeout", timeout)
+		return s.http.Close()
+	}
+	return err
+}
+
+// Handler creates a new server and returns the http handler that serves the api,
+// without listening in any port.
+func Handler(cx context.Context) http.Handler {
+	return newServer(cx).routes()
+}
+
+func (s *Server) routes() http.Handler {
 	s.router.GET("/", s.index)
-	s.router.POST("/crawl", s.crawl)
-	s.router.GET("/status/:jobUUID", s.status)
-	s.router.GET("/results/:jobUUID", s.results)
+	s.router.POST("/crawl", s.authenticate(s.crawl))
+	s.router.GET("/status/:jobUUID", s.authenticate(s.status))
+	s.router.GET("/results/:jobUUID", s.authenticate(s.results))
+	s.router.POST("/cancel/:jobUUID", s.authenticate(s.cancel))
+	s.router.GET("/diff/:jobUUID/:toUUID", s.authenticate(s.diff))
+	s.router.GET("/quota", s.authenticate(s.quotaStatus))
+	s.router.POST("/schedules", s.authenticate(s.withSchedules(s.createSchedule)))
+	s.router.GET("/schedules", s.authenticate(s.withSchedules(s.listSchedules)))
+	s.router.GET("/schedules/:scheduleID", s.authenticate(s.withSchedules(s.showSchedule)))
+	s.router.PUT("/schedules/:scheduleID", s.authenticate(s.withSchedules(s.updateSchedule)))
+	s.router.DELETE("/schedules/:scheduleID", s.authenticate(s.withSchedules(s.deleteSchedule)))
+	s.router.GET("/schedules/:scheduleID/runs", s.authenticate(s.withSchedules(s.scheduleRuns)))
+
+	return s.workerRoutes()
+}
+
+// workerRoutes adds the endpoints to operate the node.
+// The metrics show the jobs of every tenant, so they require an api key when the server has keys.
+// The probes don't, the orchestrators call them without credentials.
+func (s *Server) workerRoutes() http.Handler {
+	s.router.GET("/healthz", s.healthz)
+	s.router.GET("/readyz", s.readyz)
+	s.router.GET("/metrics", s.authenticate(handle(metrics.Handler())))
 
-	port := serverPort()
-	log.Printf("Server listening in port %s\n", port)
-	log.Fatal(http.ListenAndServe(port, s.router))
+	return s.router
+}
+
+// handle adapts an http.Handler to the router.
+func handle(h http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, r)
+	}
 }
 
 func (s *Server) index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -75,42 +201,93 @@ func (s *Server) index(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 }
 
 func (s *Server) crawl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	span := startSpan(r, "POST /crawl")
+	defer span.End()
+	w.Header().Set(traceresponseHeader, span.Context().Traceparent())
+
+	priority, err := queue.ParsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, "Invalid priority", http.StatusBadRequest)
+		return
+	}
+
+	sitemaps, err := parseSitemaps(r)
+	if err != nil {
+		http.Error(w, "Invalid sitemaps", http.StatusBadRequest)
+		return
+	}
+
 	urls, err := parseURLs(r)
 	if err != nil || len(urls) == 0 {
 		http.Error(w, "Invalid urls", http.StatusBadRequest)
 		return
 	}
 
-	jobUUID, err := s.createNewJob()
+	tenant := requestTenant(r)
+	if err := s.quota.Admit(tenant, len(urls)); err != nil {
+		span.SetError(err)
+		if _, ok := err.(*quota.ExceededError); ok {
+			slog.Info("jobRejected", logging.TenantKey, tenant, logging.Err(err))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		slog.Error("quotaError", logging.TenantKey, tenant, logging.Err(err))
+		http.Error(w, "Unable to check the quotas", http.StatusInternalServerError)
+		return
+	}
+
+	var jobUUID string
+	err = tracing.Do(span.Context(), "storage.create_job", tracing.KindClient, func() (err error) {
+		jobUUID, err = s.createNewJob(tenant)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("type=creatingJobError jobUUID=%s err=%v", jobUUID, err)
+		logging.Job(jobUUID).Error("creatingJobError", logging.Err(err))
+		span.SetError(err)
 		http.Error(w, "Unable to create new jobs", http.StatusInternalServerError)
 		return
 	}
 
+	l := logging.Job(jobUUID).With(logging.TraceKey, span.Context().TraceID.String())
+	if tenant != "" {
+		l = l.With(logging.TenantKey, tenant)
+		span.SetAttributes("tenant", tenant)
+	}
+	l.Info("jobCreated", "urls", len(urls), "priority", priority.String(), "sitemaps", sitemaps)
+	span.SetAttributes("job.uuid", jobUUID, "crawl.urls", strconv.Itoa(len(urls)), "job.priority", priority.String())
+
 	for _, u := range urls {
-		err := s.publish(jobUUID, u)
+		err := s.publish(span.Context(), jobUUID, tenant, priority, sitemaps, u)
 		if err != nil {
-			fmt.Printf("type=publisingError jobUUID=%s url=%v err=%v", jobUUID, u, err)
+			l.Error("publishingError", logging.URLKey, u.String(), logging.Err(err))
 		}
 	}
 
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Location", fmt.Sprintf("/status/%s", jobUUID))
+	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(jobUUID))
 }
 
 func (s *Server) status(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jobUUID := ps.ByName(jobParamName)
 
-	info, err := s.context.Db.Status(jobUUID)
+	info, err := s.ownedJob(r, jobUUID)
 	if err != nil {
-		log.Printf("type=statusError jobUUID=%s err=%v", jobUUID, err)
+		logging.Job(jobUUID).Debug("statusError", logging.Err(err))
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
 
+	if strings.Contains(r.Header.Get("Accept"), jsonMediaType) {
+		w.Header().Set("Content-Type", jsonMediaType)
+		json.NewEncoder(w).Encode(newStatusResponse(info))
+		return
+	}
+
 	b := bytes.NewBufferString(fmt.Sprintf("- Processing: %d URLs\n- Done: %d URLs\n", info.Processing, info.Done))
+	if info.Cancelled {
+		b.WriteString("- Cancelled\n")
+	}
 
 	pageViews := info.PageViews()
 	if len(pageViews) > 0 {
@@ -124,15 +301,21 @@ func (s *Server) status(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		}
 	}
 
-	fmt.Fprintf(w, b.String())
+	fmt.Fprint(w, b.String())
 }
 
 func (s *Server) results(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jobUUID := ps.ByName(jobParamName)
 
+	if _, err := s.ownedJob(r, jobUUID); err != nil {
+		logging.Job(jobUUID).Debug("resultsError", logging.Err(err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
 	images, err := s.context.Db.Results(jobUUID)
 	if err != nil {
-		log.Printf("type=resultsError jobUUID=%s err=%v", jobUUID, err)
+		logging.Job(jobUUID).Debug("resultsError", logging.Err(err))
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
@@ -146,20 +329,101 @@ func (s *Server) results(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	fmt.Fprint(w, b.String())
 }
 
-func (s *Server) publish(jobUUID string, u *url.URL) error {
-	return s.context.Queue.Publish(jobUUID, u.String(), 0)
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jobUUID := ps.ByName(jobParamName)
+
+	if _, err := s.ownedJob(r, jobUUID); err != nil {
+		logging.Job(jobUUID).Debug("statusError", logging.Err(err))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.context.Db.Cancel(jobUUID); err != nil {
+		logging.Job(jobUUID).Error("cancelError", logging.Err(err))
+		http.Error(w, "Unable to cancel the job", http.StatusInternalServerError)
+		return
+	}
+
+	logging.Job(jobUUID).Info("jobCancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) quotaStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tenant := requestTenant(r)
+
+	st, err := s.quota.Status(tenant)
+	if err != nil {
+		slog.Error("quotaError", logging.TenantKey, tenant, logging.Err(err))
+		http.Error(w, "Unable to check the quotas", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), jsonMediaType) {
+		w.Header().Set("Content-Type", jsonMediaType)
+		json.NewEncoder(w).Encode(st)
+		return
+	}
+
+	l := st.Limits
+	fmt.Fprintf(w, "- Active jobs: %s\n- Pages per job: %s\n- Pages today: %s\n- Bytes today: %s\n",
+		formatUsage(int64(st.ActiveJobs), int64(l.ConcurrentJobs)),
+		formatLimit(l.PagesPerJob),
+		formatUsage(st.Pages, l.PagesPerDay),
+		formatUsage(st.Bytes, l.BytesPerDay))
+}
+
+func (s *Server) publish(parent tracing.SpanContext, jobUUID, tenant string, priority queue.Priority, sitemaps bool, u *url.URL) error {
+	msg := queue.NewMessage(jobUUID, u.String(), 0)
+	msg.Tenant = tenant
+	msg.Priority = priority
+	msg.Sitemaps = sitemaps
+	return queue.Enqueue(s.context.Queue, s.context.Db, parent, msg)
 }
 
-func (s *Server) createNewJob() (string, error) {
+func (s *Server) createNewJob(tenant string) (string, error) {
 	jobUUID := queue.UUID()
-	return jobUUID, s.context.Db.CreateJob(jobUUID)
+	return jobUUID, s.context.Db.CreateJob(jobUUID, tenant)
 }
 
 func newServer(cx context.Context) *Server {
-	return &Server{
+	s := &Server{
 		context: cx,
 		router:  httprouter.New(),
+		keys:    newAPIKeys(cx.Config.API.Tenants),
+		quota:   quota.New(cx.Db, cx.Config.QuotaPolicy()),
+	}
+	s.schedules, _ = db.AsScheduleStore(cx.Db)
+
+	if cx.Db != nil {
+		s.AddCheck("storage", cx.Db.Ping)
+	}
+	if cx.Queue != nil {
+		s.AddCheck("queue", cx.Queue.Ping)
+	}
+	return s
+}
+
+func (s *Server) newHTTPServer(h http.Handler) *http.Server {
+	cfg := s.context.Config.API
+
+	addr := serverPort()
+	if cfg.Port != "" {
+		addr = fmt.Sprintf(":%s", cfg.Port)
 	}
+
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+	}
+}
+
+// startSpan starts a span for a request,
+// continuing the trace of the client when the request has a traceparent header.
+func startSpan(r *http.Request, name string) *tracing.Span {
+	parent, _ := tracing.ParseTraceparent(r.Header.Get(traceparentHeader))
+	return tracing.Start(parent, name, tracing.KindServer)
 }
 
 func parseURLs(req *http.Request) ([]*url.URL, error) {
@@ -174,7 +438,7 @@ func parseURLs(req *http.Request) ([]*url.URL, error) {
 
 		u, err := url.Parse(t)
 		if err != nil {
-			log.Printf("type=parseError line=%s err=%v", t, err)
+			slog.Debug("parseError", "line", t, logging.Err(err))
 			return nil, err
 		}
 
@@ -182,13 +446,34 @@ func parseURLs(req *http.Request) ([]*url.URL, error) {
 	}
 
 	if err := s.Err(); err != nil {
-		log.Printf("type=parseError err=%v", err)
+		slog.Debug("parseError", logging.Err(err))
 		return nil, err
 	}
 
 	return urls, nil
 }
 
+// parseSitemaps returns true when the request asks to crawl the sitemaps of the seeds too.
+func parseSitemaps(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("sitemaps")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// formatUsage formats the usage of a quota with its limit, like 10/100.
+func formatUsage(used, limit int64) string {
+	return fmt.Sprintf("%d/%s", used, formatLimit(limit))
+}
+
+func formatLimit(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
 func serverPort() string {
 	if p := os.Getenv(crawlerPortKey); p != "" {
 		return fmt.Sprintf(":%s", p)
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -8,17 +9,21 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/calavera/crawler/context"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/diff"
 	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
 	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNotFound(t *testing.T) {
 	d, _ := db.NewMapConn()
-	x := context.Context{d, nil}
+	x := context.Context{Db: d}
 
 	s := newServer(x)
 
@@ -39,11 +44,12 @@ func TestNotFound(t *testing.T) {
 
 func TestFound(t *testing.T) {
 	d, _ := db.NewMapConn()
+	d.CreateJob("test", "")
 	d.ViewPage("test", "http://example.com")
 	d.Processing("test")
 	d.Save("test", "http://example.com/image.jpg")
 
-	x := context.Context{d, nil}
+	x := context.Context{Db: d}
 
 	s := newServer(x)
 
@@ -70,6 +76,49 @@ func TestFound(t *testing.T) {
 	assert.Equal(t, "http://example.com/image.jpg\n", string(b))
 }
 
+func TestStatusJSON(t *testing.T) {
+	d, _ := db.NewMapConn()
+	d.CreateJob("test", "")
+	d.ViewPage("test", "http://example.com")
+	d.Processing("test")
+
+	s := newServer(context.Context{Db: d})
+
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	r.Header.Set("Accept", "application/json")
+
+	p := httprouter.Params{{Key: "jobUUID", Value: "test"}}
+
+	w := httptest.NewRecorder()
+	s.status(w, r, p)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"processing":1,"done":0,"cancelled":false,"pageViews":[{"url":"http://example.com","hits":1}]}`, w.Body.String())
+}
+
+func TestCancel(t *testing.T) {
+	d, _ := db.NewMapConn()
+	d.CreateJob("test", "")
+
+	s := newServer(context.Context{Db: d})
+
+	r, _ := http.NewRequest("POST", "http://example.com", nil)
+
+	w := httptest.NewRecorder()
+	s.cancel(w, r, httprouter.Params{{Key: "jobUUID", Value: "missing"}})
+	assert.Equal(t, 404, w.Code)
+
+	p := httprouter.Params{{Key: "jobUUID", Value: "test"}}
+
+	w = httptest.NewRecorder()
+	s.cancel(w, r, p)
+	assert.Equal(t, 204, w.Code)
+
+	w = httptest.NewRecorder()
+	s.status(w, r, p)
+	assert.Equal(t, "- Processing: 0 URLs\n- Done: 0 URLs\n- Cancelled\n", w.Body.String())
+}
+
 func TestParseURLs(t *testing.T) {
 	testCases := []struct {
 		input string
@@ -112,7 +161,7 @@ func TestCrawl(t *testing.T) {
 	}
 	q.Subscribe(processor)
 
-	x := context.Context{d, q}
+	x := context.Context{Db: d, Queue: q}
 
 	s := newServer(x)
 	r, _ := http.NewRequest("GET", "http://example.com", strings.NewReader("http://example.com"))
@@ -131,6 +180,286 @@ func TestCrawl(t *testing.T) {
 	assert.Equal(t, 201, w.Code)
 }
 
+func TestCrawlContinuesTrace(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	defer q.Close()
+
+	msgs := make(chan *queue.Message, 1)
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		msgs <- msg
+	})
+
+	s := newServer(context.Context{Db: d, Queue: q})
+	r, _ := http.NewRequest("POST", "http://example.com/crawl", strings.NewReader("http://example.com"))
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	s.crawl(w, r, nil)
+	assert.Equal(t, 201, w.Code)
+
+	sc, err := tracing.ParseTraceparent(w.Header().Get(traceresponseHeader))
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+
+	msg := <-msgs
+	assert.Equal(t, sc.TraceID, msg.SpanContext().TraceID)
+	assert.NotEqual(t, sc.SpanID, msg.SpanContext().SpanID)
+}
+
+func TestCrawlPriority(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	defer q.Close()
+
+	msgs := make(chan *queue.Message, 1)
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		msgs <- msg
+	})
+
+	s := newServer(context.Context{Db: d, Queue: q})
+
+	r, _ := http.NewRequest("POST", "http://example.com/crawl?priority=urgent", strings.NewReader("http://example.com"))
+	w := httptest.NewRecorder()
+	s.crawl(w, r, nil)
+	assert.Equal(t, 400, w.Code)
+
+	r, _ = http.NewRequest("POST", "http://example.com/crawl?priority=high", strings.NewReader("http://example.com"))
+	w = httptest.NewRecorder()
+	s.crawl(w, r, nil)
+	assert.Equal(t, 201, w.Code)
+
+	msg := <-msgs
+	assert.Equal(t, queue.PriorityHigh, msg.Priority)
+	assert.False(t, msg.Sitemaps)
+}
+
+func TestCrawlSitemaps(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	defer q.Close()
+
+	msgs := make(chan *queue.Message, 1)
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		msgs <- msg
+	})
+
+	s := newServer(context.Context{Db: d, Queue: q})
+
+	r, _ := http.NewRequest("POST", "http://example.com/crawl?sitemaps=maybe", strings.NewReader("http://example.com"))
+	w := httptest.NewRecorder()
+	s.crawl(w, r, nil)
+	assert.Equal(t, 400, w.Code)
+
+	r, _ = http.NewRequest("POST", "http://example.com/crawl?sitemaps=true", strings.NewReader("http://example.com"))
+	w = httptest.NewRecorder()
+	s.crawl(w, r, nil)
+	assert.Equal(t, 201, w.Code)
+
+	msg := <-msgs
+	assert.True(t, msg.Sitemaps)
+}
+
+func TestAuthentication(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	defer q.Close()
+
+	msgs := make(chan *queue.Message, 1)
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		msgs <- msg
+	})
+
+	cfg := context.DefaultConfig()
+	cfg.API.Tenants = []context.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-key"}},
+		{Name: "other", Keys: []string{"other-key"}},
+	}
+	h := Handler(context.Context{Config: cfg, Db: d, Queue: q})
+
+	do := func(method, path, header, key string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader("http://example.com"))
+		if header != "" {
+			r.Header.Set(header, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("POST", "/crawl", "", "")
+	assert.Equal(t, 401, w.Code)
+	assert.NotEmpty(t, w.Header().Get(wwwAuthenticateHeader))
+
+	w = do("POST", "/crawl", authorizationHeader, "Bearer wrong-key")
+	assert.Equal(t, 401, w.Code)
+
+	w = do("POST", "/crawl", authorizationHeader, "Bearer acme-key")
+	assert.Equal(t, 201, w.Code)
+	jobUUID := w.Body.String()
+	assert.Equal(t, "acme", (<-msgs).Tenant)
+
+	info, err := d.Status(jobUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", info.Tenant)
+
+	w = do("GET", "/status/"+jobUUID, apiKeyHeader, "acme-key")
+	assert.Equal(t, 200, w.Code)
+
+	w = do("GET", "/results/"+jobUUID, apiKeyHeader, "acme-key")
+	assert.Equal(t, 200, w.Code)
+
+	for _, path := range []string{"/status/", "/results/"} {
+		w = do("GET", path+jobUUID, apiKeyHeader, "other-key")
+		assert.Equal(t, 404, w.Code, path)
+
+		w = do("GET", path+jobUUID, "", "")
+		assert.Equal(t, 401, w.Code, path)
+	}
+
+	w = do("POST", "/cancel/"+jobUUID, apiKeyHeader, "other-key")
+	assert.Equal(t, 404, w.Code)
+
+	w = do("POST", "/cancel/"+jobUUID, authorizationHeader, "bearer acme-key")
+	assert.Equal(t, 204, w.Code)
+
+	w = do("GET", "/healthz", "", "")
+	assert.Equal(t, 200, w.Code)
+
+	w = do("GET", "/metrics", "", "")
+	assert.Equal(t, 401, w.Code)
+
+	w = do("GET", "/metrics", authorizationHeader, "Bearer other-key")
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCrawlQuotas(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	defer q.Close()
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {})
+
+	cfg := context.DefaultConfig()
+	cfg.Quotas = quota.Limits{ConcurrentJobs: 1, PagesPerJob: 2}
+	h := Handler(context.Context{Config: cfg, Db: d, Queue: q})
+
+	crawl := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://example.com/crawl", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := crawl("http://example.com http://example.com/a http://example.com/b")
+	assert.Equal(t, 429, w.Code)
+	assert.Contains(t, w.Body.String(), quota.PagesPerJob)
+
+	w = crawl("http://example.com")
+	assert.Equal(t, 201, w.Code)
+
+	w = crawl("http://example.com")
+	assert.Equal(t, 429, w.Code)
+	assert.Contains(t, w.Body.String(), quota.ConcurrentJobs)
+
+	r, _ := http.NewRequest("GET", "http://example.com/quota", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "- Active jobs: 1/1\n- Pages per job: 2\n- Pages today: 0/unlimited\n- Bytes today: 0/unlimited\n", w.Body.String())
+}
+
+func TestSchedules(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	cfg := context.DefaultConfig()
+	cfg.API.Tenants = []context.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-key"}},
+		{Name: "other", Keys: []string{"other-key"}},
+	}
+	h := Handler(context.Context{Config: cfg, Db: d})
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, body := range []string{
+		`{"cron": "0 3 * * *"}`,
+		`{"cron": "every night", "seeds": ["http://example.com"]}`,
+		`{"cron": "0 3 * * *", "seeds": ["http://example.com"], "priority": "urgent"}`,
+		`cron`,
+	} {
+		w := do("POST", "/schedules", "acme-key", body)
+		assert.Equal(t, 400, w.Code, body)
+	}
+
+	w := do("POST", "/schedules", "acme-key", `{"cron": "0 3 * * *", "seeds": ["http://example.com"]}`)
+	assert.Equal(t, 201, w.Code)
+
+	var sc scheduleResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&sc))
+	assert.Equal(t, "/schedules/"+sc.ID, w.Header().Get("Location"))
+	assert.Equal(t, "normal", sc.Priority)
+	assert.Equal(t, 3, sc.NextRun.Hour())
+	assert.True(t, sc.NextRun.After(sc.Updated))
+
+	ss := d.(db.ScheduleStore)
+	stored, err := ss.Schedule(sc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", stored.Tenant)
+
+	w = do("GET", "/schedules", "other-key", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	w = do("GET", "/schedules", "acme-key", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), sc.ID)
+
+	for _, path := range []string{"/schedules/" + sc.ID, "/schedules/" + sc.ID + "/runs", "/schedules/" + queue.UUID()} {
+		w = do("GET", path, "other-key", "")
+		assert.Equal(t, 404, w.Code, path)
+	}
+
+	d.(db.RunStore).AddRun(sc.ID, db.Run{JobUUID: "job", Time: time.Now()})
+	w = do("GET", "/schedules/"+sc.ID+"/runs", "acme-key", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"jobUUID":"job"`)
+
+	w = do("PUT", "/schedules/"+sc.ID, "acme-key", `{"cron": "@hourly", "seeds": ["http://example.org"], "priority": "high", "sitemaps": true}`)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"sitemaps":true`)
+	stored, _ = ss.Schedule(sc.ID)
+	assert.Equal(t, "@hourly", stored.Cron)
+	assert.True(t, stored.Sitemaps)
+	assert.Equal(t, []string{"http://example.org"}, stored.Seeds)
+	assert.Equal(t, "acme", stored.Tenant)
+
+	w = do("DELETE", "/schedules/"+sc.ID, "other-key", "")
+	assert.Equal(t, 404, w.Code)
+
+	w = do("DELETE", "/schedules/"+sc.ID, "acme-key", "")
+	assert.Equal(t, 204, w.Code)
+
+	w = do("GET", "/schedules/"+sc.ID, "acme-key", "")
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestSchedulesUnsupported(t *testing.T) {
+	d, _ := db.NewMapConn()
+	h := Handler(context.Context{Config: context.DefaultConfig(), Db: struct{ db.Connection }{d}})
+
+	for _, method := range []string{"GET", "POST"} {
+		r, _ := http.NewRequest(method, "http://example.com/schedules", strings.NewReader(`{"cron": "0 3 * * *", "seeds": ["http://example.com"]}`))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotImplemented, w.Code, method)
+	}
+}
+
 func TestIndex(t *testing.T) {
 	x := context.Context{}
 	s := newServer(x)
@@ -160,10 +489,125 @@ func TestServerPort(t *testing.T) {
 
 func TestCreateJob(t *testing.T) {
 	d, _ := db.NewMapConn()
-	x := context.Context{d, nil}
+	x := context.Context{Db: d}
 
 	s := newServer(x)
-	j, err := s.createNewJob()
+	j, err := s.createNewJob("")
 	assert.NoError(t, err)
 	assert.NotNil(t, j)
 }
+
+func TestShutdown(t *testing.T) {
+	os.Setenv("CRAWLER_PORT", "0")
+	defer os.Setenv("CRAWLER_PORT", "")
+
+	d, _ := db.NewMapConn()
+	s := NewServer(context.Context{Db: d})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServe()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, s.Shutdown(time.Second))
+	assert.NoError(t, <-errs)
+}
+
+func TestWorkerRoutes(t *testing.T) {
+	d, _ := db.NewMapConn()
+	s := newServer(context.Context{Db: d})
+	h := s.workerRoutes()
+
+	r, _ := http.NewRequest("GET", "http://example.com/healthz", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+
+	r, _ = http.NewRequest("GET", "http://example.com/metrics", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	r, _ = http.NewRequest("POST", "http://example.com/crawl", strings.NewReader("http://example.com"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	s := newServer(context.Context{Db: d, Queue: q})
+	h := s.workerRoutes()
+
+	ready := true
+	s.AddCheck("worker", func() error {
+		if !ready {
+			return fmt.Errorf("worker draining")
+		}
+		return nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://example.com/readyz", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "[+]storage ok\n[+]queue ok\n[+]worker ok\n", w.Body.String())
+
+	ready = false
+	q.Close()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "[+]storage ok\n[-]queue failed: queue connection closed\n[-]worker failed: worker draining\n", w.Body.String())
+}
+
+func TestDiff(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	from, to, other := queue.UUID(), queue.UUID(), queue.UUID()
+	d.CreateJob(from, "acme")
+	d.CreateJob(to, "acme")
+	d.CreateJob(other, "other")
+	d.SaveMany(from, []string{"http://example.com/logo.png"})
+	d.SaveMany(to, []string{"http://example.com/new.png"})
+	d.ViewPage(from, "http://example.com")
+	d.ViewPage(to, "http://example.com")
+	hs := d.(db.PageHashStore)
+	hs.SavePageHash(from, "http://example.com", "aaaa")
+	hs.SavePageHash(to, "http://example.com", "bbbb")
+
+	cfg := context.DefaultConfig()
+	cfg.API.Tenants = []context.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-key"}},
+		{Name: "other", Keys: []string{"other-key"}},
+	}
+	h := Handler(context.Context{Config: cfg, Db: d})
+
+	do := func(path, key string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("/diff/"+from+"/"+to, "acme-key")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var report diff.Report
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, []string{"http://example.com/new.png"}, report.Images.Added)
+	assert.Equal(t, []string{"http://example.com/logo.png"}, report.Images.Removed)
+	assert.Equal(t, []string{"http://example.com"}, report.Pages.Changed)
+
+	assert.Equal(t, 404, do("/diff/"+from+"/"+other, "acme-key").Code)
+	assert.Equal(t, 404, do("/diff/"+from+"/"+to, "other-key").Code)
+	assert.Equal(t, 404, do("/diff/"+from+"/missing", "acme-key").Code)
+	assert.Equal(t, 401, do("/diff/"+from+"/"+to, "").Code)
+}
@@ -0,0 +1,31 @@
+package api
+
+import "github.com/calavera/crawler/db"
+
+// statusResponse is the representation of the job status
+// sent to clients that accept json.
+type statusResponse struct {
+	Processing int64          `json:"processing"`
+	Done       int64          `json:"done"`
+	Cancelled  bool           `json:"cancelled"`
+	PageViews  []pageResponse `json:"pageViews"`
+}
+
+type pageResponse struct {
+	URL  string `json:"url"`
+	Hits int64  `json:"hits"`
+}
+
+func newStatusResponse(info *db.Info) statusResponse {
+	pages := []pageResponse{}
+	for _, p := range info.PageViews() {
+		pages = append(pages, pageResponse{URL: p.URL, Hits: p.Hits})
+	}
+
+	return statusResponse{
+		Processing: info.Processing,
+		Done:       info.Done,
+		Cancelled:  info.Cancelled,
+		PageViews:  pages,
+	}
+}
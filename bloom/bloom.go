@@ -0,0 +1,134 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// Filter is a probabilistic set of strings.
+// Test never returns false for a string that has been added,
+// but it can return true for strings that have never been added.
+// It is safe to use from concurrent goroutines.
+type Filter struct {
+	*sync.RWMutex
+	bits []byte
+	m    uint32 // number of bits in the filter
+	k    uint32 // number of hashes per element
+}
+
+// New creates a filter with m bits and k hash functions.
+func New(m, k uint32) *Filter {
+	if m < 8 {
+		m = 8
+	}
+	if k < 1 {
+		k = 1
+	}
+
+	return &Filter{
+		RWMutex: new(sync.RWMutex),
+		bits:    make([]byte, (m+7)/8),
+		m:       m,
+		k:       k,
+	}
+}
+
+// NewWithEstimates creates a filter sized to hold n elements
+// with a false positive rate of p.
+func NewWithEstimates(n uint32, p float64) *Filter {
+	m, k := Estimate(n, p)
+	return New(m, k)
+}
+
+// Estimate calculates the number of bits and hash functions
+// needed to hold n elements with a false positive rate of p.
+func Estimate(n uint32, p float64) (uint32, uint32) {
+	m := math.Ceil(-1 * float64(n) * math.Log(p) / math.Pow(math.Log(2), 2))
+	k := math.Ceil(math.Log(2) * m / float64(n))
+	return uint32(m), uint32(k)
+}
+
+// Add inserts an element in the filter.
+func (f *Filter) Add(s string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.add(s)
+}
+
+// Test checks whether an element is probably in the filter.
+func (f *Filter) Test(s string) bool {
+	f.RLock()
+	defer f.RUnlock()
+
+	return f.test(s)
+}
+
+// TestAndAdd inserts an element in the filter
+// and returns whether it was probably there before.
+func (f *Filter) TestAndAdd(s string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.test(s) {
+		return true
+	}
+	f.add(s)
+	return false
+}
+
+// Bytes returns a copy of the bits in the filter.
+func (f *Filter) Bytes() []byte {
+	f.RLock()
+	defer f.RUnlock()
+
+	b := make([]byte, len(f.bits))
+	copy(b, f.bits)
+	return b
+}
+
+// Merge adds the elements in a different filter to this one.
+// Both filters must have been created with the same size and hashes,
+// bits with a different length are ignored.
+func (f *Filter) Merge(bits []byte) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(bits) != len(f.bits) {
+		return false
+	}
+
+	for i, b := range bits {
+		f.bits[i] |= b
+	}
+	return true
+}
+
+func (f *Filter) add(s string) {
+	h1, h2 := hashes(s)
+	for i := uint32(0); i < f.k; i++ {
+		n := (h1 + i*h2) % f.m
+		f.bits[n/8] |= 1 << (n % 8)
+	}
+}
+
+func (f *Filter) test(s string) bool {
+	h1, h2 := hashes(s)
+	for i := uint32(0); i < f.k; i++ {
+		n := (h1 + i*h2) % f.m
+		if f.bits[n/8]&(1<<(n%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashes calculates two independent hashes for an element.
+// The rest of hashes are derived from them using double hashing.
+func hashes(s string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	v := h.Sum64()
+	return uint32(v), uint32(v>>32) | 1
+}
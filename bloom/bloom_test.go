@@ -0,0 +1,53 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+
+	assert.False(t, f.Test("http://example.com"))
+	f.Add("http://example.com")
+	assert.True(t, f.Test("http://example.com"))
+	assert.False(t, f.Test("http://example.org"))
+}
+
+func TestTestAndAdd(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+
+	assert.False(t, f.TestAndAdd("http://example.com"))
+	assert.True(t, f.TestAndAdd("http://example.com"))
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("http://example.com/%d", i))
+	}
+
+	fp := 0
+	for i := 0; i < 1000; i++ {
+		if f.Test(fmt.Sprintf("http://example.org/%d", i)) {
+			fp++
+		}
+	}
+	assert.True(t, fp < 50, "too many false positives: %d", fp)
+}
+
+func TestMerge(t *testing.T) {
+	f1 := NewWithEstimates(1000, 0.01)
+	f2 := NewWithEstimates(1000, 0.01)
+
+	f1.Add("http://example.com")
+	f2.Add("http://example.org")
+
+	assert.True(t, f1.Merge(f2.Bytes()))
+	assert.True(t, f1.Test("http://example.com"))
+	assert.True(t, f1.Test("http://example.org"))
+
+	assert.False(t, f1.Merge([]byte{1}))
+}
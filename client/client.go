@@ -0,0 +1,348 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the address of the api when it runs in the local host with the default port.
+const DefaultURL = "http://localhost:3819"
+
+// Priorities of the jobs. Workers crawl pages of high priority jobs first,
+// and jobs with the same priority take turns.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+var (
+	// ErrNotFound is returned when the api doesn't know the job.
+	ErrNotFound = errors.New("job not found")
+	// ErrCancelled is returned when a job that is being watched is cancelled.
+	ErrCancelled = errors.New("job cancelled")
+	// ErrUnauthorized is returned when the api requires a key and the client has a wrong one, or none.
+	ErrUnauthorized = errors.New("invalid api key")
+)
+
+// Client talks with the crawler http api.
+type Client struct {
+	url  string
+	key  string
+	http *http.Client
+}
+
+// Page is a url found by a job and the number of times that it was found.
+type Page struct {
+	URL  string `json:"url"`
+	Hits int64  `json:"hits"`
+}
+
+// Status holds the counters of a job.
+type Status struct {
+	Processing int64  `json:"processing"`
+	Done       int64  `json:"done"`
+	Cancelled  bool   `json:"cancelled"`
+	PageViews  []Page `json:"pageViews"`
+}
+
+// Limits are the quotas of a tenant, zero values mean no limit.
+type Limits struct {
+	ConcurrentJobs int   `json:"concurrentJobs"`
+	PagesPerJob    int64 `json:"pagesPerJob"`
+	PagesPerDay    int64 `json:"pagesPerDay"`
+	BytesPerDay    int64 `json:"bytesPerDay"`
+}
+
+// Quota holds the quotas of a tenant and how much of them it used in a day.
+type Quota struct {
+	Tenant     string `json:"tenant"`
+	Day        string `json:"day"`
+	Limits     Limits `json:"limits"`
+	ActiveJobs int    `json:"activeJobs"`
+	Pages      int64  `json:"pages"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// SubmitOptions configure how a job crawls its urls.
+type SubmitOptions struct {
+	Priority string // low, normal or high, normal when it's empty.
+	Sitemaps bool   // crawl the pages listed in the sitemaps of the sites of the urls too.
+}
+
+// Changes lists the urls that differ between two jobs, sorted alphabetically.
+type Changes struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"` // pages with different content, images are not compared by content.
+	Unchanged int      `json:"unchanged"`
+}
+
+// Diff holds the images and the pages that changed between an old job and a new job.
+type Diff struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Images Changes `json:"images"`
+	Pages  Changes `json:"pages"`
+}
+
+// New creates a new client for the api listening in a given url.
+func New(url string) *Client {
+	return &Client{
+		url:  strings.TrimRight(url, "/"),
+		http: http.DefaultClient,
+	}
+}
+
+// NewWithKey creates a new client that authenticates with an api key.
+// The api only shows the jobs created with the keys of the same tenant.
+func NewWithKey(url, key string) *Client {
+	c := New(url)
+	c.key = key
+	return c
+}
+
+// Submit creates a new job to crawl the urls.
+// It returns the uuid of the job.
+func (c *Client) Submit(urls []string) (string, error) {
+	return c.SubmitPriority(urls, PriorityNormal)
+}
+
+// SubmitPriority creates a new job with a priority to crawl the urls.
+// It returns the uuid of the job.
+func (c *Client) SubmitPriority(urls []string, priority string) (string, error) {
+	return c.SubmitWithOptions(urls, SubmitOptions{Priority: priority})
+}
+
+// SubmitWithOptions creates a new job to crawl the urls with some options.
+// It returns the uuid of the job.
+func (c *Client) SubmitWithOptions(urls []string, opts SubmitOptions) (string, error) {
+	body := strings.NewReader(strings.Join(urls, "\n"))
+
+	q := url.Values{}
+	if opts.Priority != "" {
+		q.Set("priority", opts.Priority)
+	}
+	if opts.Sitemaps {
+		q.Set("sitemaps", "true")
+	}
+
+	path := "/crawl"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	res, err := c.do("POST", path, body, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Status returns the counters of a job.
+func (c *Client) Status(jobUUID string) (*Status, error) {
+	h := http.Header{"Accept": {"application/json"}}
+
+	res, err := c.do("GET", "/status/"+jobUUID, nil, h)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var s Status
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Results returns the images found by a job.
+func (c *Client) Results(jobUUID string) ([]string, error) {
+	res, err := c.do("GET", "/results/"+jobUUID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var images []string
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		if t := strings.TrimSpace(s.Text()); t != "" {
+			images = append(images, t)
+		}
+	}
+	return images, s.Err()
+}
+
+// Cancel stops a job, so it doesn't crawl new pages.
+func (c *Client) Cancel(jobUUID string) error {
+	res, err := c.do("POST", "/cancel/"+jobUUID, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Quota returns the quotas of the tenant of the client and its usage today.
+func (c *Client) Quota() (*Quota, error) {
+	h := http.Header{"Accept": {"application/json"}}
+
+	res, err := c.do("GET", "/quota", nil, h)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var q Quota
+	if err := json.NewDecoder(res.Body).Decode(&q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Diff compares the images and the pages found by two jobs, the old one first.
+func (c *Client) Diff(from, to string) (*Diff, error) {
+	var d Diff
+	if err := c.doJSON("GET", "/diff/"+from+"/"+to, nil, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// StablePolls is the number of polls in a row that must find a job with no urls processing
+// and the same counters as the previous poll to consider that it finished.
+// The storage doesn't know the urls waiting in the queue, like the seeds that were not received yet,
+// so a job is only finished when nothing changes during several intervals.
+const StablePolls = 3
+
+// Watch polls the status of a job until it finishes, calling progress with every status received.
+// A job is finished when no urls are processing and its counters don't change during StablePolls polls,
+// because the urls found in a page are queued before the page is marked as done.
+// Urls that wait in the queue for longer than that can still be crawled after Watch returns.
+// It returns ErrCancelled if the job is cancelled before finishing.
+func (c *Client) Watch(jobUUID string, interval time.Duration, progress func(*Status)) (*Status, error) {
+	var last *Status
+	var stable int
+	for {
+		s, err := c.Status(jobUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		if progress != nil {
+			progress(s)
+		}
+
+		if s.Cancelled {
+			return s, ErrCancelled
+		}
+
+		if settled(last, s) {
+			stable++
+		} else {
+			stable = 0
+		}
+		if stable >= StablePolls {
+			return s, nil
+		}
+
+		last = s
+		time.Sleep(interval)
+	}
+}
+
+func (c *Client) do(method, path string, body io.Reader, h http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return nil, ErrUnauthorized
+	}
+
+	if res.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(b)))
+	}
+
+	return res, nil
+}
+
+// doJSON sends a request with a json body, when in is not nil,
+// and decodes the json response into out, when it's not nil.
+func (c *Client) doJSON(method, path string, in, out interface{}) error {
+	h := http.Header{"Accept": {"application/json"}}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		h.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.do(method, path, body, h)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// settled returns true when a job has no urls processing and nothing changed since the last poll,
+// including the hits of the pages that the job skipped because it saw them before.
+func settled(last, current *Status) bool {
+	if last == nil || current.Processing > 0 || current.Done == 0 {
+		return false
+	}
+	return last.Processing == 0 && last.Done == current.Done && last.hits() == current.hits()
+}
+
+// hits returns the times that the job found any page.
+func (s *Status) hits() int64 {
+	var n int64
+	for _, p := range s.PageViews {
+		n += p.Hits
+	}
+	return n
+}
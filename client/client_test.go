@@ -0,0 +1,264 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/api"
+	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/crawler"
+	"github.com/calavera/crawler/crawler/sitetest"
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func startAPI(t *testing.T) (*Client, func()) {
+	return startAPIWithConfig(t, context.Config{})
+}
+
+func startAPIWithConfig(t *testing.T, cfg context.Config) (*Client, func()) {
+	d, _ := db.NewMapConn()
+	q := queue.NewPoolConn(d)
+	q.Subscribe(crawler.ProcessMessage)
+
+	s := httptest.NewServer(api.Handler(context.Context{Config: cfg, Db: d, Queue: q}))
+	return New(s.URL + "/"), func() {
+		s.Close()
+		q.Close()
+	}
+}
+
+func TestSubmitAndWatch(t *testing.T) {
+	site := sitetest.Start(sitetest.Site{
+		"/":  {Links: []string{"/a"}, Images: []string{"/logo.png"}},
+		"/a": {Images: []string{"/a.png"}},
+	})
+	defer site.Close()
+
+	c, stop := startAPI(t)
+	defer stop()
+
+	jobUUID, err := c.Submit([]string{site.PageURL("/")})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, jobUUID)
+
+	var updates int
+	s, err := c.Watch(jobUUID, 50*time.Millisecond, func(*Status) { updates++ })
+	assert.NoError(t, err)
+	assert.True(t, updates >= 2)
+	assert.Equal(t, 0, s.Processing)
+	assert.Equal(t, 2, s.Done)
+	assert.False(t, s.Cancelled)
+	assert.Len(t, s.PageViews, 2)
+
+	images, err := c.Results(jobUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, site.ImageURLs("/", "/a"), sorted(images))
+}
+
+func TestWatchWaitsForStableCounters(t *testing.T) {
+	// The second seed is received after the first one is done.
+	statuses := []string{
+		`{"processing": 1, "done": 0}`,
+		`{"processing": 0, "done": 1, "pageViews": [{"url": "/a", "hits": 1}]}`,
+		`{"processing": 0, "done": 1, "pageViews": [{"url": "/a", "hits": 1}]}`,
+		`{"processing": 0, "done": 1, "pageViews": [{"url": "/a", "hits": 2}]}`,
+		`{"processing": 1, "done": 1, "pageViews": [{"url": "/a", "hits": 2}, {"url": "/b", "hits": 1}]}`,
+		`{"processing": 0, "done": 2, "pageViews": [{"url": "/a", "hits": 2}, {"url": "/b", "hits": 1}]}`,
+	}
+	var polls int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if polls < len(statuses) {
+			w.Write([]byte(statuses[polls]))
+		} else {
+			w.Write([]byte(statuses[len(statuses)-1]))
+		}
+		polls++
+	}))
+	defer s.Close()
+
+	st, err := New(s.URL).Watch("job", time.Millisecond, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), st.Done)
+	assert.Equal(t, len(statuses)+StablePolls, polls)
+}
+
+func TestCancel(t *testing.T) {
+	c, stop := startAPI(t)
+	defer stop()
+
+	jobUUID, err := c.Submit([]string{"http://127.0.0.1:1/"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Cancel(jobUUID))
+
+	s, err := c.Watch(jobUUID, 10*time.Millisecond, nil)
+	assert.Equal(t, ErrCancelled, err)
+	assert.True(t, s.Cancelled)
+}
+
+func TestNotFound(t *testing.T) {
+	c, stop := startAPI(t)
+	defer stop()
+
+	_, err := c.Status("missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = c.Results("missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, ErrNotFound, c.Cancel("missing"))
+}
+
+func TestInvalidSubmit(t *testing.T) {
+	c, stop := startAPI(t)
+	defer stop()
+
+	_, err := c.Submit(nil)
+	assert.Error(t, err)
+}
+
+func TestSubmitPriority(t *testing.T) {
+	c, stop := startAPI(t)
+	defer stop()
+
+	_, err := c.SubmitPriority([]string{"http://example.com"}, "urgent")
+	assert.Error(t, err)
+
+	jobUUID, err := c.SubmitPriority([]string{"http://example.com"}, PriorityHigh)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, jobUUID)
+}
+
+func TestSubmitSitemaps(t *testing.T) {
+	site := sitetest.Start(sitetest.Site{
+		"/":            {Images: []string{"/logo.png"}},
+		"/sitemap.xml": {Links: []string{"/", "/hidden"}, Sitemap: true},
+		"/hidden":      {Images: []string{"/hidden.png"}},
+	})
+	defer site.Close()
+
+	c, stop := startAPI(t)
+	defer stop()
+
+	jobUUID, err := c.SubmitWithOptions([]string{site.PageURL("/")}, SubmitOptions{Sitemaps: true})
+	assert.NoError(t, err)
+
+	_, err = c.Watch(jobUUID, 50*time.Millisecond, func(*Status) {})
+	assert.NoError(t, err)
+
+	images, err := c.Results(jobUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, site.ImageURLs("/", "/hidden"), sorted(images))
+}
+
+func TestAPIKey(t *testing.T) {
+	cfg := context.DefaultConfig()
+	cfg.API.Tenants = []context.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-key"}},
+		{Name: "other", Keys: []string{"other-key"}},
+	}
+
+	anonymous, stop := startAPIWithConfig(t, cfg)
+	defer stop()
+
+	_, err := anonymous.Submit([]string{"http://127.0.0.1:1/"})
+	assert.Equal(t, ErrUnauthorized, err)
+
+	c := NewWithKey(anonymous.url, "acme-key")
+	jobUUID, err := c.Submit([]string{"http://127.0.0.1:1/"})
+	assert.NoError(t, err)
+
+	_, err = c.Status(jobUUID)
+	assert.NoError(t, err)
+
+	_, err = NewWithKey(anonymous.url, "other-key").Status(jobUUID)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestQuota(t *testing.T) {
+	cfg := context.DefaultConfig()
+	cfg.Quotas.ConcurrentJobs = 1
+
+	c, stop := startAPIWithConfig(t, cfg)
+	defer stop()
+
+	q, err := c.Quota()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Limits.ConcurrentJobs)
+	assert.Equal(t, 0, q.ActiveJobs)
+	assert.NotEmpty(t, q.Day)
+}
+
+func TestDiff(t *testing.T) {
+	site := sitetest.Start(sitetest.Site{
+		"/":  {Links: []string{"/a"}, Images: []string{"/logo.png"}},
+		"/a": {Images: []string{"/a.png"}},
+	})
+	defer site.Close()
+
+	c, stop := startAPI(t)
+	defer stop()
+
+	var jobs []string
+	for i := 0; i < 2; i++ {
+		jobUUID, err := c.Submit([]string{site.PageURL("/")})
+		assert.NoError(t, err)
+		_, err = c.Watch(jobUUID, 50*time.Millisecond, func(*Status) {})
+		assert.NoError(t, err)
+		jobs = append(jobs, jobUUID)
+	}
+
+	d, err := c.Diff(jobs[0], jobs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, jobs[0], d.From)
+	assert.Empty(t, d.Images.Added)
+	assert.Empty(t, d.Images.Removed)
+	assert.Equal(t, 2, d.Images.Unchanged)
+	assert.Empty(t, d.Pages.Changed)
+	assert.Equal(t, 2, d.Pages.Unchanged)
+
+	_, err = c.Diff(jobs[0], "missing")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSchedules(t *testing.T) {
+	c, stop := startAPI(t)
+	defer stop()
+
+	_, err := c.CreateSchedule(Template{Cron: "every night"})
+	assert.Error(t, err)
+
+	s, err := c.CreateSchedule(Template{Cron: "@daily", Seeds: []string{"http://example.com"}, Priority: PriorityLow})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, s.ID)
+	assert.Equal(t, PriorityLow, s.Priority)
+	assert.False(t, s.NextRun.IsZero())
+
+	s, err = c.UpdateSchedule(s.ID, Template{Cron: "@hourly", Seeds: []string{"http://example.org"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://example.org"}, s.Seeds)
+
+	schedules, err := c.Schedules()
+	assert.NoError(t, err)
+	if assert.Len(t, schedules, 1) {
+		assert.Equal(t, "@hourly", schedules[0].Cron)
+	}
+
+	runs, err := c.Runs(s.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, runs)
+
+	assert.NoError(t, c.DeleteSchedule(s.ID))
+	_, err = c.Schedule(s.ID)
+	assert.Equal(t, ErrScheduleNotFound, err)
+}
+
+func sorted(s []string) []string {
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrScheduleNotFound is returned when the api doesn't know the schedule.
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Template holds the settings of the jobs that a schedule creates.
+type Template struct {
+	Cron     string   `json:"cron"` // cron expression in UTC, like "0 3 * * *" or "@daily".
+	Seeds    []string `json:"seeds"`
+	Priority string   `json:"priority"` // empty for normal.
+	Sitemaps bool     `json:"sitemaps"` // crawl the pages in the sitemaps of the seeds too.
+}
+
+// Schedule is a template that creates a new job every time that its cron expression matches.
+type Schedule struct {
+	ID       string    `json:"id"`
+	Cron     string    `json:"cron"`
+	Seeds    []string  `json:"seeds"`
+	Priority string    `json:"priority"`
+	Sitemaps bool      `json:"sitemaps"`
+	Updated  time.Time `json:"updated"`
+	NextRun  time.Time `json:"nextRun"`
+}
+
+// Run is a job created by a schedule.
+// Runs that didn't create their job have the reason in Error.
+type Run struct {
+	JobUUID string    `json:"jobUUID"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error"`
+}
+
+// CreateSchedule creates a schedule that crawls the seeds of the template periodically.
+func (c *Client) CreateSchedule(t Template) (*Schedule, error) {
+	return c.schedule("POST", "/schedules", t)
+}
+
+// UpdateSchedule replaces the template of a schedule.
+func (c *Client) UpdateSchedule(id string, t Template) (*Schedule, error) {
+	return c.schedule("PUT", "/schedules/"+id, t)
+}
+
+// Schedule returns a schedule and when it runs next.
+func (c *Client) Schedule(id string) (*Schedule, error) {
+	return c.schedule("GET", "/schedules/"+id, nil)
+}
+
+// Schedules returns the schedules of the tenant of the client.
+func (c *Client) Schedules() ([]Schedule, error) {
+	var s []Schedule
+	if err := c.doJSON("GET", "/schedules", nil, &s); err != nil {
+		return nil, scheduleError(err)
+	}
+	return s, nil
+}
+
+// DeleteSchedule removes a schedule, so it doesn't create more jobs.
+// The jobs that it created are kept.
+func (c *Client) DeleteSchedule(id string) error {
+	return scheduleError(c.doJSON("DELETE", "/schedules/"+id, nil, nil))
+}
+
+// Runs returns the jobs created by a schedule, from the newest to the oldest.
+func (c *Client) Runs(id string) ([]Run, error) {
+	var r []Run
+	if err := c.doJSON("GET", "/schedules/"+id+"/runs", nil, &r); err != nil {
+		return nil, scheduleError(err)
+	}
+	return r, nil
+}
+
+func (c *Client) schedule(method, path string, t interface{}) (*Schedule, error) {
+	var s Schedule
+	if err := c.doJSON(method, path, t, &s); err != nil {
+		return nil, scheduleError(err)
+	}
+	return &s, nil
+}
+
+// scheduleError tells apart the schedules that don't exist from other resources.
+func scheduleError(err error) error {
+	if err == ErrNotFound {
+		return ErrScheduleNotFound
+	}
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/calavera/crawler/client"
+)
+
+const (
+	apiURLKey = "CRAWLER_API_URL"
+	apiKeyKey = "CRAWLER_API_KEY"
+)
+
+// clientFlags holds the flags shared by the commands that talk with the api.
+type clientFlags struct {
+	*flag.FlagSet
+	server   *string
+	key      *string
+	interval *time.Duration
+}
+
+func newClientFlags(name string) clientFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	server := os.Getenv(apiURLKey)
+	if server == "" {
+		server = client.DefaultURL
+	}
+
+	return clientFlags{
+		FlagSet:  fs,
+		server:   fs.String("server", server, "url of the crawler api, it can also be set with "+apiURLKey),
+		key:      fs.String("api-key", os.Getenv(apiKeyKey), "key to authenticate with the api, it can also be set with "+apiKeyKey),
+		interval: fs.Duration("interval", time.Second, "time between status checks when watching a job"),
+	}
+}
+
+func (f clientFlags) client() *client.Client {
+	return client.NewWithKey(*f.server, *f.key)
+}
+
+// jobArg parses the flags of commands that take a job uuid as their only argument.
+func (f clientFlags) jobArg(args []string) (string, error) {
+	if err := f.Parse(args); err != nil {
+		return "", err
+	}
+	if f.NArg() != 1 {
+		return "", fmt.Errorf("expected a job uuid")
+	}
+	return f.Arg(0), nil
+}
+
+// runSubmit creates a new job with the seeds given as arguments or read from a file.
+// It reads the seeds from the standard input when there are no arguments nor file.
+func runSubmit(args []string) error {
+	f := newClientFlags("submit")
+	file := f.String("file", "", "file with urls to crawl separated by white spaces, - reads the standard input")
+	watch := f.Bool("watch", false, "watch the job until it finishes")
+	priority := f.String("priority", client.PriorityNormal, "priority of the job: low, normal or high")
+	sitemaps := f.Bool("sitemaps", false, "crawl the pages listed in the sitemaps of the sites too")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	seeds := f.Args()
+	if *file == "" && len(seeds) == 0 {
+		*file = "-"
+	}
+
+	if *file != "" {
+		s, err := readSeeds(*file)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, s...)
+	}
+
+	if len(seeds) == 0 {
+		return fmt.Errorf("no urls to crawl")
+	}
+
+	c := f.client()
+	jobUUID, err := c.SubmitWithOptions(seeds, client.SubmitOptions{Priority: *priority, Sitemaps: *sitemaps})
+	if err != nil {
+		return err
+	}
+	fmt.Println(jobUUID)
+
+	if *watch {
+		return watchJob(c, jobUUID, *f.interval)
+	}
+	return nil
+}
+
+// runStatus prints the counters and the page views of a job.
+func runStatus(args []string) error {
+	f := newClientFlags("status")
+	jobUUID, err := f.jobArg(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := f.client().Status(jobUUID)
+	if err != nil {
+		return err
+	}
+
+	printProgress(s)
+	for _, p := range s.PageViews {
+		fmt.Printf("%s\t%d\n", p.URL, p.Hits)
+	}
+	return nil
+}
+
+// runResults prints the images found by a job, one per line.
+func runResults(args []string) error {
+	f := newClientFlags("results")
+	jobUUID, err := f.jobArg(args)
+	if err != nil {
+		return err
+	}
+
+	images, err := f.client().Results(jobUUID)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range images {
+		fmt.Println(i)
+	}
+	return nil
+}
+
+// runCancel stops a job.
+func runCancel(args []string) error {
+	f := newClientFlags("cancel")
+	jobUUID, err := f.jobArg(args)
+	if err != nil {
+		return err
+	}
+
+	return f.client().Cancel(jobUUID)
+}
+
+// runWatch prints the progress of a job until it finishes.
+// It fails if the job is cancelled.
+func runWatch(args []string) error {
+	f := newClientFlags("watch")
+	jobUUID, err := f.jobArg(args)
+	if err != nil {
+		return err
+	}
+
+	return watchJob(f.client(), jobUUID, *f.interval)
+}
+
+// runDiff prints the images and the pages that changed between two jobs, one per line,
+// prefixed with + when they were added, - when they were removed and ~ when their content changed.
+func runDiff(args []string) error {
+	f := newClientFlags("diff")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 2 {
+		return fmt.Errorf("expected the uuids of the old job and the new job")
+	}
+
+	d, err := f.client().Diff(f.Arg(0), f.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	printChanges("image", d.Images)
+	printChanges("page", d.Pages)
+	return nil
+}
+
+// runQuota prints the quotas of the tenant and its usage today, 0 means no limit.
+func runQuota(args []string) error {
+	f := newClientFlags("quota")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	q, err := f.client().Quota()
+	if err != nil {
+		return err
+	}
+
+	l := q.Limits
+	fmt.Printf("day=%s activeJobs=%d/%d pagesPerJob=%d pages=%d/%d bytes=%d/%d\n",
+		q.Day, q.ActiveJobs, l.ConcurrentJobs, l.PagesPerJob, q.Pages, l.PagesPerDay, q.Bytes, l.BytesPerDay)
+	return nil
+}
+
+func printChanges(kind string, c client.Changes) {
+	for _, u := range c.Added {
+		fmt.Printf("+ %s\t%s\n", kind, u)
+	}
+	for _, u := range c.Removed {
+		fmt.Printf("- %s\t%s\n", kind, u)
+	}
+	for _, u := range c.Changed {
+		fmt.Printf("~ %s\t%s\n", kind, u)
+	}
+}
+
+func watchJob(c *client.Client, jobUUID string, interval time.Duration) error {
+	var last *client.Status
+
+	_, err := c.Watch(jobUUID, interval, func(s *client.Status) {
+		if last == nil || last.Processing != s.Processing || last.Done != s.Done || last.Cancelled != s.Cancelled {
+			printProgress(s)
+		}
+		last = s
+	})
+	return err
+}
+
+func printProgress(s *client.Status) {
+	state := "running"
+	if s.Cancelled {
+		state = "cancelled"
+	}
+	fmt.Printf("processing=%d done=%d state=%s\n", s.Processing, s.Done, state)
+}
+
+func readSeeds(file string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var seeds []string
+	s := bufio.NewScanner(r)
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		seeds = append(seeds, s.Text())
+	}
+	return seeds, s.Err()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/calavera/crawler/context"
+)
+
+const configUsage = `Usage: crawler config print [flags]
+
+Print the effective configuration, after applying the configuration file,
+the environment variables and the flags. It fails if the configuration is not valid.
+`
+
+// runConfig runs the subcommands that inspect the node configuration.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("unknown config command\n\n%s", configUsage)
+	}
+
+	cfg, err := context.LoadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(cfg)
+	return nil
+}
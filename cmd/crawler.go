@@ -1,14 +1,72 @@
 package main
 
 import (
-	"github.com/calavera/crawler/api"
-	"github.com/calavera/crawler/context"
-	"github.com/calavera/crawler/crawler"
+	"flag"
+	"fmt"
+	"os"
 )
 
+const usage = `Usage: crawler [command]
+
+Node commands:
+  all      Serve the api and crawl urls in the same node (default)
+  serve    Serve the api, without crawling urls
+  work     Crawl urls, without serving the api
+
+Node commands accept configuration flags, run "crawler all -h" to see them.
+
+Configuration commands:
+  config print  Show the effective configuration
+
+Client commands:
+  submit    Create a new job with urls from the arguments, a file or the standard input
+  status    Show the progress of a job
+  results   Show the images found by a job
+  cancel    Stop crawling new pages for a job
+  watch     Show the progress of a job until it finishes, failing if it's cancelled
+  diff      Show the images and pages added, removed or changed between two jobs
+  quota     Show the quotas of your tenant and how much of them you used today
+  schedule  Create, list and delete recurring crawls, run "crawler schedule" to see its commands
+
+Run "crawler [command] -h" to see the options of every client command.
+`
+
+// commands maps the name of every subcommand with the function that runs it.
+var commands = map[string]func(args []string) error{
+	"all":   runNode(roleAll),
+	"serve": runNode(roleServe),
+	"work":  runNode(roleWork),
+
+	"config": runConfig,
+
+	"submit":   runSubmit,
+	"status":   runStatus,
+	"results":  runResults,
+	"cancel":   runCancel,
+	"watch":    runWatch,
+	"diff":     runDiff,
+	"quota":    runQuota,
+	"schedule": runSchedule,
+}
+
 func main() {
-	c := context.NewDefaultContext()
+	name, args := "all", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-	c.Queue.Subscribe(crawler.ProcessMessage)
-	api.StartServer(c)
+	err := cmd(args)
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "crawler %s: %v\n", name, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/calavera/crawler/api"
+	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/crawler"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/metrics"
+	"github.com/calavera/crawler/schedule"
+	"github.com/calavera/crawler/tracing"
+)
+
+// role defines what a node does.
+type role struct {
+	name  string
+	api   bool // serve the api to submit and monitor jobs.
+	crawl bool // subscribe to the queue to crawl urls.
+}
+
+var (
+	roleAll   = role{name: "all", api: true, crawl: true}
+	roleServe = role{name: "serve", api: true}
+	roleWork  = role{name: "work", crawl: true}
+)
+
+var errNotDistributed = errors.New("nodes that only serve the api or only crawl urls need Riak and Gnatsd")
+
+// runNode returns a command that starts a node with a given role.
+// The arguments are configuration flags.
+// The node runs until it receives SIGINT or SIGTERM.
+func runNode(r role) func([]string) error {
+	return func(args []string) error {
+		cfg, err := context.LoadConfig(args)
+		if err != nil {
+			return err
+		}
+
+		if err := logging.Setup(os.Stderr, cfg.Log.Format, cfg.Log.Level, cfg.NodeID); err != nil {
+			return err
+		}
+
+		if err := tracing.Setup(cfg.Tracing.URL, cfg.NodeID); err != nil {
+			return err
+		}
+
+		c, err := context.NewContext(cfg)
+		if err != nil {
+			return err
+		}
+
+		if r != roleAll && !c.Distributed() {
+			c.Close()
+			return errNotDistributed
+		}
+
+		metrics.Default.SetConstLabel("node", cfg.NodeID)
+
+		var w *crawler.Worker
+		if r.crawl {
+			if cfg.Metrics.JobLabels {
+				slog.Warn("jobMetricsEnabled", "reason", "the series of every job are kept until the node stops, only use them to debug")
+			}
+			w = crawler.NewWorker(crawlerOptions(cfg))
+			c.Queue.Subscribe(w.Process)
+		}
+
+		var sch *schedule.Scheduler
+		if r.api && cfg.Scheduler.Interval.Duration > 0 {
+			if st, ok := schedule.StorageOf(c.Db); ok {
+				sch = schedule.New(st, c.Queue, cfg.QuotaPolicy(), cfg.NodeID, cfg.Scheduler.Interval.Duration)
+				sch.Start()
+			} else {
+				slog.Warn("schedulerDisabled", "reason", "the storage doesn't keep schedules, runs and leases")
+			}
+		}
+
+		s := api.NewWorkerServer(c)
+		if r.api {
+			s = api.NewServer(c)
+		}
+		if w != nil {
+			s.AddCheck("worker", w.Ready)
+		}
+
+		go func() {
+			if err := s.ListenAndServe(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		slog.Info("nodeStarted", "role", r.name)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		slog.Info("signalReceived", "signal", (<-sig).String())
+
+		shutdown(c, s, w, sch)
+		return nil
+	}
+}
+
+// shutdown drains the node before stopping it.
+// It stops receiving requests, messages and schedules first, so no new work starts,
+// and it waits for the work in flight before closing the connections.
+func shutdown(c context.Context, s *api.Server, w *crawler.Worker, sch *schedule.Scheduler) {
+	shutdownTimeout := c.Config.ShutdownTimeout.Duration
+	deadline := time.Now().Add(shutdownTimeout)
+	slog.Info("shutdownStarted", "timeout", shutdownTimeout)
+
+	if sch != nil {
+		sch.Stop()
+	}
+
+	if err := s.Shutdown(time.Until(deadline)); err != nil {
+		slog.Error("serverShutdownError", logging.Err(err))
+	}
+
+	if w != nil {
+		if err := c.Queue.Unsubscribe(); err != nil {
+			slog.Error("unsubscribeError", logging.Err(err))
+		}
+
+		if n := w.Drain(time.Until(deadline)); n > 0 {
+			slog.Warn("crawlsAbandoned", "crawls", n)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		slog.Error("closeError", logging.Err(err))
+	}
+
+	if err := tracing.Shutdown(time.Until(deadline)); err != nil {
+		slog.Error("traceShutdownError", logging.Err(err))
+	}
+	slog.Info("shutdownFinished")
+}
+
+func crawlerOptions(cfg context.Config) crawler.Options {
+	return crawler.Options{
+		UserAgent:     cfg.Crawler.UserAgent,
+		Depth:         cfg.Crawler.Depth,
+		FetchTimeout:  cfg.Crawler.FetchTimeout.Duration,
+		CrawlDelay:    cfg.Crawler.CrawlDelay.Duration,
+		JobMetrics:    cfg.Metrics.JobLabels,
+		MaxCrawls:     cfg.Crawler.MaxCrawls,
+		Concurrency:   cfg.Crawler.Concurrency,
+		Quotas:        cfg.QuotaPolicy(),
+		Normalize:     cfg.Crawler.Normalize,
+		SeenErrorRate: cfg.Crawler.SeenErrorRate,
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/calavera/crawler/client"
+)
+
+const scheduleUsage = `Usage: crawler schedule [command] [flags]
+
+Commands:
+  create  Create a schedule that crawls the urls in the arguments periodically
+  update  Replace the cron expression, priority and urls of a schedule
+  list    Show the schedules of your tenant and when they run next
+  runs    Show the jobs created by a schedule, from the newest to the oldest
+  delete  Stop creating jobs for a schedule
+
+Cron expressions are evaluated in UTC, like "0 3 * * *" or "@daily".
+`
+
+// scheduleCommands maps the name of every schedule subcommand with the function that runs it.
+var scheduleCommands = map[string]func(args []string) error{
+	"create": runScheduleCreate,
+	"update": runScheduleUpdate,
+	"list":   runScheduleList,
+	"runs":   runScheduleRuns,
+	"delete": runScheduleDelete,
+}
+
+// runSchedule runs the subcommands that manage recurring crawls.
+func runSchedule(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing schedule command\n\n%s", scheduleUsage)
+	}
+
+	cmd, ok := scheduleCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown schedule command\n\n%s", scheduleUsage)
+	}
+	return cmd(args[1:])
+}
+
+// runScheduleCreate creates a schedule with the seeds given as arguments.
+func runScheduleCreate(args []string) error {
+	f := newClientFlags("schedule create")
+	t := templateFlags(f)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := f.client().CreateSchedule(t(f.Args()))
+	if err != nil {
+		return err
+	}
+	printSchedule(s)
+	return nil
+}
+
+// runScheduleUpdate replaces the template of the schedule in the first argument
+// with the flags and the seeds in the rest of the arguments.
+func runScheduleUpdate(args []string) error {
+	f := newClientFlags("schedule update")
+	t := templateFlags(f)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() < 1 {
+		return fmt.Errorf("expected a schedule id")
+	}
+
+	s, err := f.client().UpdateSchedule(f.Arg(0), t(f.Args()[1:]))
+	if err != nil {
+		return err
+	}
+	printSchedule(s)
+	return nil
+}
+
+// runScheduleList prints the schedules of the tenant, one per line.
+func runScheduleList(args []string) error {
+	f := newClientFlags("schedule list")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	schedules, err := f.client().Schedules()
+	if err != nil {
+		return err
+	}
+
+	for i := range schedules {
+		printSchedule(&schedules[i])
+	}
+	return nil
+}
+
+// runScheduleRuns prints the runs of a schedule, one per line.
+func runScheduleRuns(args []string) error {
+	f := newClientFlags("schedule runs")
+	id, err := f.scheduleArg(args)
+	if err != nil {
+		return err
+	}
+
+	runs, err := f.client().Runs(id)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range runs {
+		result := r.JobUUID
+		if r.Error != "" {
+			result = "error=" + r.Error
+		}
+		fmt.Printf("%s\t%s\n", r.Time.Format(time.RFC3339), result)
+	}
+	return nil
+}
+
+// runScheduleDelete removes a schedule.
+func runScheduleDelete(args []string) error {
+	f := newClientFlags("schedule delete")
+	id, err := f.scheduleArg(args)
+	if err != nil {
+		return err
+	}
+
+	return f.client().DeleteSchedule(id)
+}
+
+// scheduleArg parses the flags of commands that take a schedule id as their only argument.
+func (f clientFlags) scheduleArg(args []string) (string, error) {
+	if err := f.Parse(args); err != nil {
+		return "", err
+	}
+	if f.NArg() != 1 {
+		return "", fmt.Errorf("expected a schedule id")
+	}
+	return f.Arg(0), nil
+}
+
+// templateFlags defines the flags of the commands that send a template.
+// It returns a function that builds the template with the seeds after parsing them.
+func templateFlags(f clientFlags) func(seeds []string) client.Template {
+	cron := f.String("cron", "@daily", "cron expression in UTC that says when to create the jobs")
+	priority := f.String("priority", client.PriorityNormal, "priority of the jobs: low, normal or high")
+	sitemaps := f.Bool("sitemaps", false, "crawl the pages listed in the sitemaps of the sites too")
+
+	return func(seeds []string) client.Template {
+		return client.Template{Cron: *cron, Seeds: seeds, Priority: *priority, Sitemaps: *sitemaps}
+	}
+}
+
+func printSchedule(s *client.Schedule) {
+	fmt.Printf("%s\tcron=%q priority=%s sitemaps=%t next=%s urls=%s\n",
+		s.ID, s.Cron, s.Priority, s.Sitemaps, s.NextRun.Format(time.RFC3339), strings.Join(s.Seeds, ","))
+}
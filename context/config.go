@@ -0,0 +1,631 @@
+package context
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
+	"github.com/calavera/crawler/urlnorm"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configFileKey  = "CRAWLER_CONFIG"
+	crawlerPortKey = "CRAWLER_PORT"
+	memoryScheme   = "mem"
+	memoryURL      = memoryScheme + "://"
+)
+
+// Config holds the settings of a crawler node.
+// Settings are loaded from a json file, environment variables and flags, in that order of precedence.
+type Config struct {
+	NodeID          string          `json:"nodeId"` // name of the node in the logs and the metrics, the hostname by default.
+	Storage         StorageConfig   `json:"storage"`
+	Queue           QueueConfig     `json:"queue"`
+	Crawler         CrawlerConfig   `json:"crawler"`
+	API             APIConfig       `json:"api"`
+	Log             LogConfig       `json:"log"`
+	Metrics         MetricsConfig   `json:"metrics"`
+	Tracing         TracingConfig   `json:"tracing"`
+	Quotas          quota.Limits    `json:"quotas"` // quotas of the tenants without their own, zero values for no limit.
+	Scheduler       SchedulerConfig `json:"scheduler"`
+	ShutdownTimeout Duration        `json:"shutdownTimeout"` // time to drain the node before stopping.
+}
+
+// StorageConfig holds the settings of the storage engine.
+type StorageConfig struct {
+	URL string `json:"url"` // the scheme selects the driver registered in the db package, like riak://127.0.0.1:8087.
+}
+
+// SchedulerConfig holds the settings of the scheduled jobs.
+type SchedulerConfig struct {
+	Interval Duration `json:"interval"` // time between checks of the schedules in api nodes, 0 disables them.
+}
+
+// QueueConfig holds the settings of the queue engine.
+type QueueConfig struct {
+	URL string `json:"url"` // the scheme selects the driver registered in the queue package, like nats://127.0.0.1:4222.
+}
+
+// CrawlerConfig holds the settings used to crawl pages.
+type CrawlerConfig struct {
+	UserAgent     string        `json:"userAgent"`
+	Depth         uint          `json:"depth"`         // links followed from the urls submitted.
+	FetchTimeout  Duration      `json:"fetchTimeout"`  // time to fetch a page, 0 for no limit.
+	CrawlDelay    Duration      `json:"crawlDelay"`    // delay between requests to a host without robots.txt.
+	MaxCrawls     int           `json:"maxCrawls"`     // crawls in flight that make the node not ready, 0 for no limit.
+	Concurrency   int           `json:"concurrency"`   // crawls that a node runs at once, in priority order, 0 for no limit.
+	Normalize     urlnorm.Rules `json:"normalize"`     // how urls are normalized before checking if the job saw them.
+	SeenErrorRate float64       `json:"seenErrorRate"` // probability of skipping an url never seen by the job.
+}
+
+// APIConfig holds the settings of the http server.
+type APIConfig struct {
+	Port         string         `json:"port"`
+	ReadTimeout  Duration       `json:"readTimeout"`  // 0 for no limit.
+	WriteTimeout Duration       `json:"writeTimeout"` // 0 for no limit.
+	Tenants      []TenantConfig `json:"tenants"`      // clients allowed to use the api, empty to not authenticate requests.
+}
+
+// TenantConfig holds the api keys that authenticate the requests of a tenant.
+// Tenants only see the jobs that they create.
+type TenantConfig struct {
+	Name   string        `json:"name"`
+	Keys   []string      `json:"keys"`
+	Quotas *quota.Limits `json:"quotas,omitempty"` // overrides the default quotas.
+}
+
+// LogConfig holds the settings of the logger.
+type LogConfig struct {
+	Format string `json:"format"` // logfmt or json.
+	Level  string `json:"level"`  // debug, info, warn or error.
+}
+
+// MetricsConfig holds the settings of the metrics exposed by the node.
+type MetricsConfig struct {
+	JobLabels bool `json:"jobLabels"` // label the crawl metrics with the job uuid, one series per job, only to debug.
+}
+
+// TracingConfig holds the settings of the trace exporter.
+type TracingConfig struct {
+	URL string `json:"url"` // stdout:// or the url of an OTLP/HTTP collector, empty to not export spans.
+}
+
+// Duration is a time.Duration represented as a string in json, like "30s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes durations represented as strings.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// DefaultConfig returns the settings used when nothing else is configured.
+// Nodes use the memory engines by default.
+func DefaultConfig() Config {
+	return Config{
+		NodeID:  hostname(),
+		Storage: StorageConfig{URL: memoryURL},
+		Queue:   QueueConfig{URL: memoryURL},
+		Crawler: CrawlerConfig{
+			UserAgent:     "Fetchbot (https://github.com/PuerkitoBio/fetchbot)",
+			Depth:         1,
+			CrawlDelay:    Duration{5 * time.Second},
+			Concurrency:   32,
+			Normalize:     urlnorm.DefaultRules(),
+			SeenErrorRate: 0.01,
+		},
+		API: APIConfig{
+			Port: "3819",
+		},
+		Log: LogConfig{
+			Format: logging.FormatLogfmt,
+			Level:  "info",
+		},
+		Scheduler: SchedulerConfig{
+			Interval: Duration{30 * time.Second},
+		},
+		ShutdownTimeout: Duration{30 * time.Second},
+	}
+}
+
+// setting is a configuration value that can be overridden with an environment variable and a flag.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(*Config, string) error
+}
+
+var settings = []setting{
+	{"storage-url", "CRAWLER_STORAGE_URL", "url of the storage engine, like riak://127.0.0.1:8087", func(c *Config, v string) error {
+		c.Storage.URL = v
+		return nil
+	}},
+	{"queue-url", "CRAWLER_QUEUE_URL", "url of the queue engine, like nats://127.0.0.1:4222", func(c *Config, v string) error {
+		c.Queue.URL = v
+		return nil
+	}},
+	{"riak-url", "", "host and port of a Riak node, shortcut for -storage-url riak://host:port", func(c *Config, v string) error {
+		c.Storage.URL = riakURL(v)
+		return nil
+	}},
+	{"gnatsd-nodes", "", "Gnatsd urls separated by comma, shortcut for -queue-url", func(c *Config, v string) error {
+		c.Queue.URL = queue.NatsURL(splitNodes(v))
+		return nil
+	}},
+	{"user-agent", "CRAWLER_USER_AGENT", "user agent sent when fetching pages", func(c *Config, v string) error {
+		c.Crawler.UserAgent = v
+		return nil
+	}},
+	{"depth", "CRAWLER_DEPTH", "links followed from the urls submitted", func(c *Config, v string) error {
+		n, err := strconv.ParseUint(v, 10, 0)
+		c.Crawler.Depth = uint(n)
+		return err
+	}},
+	{"fetch-timeout", "CRAWLER_FETCH_TIMEOUT", "time to fetch a page, 0 for no limit", func(c *Config, v string) error {
+		return setDuration(&c.Crawler.FetchTimeout, v)
+	}},
+	{"crawl-delay", "CRAWLER_CRAWL_DELAY", "delay between requests to a host without robots.txt", func(c *Config, v string) error {
+		return setDuration(&c.Crawler.CrawlDelay, v)
+	}},
+	{"max-crawls", "CRAWLER_MAX_CRAWLS", "crawls in flight that make the node not ready, 0 for no limit", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Crawler.MaxCrawls = n
+		return err
+	}},
+	{"concurrency", "CRAWLER_CONCURRENCY", "crawls that a node runs at once, in priority order, 0 for no limit", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Crawler.Concurrency = n
+		return err
+	}},
+	{"seen-error-rate", "CRAWLER_SEEN_ERROR_RATE", "probability of skipping an url never seen by the job", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		c.Crawler.SeenErrorRate = f
+		return err
+	}},
+	{"tracking-params", "CRAWLER_TRACKING_PARAMS", "query parameters removed from the urls separated by comma, * matches a prefix", func(c *Config, v string) error {
+		c.Crawler.Normalize.TrackingParams = splitList(v)
+		return nil
+	}},
+	{"canonical", "CRAWLER_CANONICAL", "crawl pages once per <link rel=canonical>", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Crawler.Normalize.Canonical = b
+		return err
+	}},
+	{"port", crawlerPortKey, "port where the api is exposed", func(c *Config, v string) error {
+		c.API.Port = v
+		return nil
+	}},
+	{"api-keys", "CRAWLER_API_KEYS", "api keys of the tenants as tenant:key pairs separated by comma", func(c *Config, v string) error {
+		t, err := parseTenants(v)
+		c.API.Tenants = t
+		return err
+	}},
+	{"quota-concurrent-jobs", "CRAWLER_QUOTA_CONCURRENT_JOBS", "jobs that a tenant can run at once, 0 for no limit", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Quotas.ConcurrentJobs = n
+		return err
+	}},
+	{"quota-pages-per-job", "CRAWLER_QUOTA_PAGES_PER_JOB", "pages that a job can crawl, 0 for no limit", func(c *Config, v string) error {
+		return setInt64(&c.Quotas.PagesPerJob, v)
+	}},
+	{"quota-pages-per-day", "CRAWLER_QUOTA_PAGES_PER_DAY", "pages that a tenant can crawl in a day, 0 for no limit", func(c *Config, v string) error {
+		return setInt64(&c.Quotas.PagesPerDay, v)
+	}},
+	{"quota-bytes-per-day", "CRAWLER_QUOTA_BYTES_PER_DAY", "bytes that a tenant can download in a day, 0 for no limit", func(c *Config, v string) error {
+		return setInt64(&c.Quotas.BytesPerDay, v)
+	}},
+	{"node-id", "CRAWLER_NODE_ID", "name of the node in the logs and the metrics, the hostname by default", func(c *Config, v string) error {
+		c.NodeID = v
+		return nil
+	}},
+	{"log-format", "CRAWLER_LOG_FORMAT", "format of the log lines, logfmt or json", func(c *Config, v string) error {
+		c.Log.Format = v
+		return nil
+	}},
+	{"log-level", "CRAWLER_LOG_LEVEL", "minimum level of the log lines, debug, info, warn or error", func(c *Config, v string) error {
+		c.Log.Level = v
+		return nil
+	}},
+	{"metrics-job-labels", "CRAWLER_METRICS_JOB_LABELS", "label the crawl metrics with the job uuid, only to debug", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Metrics.JobLabels = b
+		return err
+	}},
+	{"trace-url", "CRAWLER_TRACE_URL", "exporter of the spans, stdout:// or the url of an OTLP/HTTP collector", func(c *Config, v string) error {
+		c.Tracing.URL = v
+		return nil
+	}},
+	{"schedule-interval", "CRAWLER_SCHEDULE_INTERVAL", "time between checks of the schedules in api nodes, 0 disables them", func(c *Config, v string) error {
+		return setDuration(&c.Scheduler.Interval, v)
+	}},
+	{"shutdown-timeout", "CRAWLER_SHUTDOWN_TIMEOUT", "time to drain the node before stopping", func(c *Config, v string) error {
+		return setDuration(&c.ShutdownTimeout, v)
+	}},
+}
+
+// LoadConfig loads the configuration for a node.
+// It starts with the default configuration and it applies,
+// in this order, the json or yaml file given by the flag -config or the variable CRAWLER_CONFIG,
+// the environment variables and the flags in the arguments.
+// It returns an error if the resulting configuration is not valid.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("crawler", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(configFileKey), "json or yaml file with the configuration")
+	for _, s := range settings {
+		fs.String(s.flag, "", s.usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	c := DefaultConfig()
+	if *file != "" {
+		if err := c.loadFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return Config{}, err
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(&c, f.Value.String()); e != nil {
+					err = fmt.Errorf("invalid value for -%s: %v", s.flag, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	return c, c.Validate()
+}
+
+// Validate checks that the configuration is complete and consistent.
+// Engine urls must use the scheme of a registered driver,
+// the drivers validate the rest of the url when they open the connections.
+func (c Config) Validate() error {
+	if err := validateScheme("storage", c.Storage.URL, db.Drivers()); err != nil {
+		return err
+	}
+
+	if err := validateScheme("queue", c.Queue.URL, queue.Drivers()); err != nil {
+		return err
+	}
+
+	if c.Crawler.UserAgent == "" {
+		return errors.New("the user agent cannot be empty")
+	}
+
+	if c.Crawler.MaxCrawls < 0 {
+		return errors.New("the maximum number of crawls cannot be negative")
+	}
+
+	if c.Crawler.Concurrency < 0 {
+		return errors.New("the concurrency cannot be negative")
+	}
+
+	if c.Crawler.SeenErrorRate <= 0 || c.Crawler.SeenErrorRate >= 1 {
+		return errors.New("the seen error rate must be between 0 and 1")
+	}
+
+	if _, err := logging.New(ioutil.Discard, c.Log.Format, c.Log.Level); err != nil {
+		return err
+	}
+
+	if err := tracing.ValidateURL(c.Tracing.URL); err != nil {
+		return err
+	}
+
+	if _, err := strconv.ParseUint(c.API.Port, 10, 16); err != nil {
+		return fmt.Errorf("invalid api port: %q", c.API.Port)
+	}
+
+	if err := validateTenants(c.API.Tenants); err != nil {
+		return err
+	}
+
+	if err := validateQuotas("default", c.Quotas); err != nil {
+		return err
+	}
+
+	for name, d := range map[string]Duration{
+		"fetch timeout":     c.Crawler.FetchTimeout,
+		"crawl delay":       c.Crawler.CrawlDelay,
+		"read timeout":      c.API.ReadTimeout,
+		"write timeout":     c.API.WriteTimeout,
+		"shutdown timeout":  c.ShutdownTimeout,
+		"schedule interval": c.Scheduler.Interval,
+	} {
+		if d.Duration < 0 {
+			return fmt.Errorf("the %s cannot be negative", name)
+		}
+	}
+
+	return nil
+}
+
+// redacted replaces the secrets in the printed configuration.
+const redacted = "REDACTED"
+
+// String returns the configuration formatted as json.
+// The api keys of the tenants and the passwords in the engine urls are redacted.
+func (c Config) String() string {
+	tenants := make([]TenantConfig, len(c.API.Tenants))
+	for i, t := range c.API.Tenants {
+		t.Keys = make([]string, len(t.Keys))
+		for j := range t.Keys {
+			t.Keys[j] = redacted
+		}
+		tenants[i] = t
+	}
+	c.API.Tenants = tenants
+
+	c.Storage.URL = redactURL(c.Storage.URL)
+	c.Queue.URL = redactURL(c.Queue.URL)
+	c.Tracing.URL = redactURL(c.Tracing.URL)
+
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
+
+// redactURL replaces the password of an url.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// loadFile applies a configuration file.
+// Files with the extensions .yaml and .yml are parsed as yaml, any other file as json.
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		b, err = yamlToJSON(b)
+	}
+	if err == nil {
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts a yaml document to json,
+// so yaml files are decoded with the same field names and types as json files.
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue replaces the yaml maps in a value, which can have keys of any type,
+// with json objects.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported key %v, keys must be strings", k)
+			}
+			j, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[s] = j
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			j, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = j
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+// loadEnv applies the environment variables,
+// including the variables defined by Docker links to Riak and Gnatsd containers.
+func (c *Config) loadEnv() error {
+	if h, ok := ParseRiakHost(); ok {
+		c.Storage.URL = riakURL(h)
+	}
+
+	if n, ok := ParseNatsNodes(); ok {
+		c.Queue.URL = queue.NatsURL(n)
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(c, v); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateScheme(engine, dsn string, drivers []string) error {
+	scheme, err := db.Scheme(dsn)
+	if err != nil {
+		return fmt.Errorf("invalid %s url: %q", engine, dsn)
+	}
+
+	for _, d := range drivers {
+		if d == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s driver %q, registered drivers: %v", engine, scheme, drivers)
+}
+
+// parseTenants parses api keys given as tenant:key pairs separated by comma.
+// Tenants can have several keys, to rotate them without downtime.
+func parseTenants(v string) ([]TenantConfig, error) {
+	var tenants []TenantConfig
+	index := map[string]int{}
+
+	for _, p := range strings.Split(v, ",") {
+		name, key, ok := strings.Cut(strings.TrimSpace(p), ":")
+		if !ok {
+			return nil, fmt.Errorf("expected tenant:key, got %q", p)
+		}
+
+		i, ok := index[name]
+		if !ok {
+			i = len(tenants)
+			index[name] = i
+			tenants = append(tenants, TenantConfig{Name: name})
+		}
+		tenants[i].Keys = append(tenants[i].Keys, key)
+	}
+	return tenants, nil
+}
+
+// validateTenants checks that every tenant has a unique name and keys,
+// so a key always authenticates the same tenant.
+func validateTenants(tenants []TenantConfig) error {
+	names := map[string]bool{}
+	keys := map[string]bool{}
+
+	for _, t := range tenants {
+		if t.Name == "" {
+			return errors.New("the tenant name cannot be empty")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant %q configured twice", t.Name)
+		}
+		names[t.Name] = true
+
+		if len(t.Keys) == 0 {
+			return fmt.Errorf("tenant %q has no api keys", t.Name)
+		}
+		for _, k := range t.Keys {
+			if k == "" {
+				return fmt.Errorf("tenant %q has an empty api key", t.Name)
+			}
+			if keys[k] {
+				return fmt.Errorf("tenant %q reuses an api key", t.Name)
+			}
+			keys[k] = true
+		}
+
+		if t.Quotas != nil {
+			if err := validateQuotas(fmt.Sprintf("tenant %q", t.Name), *t.Quotas); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateQuotas(owner string, l quota.Limits) error {
+	if l.ConcurrentJobs < 0 || l.PagesPerJob < 0 || l.PagesPerDay < 0 || l.BytesPerDay < 0 {
+		return fmt.Errorf("the %s quotas cannot be negative", owner)
+	}
+	return nil
+}
+
+// QuotaPolicy returns the quotas of every tenant,
+// the default quotas apply to the tenants without their own and to anonymous clients.
+func (c Config) QuotaPolicy() quota.Policy {
+	p := quota.Policy{Default: c.Quotas, Tenants: map[string]quota.Limits{}}
+	for _, t := range c.API.Tenants {
+		if t.Quotas != nil {
+			p.Tenants[t.Name] = *t.Quotas
+		}
+	}
+	return p
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+func riakURL(host string) string {
+	return "riak://" + host
+}
+
+func setInt64(dst *int64, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	*dst = n
+	return err
+}
+
+func setDuration(dst *Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	dst.Duration = d
+	return err
+}
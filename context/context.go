@@ -1,15 +1,17 @@
 package context
 
 import (
+	"fmt"
 	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"strings"
 
-	"github.com/apcera/nats"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/metrics"
 	"github.com/calavera/crawler/queue"
-	"github.com/tpjg/goriakpbc"
 )
 
 const (
@@ -22,44 +24,106 @@ const (
 // Context holds connections to external dependencies.
 // It configures the application to use specific queue and storage drivers.
 type Context struct {
-	Db    db.Connection    // client to talk with a database.
-	Queue queue.Connection // client to talk with a queue.
+	Db     db.Connection    // client to talk with a database.
+	Queue  queue.Connection // client to talk with a queue.
+	Config Config           // settings used to create the connections and run the node.
 }
 
-// NewDefaultContext initializes the application context.
-// It takes the Gnatsd nodes from an environment variable called CRAWLER_GNATSD_NODES, using nats://127.0.0.1:2222 by default.
-// It takes Riak's address from an environment variable called CRAWLER_RIAK_URL, using 127.0.0.1:8087 by default.
+// NewDefaultContext initializes the application context with the configuration
+// given by the file in CRAWLER_CONFIG and the environment variables.
+// It takes the Gnatsd nodes from an environment variable called CRAWLER_GNATSD_NODES.
+// It takes Riak's address from an environment variable called CRAWLER_RIAK_URL.
+// It uses the memory engines when those variables are not set.
+// It exits the program if the configuration is not valid or the connections fail.
 func NewDefaultContext() Context {
-	db := connectDb()
-	qu := connectQueue(db)
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
+	}
+
+	c, err := NewContext(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// NewContext connects the application with the engines in the configuration.
+func NewContext(cfg Config) (Context, error) {
+	if err := cfg.Validate(); err != nil {
+		return Context{}, err
+	}
+
+	d, err := connectDb(cfg.Storage)
+	if err != nil {
+		return Context{}, err
+	}
+
+	if _, ok := db.AsUsageStore(d); !ok && cfg.QuotaPolicy().CountsUsage() {
+		d.Close()
+		return Context{}, fmt.Errorf("the storage %s doesn't keep the usage needed by the quotas", cfg.Storage.URL)
+	}
+
+	q, err := connectQueue(cfg.Queue, d)
+	if err != nil {
+		d.Close()
+		return Context{}, err
+	}
 
 	return Context{
-		Db:    db,
-		Queue: qu,
+		Db:     d,
+		Queue:  q,
+		Config: cfg,
+	}, nil
+}
+
+// Close closes the queue before the storage,
+// so messages received in the meantime don't try to use a closed storage.
+func (c Context) Close() error {
+	qErr := c.Queue.Close()
+	dErr := c.Db.Close()
+
+	if qErr != nil {
+		return qErr
 	}
+	return dErr
 }
 
-// connectDb attempts to connect with a database.
-// The prefered database engine is Riak, but it falls back to a in memory map if Riak is not configured.
-// It exits the program if the connection fails.
-func connectDb() db.Connection {
-	if h, ok := ParseRiakHost(); ok {
-		return ConnectRiakDb(h)
+// Distributed returns whether the queue and the storage can be shared between nodes.
+// In memory engines only work when the api and the crawler run in the same node.
+func (c Context) Distributed() bool {
+	for _, dsn := range []string{c.Config.Storage.URL, c.Config.Queue.URL} {
+		if scheme, err := db.Scheme(dsn); err != nil || scheme == memoryScheme {
+			return false
+		}
+	}
+	return true
+}
+
+// connectDb opens the storage with the driver registered for the url in the configuration.
+// The connection records metrics labeled with the scheme of the url.
+func connectDb(cfg StorageConfig) (db.Connection, error) {
+	d, err := db.Open(cfg.URL)
+	if err != nil {
+		return nil, err
 	}
 
-	m, _ := db.NewMapConn()
-	return m
+	slog.Info("storageConnected", logging.URLKey, cfg.URL)
+	scheme, _ := db.Scheme(cfg.URL)
+	return metrics.InstrumentDb(d, scheme), nil
 }
 
-// connectQueue attempts to connect with the cluster of Gnatsd servers.
-// It exits the program if the connection fails.
-// It falls back to a channel pool if the nats servers are not configured.
-func connectQueue(d db.Connection) queue.Connection {
-	if servers, ok := ParseNatsNodes(); ok {
-		return ConnectNatsQueue(servers, d)
+// connectQueue opens the queue with the driver registered for the url in the configuration.
+// The connection records metrics labeled with the scheme of the url.
+func connectQueue(cfg QueueConfig, d db.Connection) (queue.Connection, error) {
+	q, err := queue.Open(cfg.URL, d)
+	if err != nil {
+		return nil, err
 	}
 
-	return queue.NewPoolConn(d)
+	slog.Info("queueConnected", logging.URLKey, cfg.URL)
+	scheme, _ := db.Scheme(cfg.URL)
+	return metrics.InstrumentQueue(q, scheme), nil
 }
 
 // ParseRiakHost decides whether to connect the application to riak or not.
@@ -70,7 +134,7 @@ func ParseRiakHost() (string, bool) {
 	if v := os.Getenv(riakDockerLinkKey); v != "" {
 		u, err := url.Parse(v)
 		if err != nil {
-			log.Printf("Malformed url: %s\n", v)
+			slog.Warn("malformedURL", "env", riakDockerLinkKey, logging.URLKey, v)
 			return "", false
 		}
 		return u.Host, true
@@ -91,45 +155,34 @@ func ParseNatsNodes() ([]string, bool) {
 	return nil, false
 }
 
-// ConnectRiakDb connects the application to the Riak cluster.
+// ConnectRiakDb connects the application to the Riak cluster with the default settings.
+// It exits the program if the connection fails.
 func ConnectRiakDb(host string) db.Connection {
-	rc := riak.NewPool(host, 5)
-
-	err := rc.Connect()
+	d, err := connectDb(StorageConfig{URL: riakURL(host)})
 	if err != nil {
-		log.Fatalf("Unable to connect to the Riak server: %v\n", err)
+		log.Fatal(err)
 	}
-
-	db, err := db.NewRiakConn(rc)
-	if err != nil {
-		log.Fatalf("Unable to create the storage buckets: %v\n", err)
-	}
-
-	log.Printf("Connected to Riak cluster in %s\n", host)
-
-	return db
+	return d
 }
 
-// ConnectNatsQueue connects the application to the Gnatsd cluster.
+// ConnectNatsQueue connects the application to the Gnatsd cluster with the default settings.
+// It exits the program if the connection fails.
 func ConnectNatsQueue(servers []string, d db.Connection) queue.Connection {
-	opts := nats.DefaultOptions
-	opts.Servers = servers
-
-	nc, err := opts.Connect()
-	if err != nil {
-		log.Fatalf("Unable to connect to the Gnatsd servers: %v\n", err)
-	}
-
-	ec, err := nats.NewEncodedConn(nc, "json")
+	q, err := connectQueue(QueueConfig{URL: queue.NatsURL(servers)}, d)
 	if err != nil {
-		log.Fatalf("Unable to encode the connection for json messages: %v\n", err)
+		log.Fatal(err)
 	}
-
-	log.Printf("Connected to Gnatsd cluster in %v\n", servers)
-
-	return queue.NewNatsConn(d, ec)
+	return q
 }
 
 func splitNodes(nodes string) []string {
 	return strings.Split(strings.Replace(nodes, " ", "", -1), ",")
 }
+
+// splitList splits a list separated by comma, an empty string is an empty list.
+func splitList(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return []string{}
+	}
+	return splitNodes(s)
+}
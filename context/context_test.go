@@ -60,3 +60,22 @@ func TestGnatsdDockerLink(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, []string{"nats://192.168.59.103:1223"}, h)
 }
+
+func TestDistributed(t *testing.T) {
+	testCases := []struct {
+		storage, queue string
+		distributed    bool
+	}{
+		{"mem://", "mem://", false},
+		{"mem://", "nats://127.0.0.1:4222", false},
+		{"riak://127.0.0.1:8087", "mem://", false},
+		{"riak://127.0.0.1:8087", "nats://127.0.0.1:4222", true},
+	}
+
+	for _, tc := range testCases {
+		c := Context{Config: DefaultConfig()}
+		c.Config.Storage.URL = tc.storage
+		c.Config.Queue.URL = tc.queue
+		assert.Equal(t, tc.distributed, c.Distributed(), "%s %s", tc.storage, tc.queue)
+	}
+}
@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/calavera/crawler/logging"
+)
+
+const canonicalSelector = `link[rel~="canonical"][href]`
+
+// canonicalViewed returns true when the page says that its canonical url is another one
+// that the job has already viewed, so its images and links are not saved again.
+// The canonical url is marked as viewed otherwise, and this page is crawled in its place.
+func (c Crawler) canonicalViewed(cx *fetchbot.Context, doc *goquery.Document) bool {
+	if !c.opts.Normalize.Canonical {
+		return false
+	}
+
+	href, ok := doc.Find(canonicalSelector).First().Attr(hrefAttr)
+	if !ok {
+		return false
+	}
+
+	abs, err := cx.Cmd.URL().Parse(href)
+	if err != nil || (abs.Scheme != "http" && abs.Scheme != "https") {
+		c.log.Debug("invalidCanonical", "href", href)
+		return false
+	}
+
+	canonical := c.opts.Normalize.URL(abs).String()
+	if canonical == c.msg.URL {
+		return false
+	}
+
+	var view bool
+	err = c.traceStorage("view_page", func() (err error) {
+		view, err = c.db.ViewPage(c.jobUUID(), canonical)
+		return err
+	})
+	if err != nil {
+		c.log.Error("viewPageError", "canonical", canonical, logging.Err(err))
+		return false
+	}
+	c.seen.Add(canonical)
+
+	if !view {
+		c.log.Debug("canonicalAlreadyViewed", "canonical", canonical)
+	}
+	return !view
+}
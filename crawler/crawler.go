@@ -1,15 +1,25 @@
 package crawler
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"log"
+	"encoding/hex"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/fetchbot"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
 	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
+	"github.com/calavera/crawler/urlnorm"
 )
 
 const (
@@ -22,13 +32,38 @@ const (
 	crawlDepth = 1
 )
 
+// Options configure how the crawler fetches pages.
+type Options struct {
+	UserAgent     string        // user agent sent in the requests.
+	Depth         uint          // links followed from the urls submitted.
+	FetchTimeout  time.Duration // time to fetch a page, 0 for no limit.
+	CrawlDelay    time.Duration // delay between requests to a host without robots.txt.
+	JobMetrics    bool          // label the metrics with the job uuid, only to debug: the series are never removed.
+	MaxCrawls     int           // crawls in flight that saturate a worker, 0 for no limit.
+	Concurrency   int           // crawls that a worker runs at once, in priority order, 0 for no limit.
+	Quotas        quota.Policy  // quotas of the tenants, enforced before crawling every page.
+	Normalize     urlnorm.Rules // how urls are normalized before checking if the job saw them.
+	SeenErrorRate float64       // probability of skipping an url never seen by the job, 0 uses DefaultSeenErrorRate.
+
+	seen *seenCache // filters of the urls seen by the jobs, set by the worker that runs the crawlers.
+}
+
+// DefaultOptions are the options used by ProcessMessage.
+var DefaultOptions = Options{
+	UserAgent:  fetchbot.DefaultUserAgent,
+	Depth:      crawlDepth,
+	CrawlDelay: fetchbot.DefaultCrawlDelay,
+	Normalize:  urlnorm.DefaultRules(),
+}
+
 // Initialize the http client with the certificates on load.
 var httpClient *http.Client
 
 func init() {
 	pool := x509.NewCertPool()
 	pool.AppendCertsFromPEM(pemCerts)
-	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	t := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	httpClient = &http.Client{Transport: instrumentedTransport{t}}
 }
 
 // Crawler is in charge of crawl a specific url received in a message.
@@ -40,34 +75,95 @@ type Crawler struct {
 
 	msg     *queue.Message
 	fetcher *fetchbot.Fetcher
+	seen    *seenFilter
+	once    *sync.Once
+	opts    Options
+	quota   *quota.Tracker
+	cached  *db.CachedPage // page crawled by a previous job of the same schedule, if any.
+	log     *slog.Logger   // adds the job, the message and its url to every line.
+	span    *tracing.Span  // continues the trace of the message.
 }
 
 // ProcessMessage initializes a crawler to parse a specific url and crawls its html looking for images.
+// Its crawlers don't remember the urls seen by the job between messages, the ones run by a Worker do.
 func ProcessMessage(q queue.Connection, d db.Connection, msg *queue.Message) {
-	log.Printf("type=messageReceived msg=%v\n", msg)
+	if c, ok := messageCrawler(q, d, msg, DefaultOptions); ok {
+		c.Crawl()
+	}
+}
 
-	view, err := d.ViewPage(msg.JobUUID, msg.URL)
+// messageCrawler initializes a crawler for the url in the message
+// when the url has not been viewed by the job yet, or when the message
+// was published again by a worker that claimed the url but didn't crawl it.
+func messageCrawler(q queue.Connection, d db.Connection, msg *queue.Message, opts Options) (*Crawler, bool) {
+	// Urls submitted to the api are normalized here, the ones found by the crawlers are already normalized.
+	// The message is copied because the queue may share it with the publisher.
+	if u := opts.Normalize.String(msg.URL); u != msg.URL {
+		m := *msg
+		m.URL = u
+		msg = &m
+	}
+
+	c := newCrawler(d, q, msg, opts)
+	c.log.Debug("messageReceived", "depth", msg.Depth)
+
+	view := msg.Claimed
+	err := c.traceStorage("view_page", func() (err error) {
+		if !view {
+			view, err = d.ViewPage(msg.JobUUID, msg.URL)
+		}
+		return err
+	})
 	if err != nil {
-		log.Printf("type=viewPageError jobUUID=%s url=%s err=%v\n", msg.JobUUID, msg.URL, err)
-		return
+		c.log.Error("viewPageError", logging.Err(err))
+		c.span.SetError(err)
+		c.skipped()
+		return nil, false
 	}
+	c.seen.Add(msg.URL)
 
 	if !view {
-		log.Printf("type=pageAlreadyViewed jobUUID=%s url=%s\n", msg.JobUUID, msg.URL)
-		return
+		c.log.Debug("pageAlreadyViewed")
+		c.span.SetAttributes("crawl.skipped", "true")
+		c.skipped()
+		return nil, false
 	}
 
-	c := newCrawler(d, q, msg)
+	c.quota = quota.New(d, opts.Quotas)
+	if err := c.quota.Allow(msg); err != nil {
+		c.quotaExceeded(err)
+		c.span.SetError(err)
+		c.skipped()
+		return nil, false
+	}
+
+	c.cached = c.cachedPage()
 	c.fetcher = fetchbot.New(fetchbot.HandlerFunc(c.crawlResponse))
-	c.fetcher.HttpClient = httpClient
-	c.Crawl()
+	c.fetcher.HttpClient = opts.httpClient(c.span.Context())
+	c.fetcher.UserAgent = opts.UserAgent
+	c.fetcher.CrawlDelay = opts.CrawlDelay
+	return c, true
 }
 
-func newCrawler(d db.Connection, q queue.Connection, m *queue.Message) *Crawler {
+func newCrawler(d db.Connection, q queue.Connection, m *queue.Message, opts Options) *Crawler {
+	s := tracing.Start(m.SpanContext(), "crawl", tracing.KindConsumer)
+	s.SetAttributes("job.uuid", m.JobUUID, "message.id", m.ID, logging.URLKey, m.URL, "crawl.depth", strconv.Itoa(int(m.Depth)))
+	if m.Tenant != "" {
+		s.SetAttributes("tenant", m.Tenant)
+	}
+	if m.Priority != queue.PriorityNormal {
+		s.SetAttributes("job.priority", m.Priority.String())
+	}
+
 	return &Crawler{
 		db:    d,
 		queue: q,
 		msg:   m,
+		seen:  opts.seenFilter(m.JobUUID),
+		once:  new(sync.Once),
+		opts:  opts,
+		log:   m.Logger(),
+		span:  s,
 	}
 }
 
@@ -75,102 +171,315 @@ func newCrawler(d db.Connection, q queue.Connection, m *queue.Message) *Crawler
 // It creates new messages for new URLs in the page.
 // It stores images found in the page.
 func (c Crawler) Crawl() {
+	defer c.span.End()
+
 	c.processing()
 	defer c.done()
 
+	if c.msg.Sitemaps {
+		c.expandSitemaps()
+	}
+
+	if c.cacheIsFresh() {
+		c.log.Info("pageUnchanged", "lastMod", c.msg.LastMod)
+		c.recordUsage(0)
+		c.reuseCachedPage()
+		return
+	}
+
 	q := c.fetcher.Start()
 
-	log.Printf("type=startCrawling jobUUID=%s url=%s\n", c.jobUUID(), c.msg.URL)
-	q.SendStringGet(c.msg.URL)
+	c.log.Info("startCrawling")
+	cmd, err := c.command()
+	if err == nil {
+		err = q.Send(cmd)
+	}
+	if err != nil {
+		c.log.Warn("crawlError", logging.Err(err))
+	}
 
 	q.Close()
-	log.Printf("type=endCrawling jobUUID=%s url=%s\n", c.jobUUID(), c.msg.URL)
+	c.shareSeenURLs()
+	c.log.Info("endCrawling")
 }
 
 func (c Crawler) crawlResponse(cx *fetchbot.Context, res *http.Response, err error) {
+	pagesFetched.Inc(statusLabel(res, err), c.jobLabel())
 	if err != nil {
-		log.Printf("type=crawlError jobUUID=%s url=%s error=%v\n", c.jobUUID(), cx.Cmd.URL(), err)
+		c.log.Warn("crawlError", "requestURL", cx.Cmd.URL().String(), logging.Err(err))
+		c.recordUsage(0)
+		return
+	}
+
+	// The content of the page is hashed while it's parsed, so diffs between jobs find the pages that changed.
+	if res.StatusCode == http.StatusNotModified && c.cached != nil {
+		c.recordUsage(0)
+		res.Body.Close()
+		c.refreshCachedPage()
+		c.reuseCachedPage()
 		return
 	}
 
-	doc, err := goquery.NewDocumentFromResponse(res)
+	body := &countingReader{r: res.Body}
+	hash := sha256.New()
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, hash), body}
+
+	var doc *goquery.Document
+	err = tracing.Do(c.span.Context(), "parse", tracing.KindInternal, func() (err error) {
+		doc, err = goquery.NewDocumentFromResponse(res)
+		return err
+	})
+	c.recordUsage(body.n)
 	if err != nil {
-		log.Printf("type=parseError jobUUID=%s url=%s error=%v\n", c.jobUUID(), cx.Cmd.URL(), err)
+		c.log.Warn("parseError", "requestURL", cx.Cmd.URL().String(), logging.Err(err))
 		return
 	}
 
-	c.crawlDocument(cx, doc)
+	if c.canonicalViewed(cx, doc) {
+		return
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	c.savePageHash(sum)
+	images, links := c.crawlDocument(cx, doc)
+	c.cachePage(res, sum, images, links)
 }
 
-func (c Crawler) crawlDocument(cx *fetchbot.Context, doc *goquery.Document) {
+// crawlDocument saves the images in a page and queues its links.
+// It returns the images and the links found.
+func (c Crawler) crawlDocument(cx *fetchbot.Context, doc *goquery.Document) ([]string, []string) {
+	var images, links []string
+
 	doc.Find(multiTagSelector).Each(func(_ int, s *goquery.Selection) {
 		if s.Is(imgSelector) {
-			c.saveImage(cx, s)
+			if src, ok := c.imageSource(cx, s); ok {
+				images = append(images, src)
+			}
 			return
 		}
 
-		if c.continueCrawling() {
-			c.enqueueURLMessage(cx, s)
+		if link, ok := c.linkURL(cx, s); ok {
+			links = append(links, link)
 		}
 	})
+
+	c.saveImages(images)
+	c.enqueueLinks(links)
+	return images, links
 }
 
-func (c Crawler) saveImage(cx *fetchbot.Context, s *goquery.Selection) {
+func (c Crawler) imageSource(cx *fetchbot.Context, s *goquery.Selection) (string, bool) {
 	src, ok := s.Attr(srcAttr)
 	if !ok {
-		log.Printf("type=unknownImageSource jobUUID=%s selector=%v\n", c.jobUUID(), s)
-		return
+		c.log.Debug("unknownImageSource")
+		return "", false
 	}
 
 	abs, err := cx.Cmd.URL().Parse(src)
 	if err != nil {
-		log.Printf("type=urlParseError jobUUID=%s src=%v err=%v\n", c.jobUUID(), src, err)
+		c.log.Debug("urlParseError", "src", src, logging.Err(err))
+		return "", false
+	}
+
+	return abs.String(), true
+}
+
+// saveImages stores all the images found in a page at once.
+func (c Crawler) saveImages(images []string) {
+	if len(images) == 0 {
 		return
 	}
 
-	err = c.db.Save(c.jobUUID(), abs.String())
+	normalized := make([]string, len(images))
+	for i, img := range images {
+		normalized[i] = c.opts.Normalize.String(img)
+	}
+	images = normalized
+
+	err := c.traceStorage("save_many", func() error {
+		return c.db.SaveMany(c.jobUUID(), images)
+	})
 	if err != nil {
-		log.Printf("type=saveError jobUUID=%s imageSrc=%v err=%v\n", c.jobUUID(), abs, err)
+		c.log.Error("saveError", "images", len(images), logging.Err(err))
+		return
 	}
+	imagesSaved.Add(float64(len(images)), c.jobLabel())
 }
 
-func (c Crawler) enqueueURLMessage(cx *fetchbot.Context, s *goquery.Selection) {
-	href, ok := s.Attr(hrefAttr)
+// savePageHash stores the hash of the content of the page in the message,
+// when the storage is able to keep it.
+func (c Crawler) savePageHash(hash string) {
+	hs, ok := db.AsPageHashStore(c.db)
 	if !ok {
-		log.Printf("type=unknownHref jobUUID=%s selector=%v\n", c.jobUUID(), s)
 		return
 	}
 
+	err := c.traceStorage("save_page_hash", func() error {
+		return hs.SavePageHash(c.jobUUID(), c.msg.URL, hash)
+	})
+	if err != nil {
+		c.log.Error("savePageHashError", logging.Err(err))
+	}
+}
+
+func (c Crawler) linkURL(cx *fetchbot.Context, s *goquery.Selection) (string, bool) {
+	href, ok := s.Attr(hrefAttr)
+	if !ok {
+		c.log.Debug("unknownHref")
+		return "", false
+	}
+
 	abs, err := cx.Cmd.URL().Parse(href)
 	if err != nil {
-		log.Printf("type=urlParseError jobUUID=%s src=%v err=%v\n", c.jobUUID(), href, err)
+		c.log.Debug("urlParseError", "href", href, logging.Err(err))
+		return "", false
+	}
+
+	return abs.String(), true
+}
+
+// enqueueLinks queues the links found in a page that the job has not seen yet,
+// unless the page is as deep as the job goes.
+func (c Crawler) enqueueLinks(links []string) {
+	if !c.continueCrawling() {
+		return
+	}
+
+	for _, link := range links {
+		c.enqueueURLMessage(link)
+	}
+}
+
+func (c Crawler) enqueueURLMessage(link string) {
+	link = c.opts.Normalize.String(link)
+	if c.seen.TestAndAdd(link) {
+		c.log.Debug("urlAlreadySeen", "link", link)
+		return
+	}
+
+	err := queue.Enqueue(c.queue, c.db, c.span.Context(), c.newMessage(link, c.msg.Depth+1))
+	if err != nil {
+		c.log.Error("publishingError", "link", link, logging.Err(err))
+	}
+}
+
+// newMessage creates a message for a url found by the job, with the settings of the job.
+func (c Crawler) newMessage(u string, depth uint) *queue.Message {
+	msg := queue.NewMessage(c.jobUUID(), u, depth)
+	msg.Tenant = c.msg.Tenant
+	msg.Priority = c.msg.Priority
+	msg.Template = c.msg.Template
+	return msg
+}
+
+// shareSeenURLs merges the urls seen by this node with the ones seen by other nodes,
+// when the storage is able to share them and the filter has enough new urls.
+func (c Crawler) shareSeenURLs() {
+	fs, ok := db.AsFilterStore(c.db)
+	if !ok || !c.seen.shareDue(time.Now()) {
 		return
 	}
 
-	err = c.queue.Publish(c.jobUUID(), abs.String(), c.msg.Depth+1)
+	var bits []byte
+	err := c.traceStorage("merge_filter", func() (err error) {
+		bits, err = fs.MergeFilter(c.jobUUID(), c.seen.Bytes())
+		return err
+	})
 	if err != nil {
-		log.Printf("type=publishingError jobUUID=%s msg=%v err=%v\n", c.jobUUID(), c.msg, err)
+		c.log.Error("mergeFilterError", logging.Err(err))
+		return
 	}
+	c.seen.Merge(bits)
 }
 
 func (c Crawler) processing() {
-	err := c.db.Processing(c.jobUUID())
+	err := c.traceStorage("processing", func() error {
+		return c.db.Processing(c.jobUUID())
+	})
 	if err != nil {
-		log.Printf("type=incProcessingError jobUUID=%s err=%v\n", c.jobUUID(), err)
+		c.log.Error("incProcessingError", logging.Err(err))
 	}
 }
 
-func (c Crawler) done() {
-	err := c.db.Done(c.jobUUID())
+// queued counts the url as queued again, when the crawl is abandoned and its message is published again.
+func (c Crawler) queued() {
+	err := c.traceStorage("queued", func() error {
+		return c.db.Queued(c.jobUUID())
+	})
 	if err != nil {
-		log.Printf("type=incDoneError jobUUID=%s err=%v\n", c.jobUUID(), err)
+		c.log.Error("incQueuedError", logging.Err(err))
 	}
 }
 
+// skipped stops counting the url as queued when it's not crawled, and ends the span of the crawl.
+func (c Crawler) skipped() {
+	err := c.traceStorage("skipped", func() error {
+		return c.db.Skipped(c.jobUUID())
+	})
+	if err != nil {
+		c.log.Error("decQueuedError", logging.Err(err))
+	}
+	c.span.End()
+}
+
+// done marks the url as done only once,
+// even if the crawl is abandoned by a worker and it finishes later.
+func (c Crawler) done() {
+	c.once.Do(func() {
+		err := c.traceStorage("done", func() error {
+			return c.db.Done(c.jobUUID())
+		})
+		if err != nil {
+			c.log.Error("incDoneError", logging.Err(err))
+		}
+	})
+}
+
+// traceStorage runs a storage operation inside a span, child of the span of the crawl.
+func (c Crawler) traceStorage(op string, fn func() error) error {
+	return tracing.Do(c.span.Context(), "storage."+op, tracing.KindClient, fn)
+}
+
 func (c Crawler) jobUUID() string {
 	return c.msg.JobUUID
 }
 
+// jobLabel returns the job uuid for the metrics when they are labeled by job.
+func (c Crawler) jobLabel() string {
+	if c.opts.JobMetrics {
+		return c.jobUUID()
+	}
+	return ""
+}
+
 func (c Crawler) continueCrawling() bool {
-	return c.msg.Depth < crawlDepth
+	return c.msg.Depth < c.opts.Depth
+}
+
+// seenFilter returns the filter of the urls seen by a job,
+// a new one when the crawler doesn't run in a worker.
+func (o Options) seenFilter(jobUUID string) *seenFilter {
+	if o.seen == nil {
+		return newSeenFilter(o.seenErrorRate())
+	}
+	return o.seen.filter(jobUUID)
+}
+
+func (o Options) seenErrorRate() float64 {
+	if o.SeenErrorRate <= 0 {
+		return DefaultSeenErrorRate
+	}
+	return o.SeenErrorRate
+}
+
+// httpClient returns a client that shares the connections with other crawlers,
+// but with its own timeout, and that records the requests as children of the parent span.
+func (o Options) httpClient(parent tracing.SpanContext) *http.Client {
+	return &http.Client{
+		Transport: tracedTransport{rt: httpClient.Transport, parent: parent},
+		Timeout:   o.FetchTimeout,
+	}
 }
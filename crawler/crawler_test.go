@@ -1,15 +1,23 @@
 package crawler
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/fetchbot"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/calavera/crawler/crawler/sitetest"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
 	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/html"
 )
@@ -39,7 +47,8 @@ func TestCrawlDocuments(t *testing.T) {
 
 	for _, e := range testCases {
 		d, _ := db.NewMapConn()
-		c := newCrawler(d, queue.NewPoolConn(d), queue.NewMessage(e.id, "http://example.com", 1))
+		d.CreateJob(e.id, "")
+		c := newCrawler(d, queue.NewPoolConn(d), queue.NewMessage(e.id, "http://example.com", 1), DefaultOptions)
 
 		doc := loadPage(t, e.page)
 		x := loadContext(t, "http://example.com")
@@ -52,17 +61,18 @@ func TestCrawlDocuments(t *testing.T) {
 
 func TestContinueCrawling(t *testing.T) {
 	d, _ := db.NewMapConn()
-	c := newCrawler(d, queue.NewPoolConn(d), queue.NewMessage("test", "http://example.com", 1))
+	c := newCrawler(d, queue.NewPoolConn(d), queue.NewMessage("test", "http://example.com", 1), DefaultOptions)
 	assert.False(t, c.continueCrawling())
 
-	c = newCrawler(d, queue.NewPoolConn(d), queue.NewMessage("test", "http://example.com", 0))
+	c = newCrawler(d, queue.NewPoolConn(d), queue.NewMessage("test", "http://example.com", 0), DefaultOptions)
 	assert.True(t, c.continueCrawling())
 }
 
 func TestCrawlHref(t *testing.T) {
 	d, _ := db.NewMapConn()
+	d.CreateJob("test", "")
 	p := queue.NewPoolConn(d)
-	c := newCrawler(d, p, queue.NewMessage("test", "http://example.com", 0))
+	c := newCrawler(d, p, queue.NewMessage("test", "http://example.com", 0), DefaultOptions)
 	x := loadContext(t, "http://example.com")
 
 	done := make(chan bool)
@@ -84,6 +94,460 @@ func TestCrawlHref(t *testing.T) {
 	assert.Equal(t, "http://example.com/images/logo.jpg", string(r[0]))
 }
 
+func TestSkipSeenURLs(t *testing.T) {
+	d, _ := db.NewMapConn()
+	d.CreateJob("seen-test", "")
+	q := &recordQueue{}
+	c := newCrawler(d, q, queue.NewMessage("seen-test", "http://example.com", 0), DefaultOptions)
+	x := loadContext(t, "http://example.com")
+
+	doc := loadPage(t, "follow_index.html")
+	c.crawlDocument(x, doc)
+	c.crawlDocument(x, doc)
+
+	assert.Equal(t, []string{"http://example.com/follow"}, q.urls)
+}
+
+func TestShareSeenURLs(t *testing.T) {
+	d, _ := db.NewMapConn()
+	d.CreateJob("share-test", "")
+	c1 := newCrawler(d, &recordQueue{}, queue.NewMessage("share-test", "http://example.com", 0), DefaultOptions)
+	c2 := newCrawler(d, &recordQueue{}, queue.NewMessage("share-test", "http://example.com", 0), DefaultOptions)
+	c2.seen.Add("http://example.com")
+
+	x := loadContext(t, "http://example.com")
+	c1.crawlDocument(x, loadPage(t, "follow_index.html"))
+	assert.False(t, c2.seen.Test("http://example.com/follow"))
+
+	c1.shareSeenURLs()
+	c2.shareSeenURLs()
+	assert.True(t, c2.seen.Test("http://example.com/follow"))
+
+	// New urls are not shared until there are enough of them or enough time passed.
+	c1.seen.Add("http://example.com/new")
+	c1.shareSeenURLs()
+	c2.seen.Add("http://example.com/other")
+	c2.shareSeenURLs()
+	assert.False(t, c2.seen.Test("http://example.com/new"))
+}
+
+func TestSeenFilterShareDue(t *testing.T) {
+	f := newSeenFilter(DefaultSeenErrorRate)
+	now := time.Now()
+	assert.False(t, f.shareDue(now))
+
+	f.Add("http://example.com")
+	assert.True(t, f.shareDue(now))
+
+	f.Add("http://example.com/a")
+	f.Add("http://example.com/a")
+	assert.False(t, f.shareDue(now))
+	assert.True(t, f.shareDue(now.Add(seenShareInterval)))
+
+	for i := 0; i < seenShareEvery; i++ {
+		f.Add(fmt.Sprintf("http://example.com/%d", i))
+	}
+	assert.True(t, f.shareDue(now.Add(seenShareInterval)))
+}
+
+func TestWorkerSeenCache(t *testing.T) {
+	w1, w2 := NewWorker(DefaultOptions), NewWorker(DefaultOptions)
+	w1.opts.seenFilter("job").Add("http://example.com")
+
+	assert.True(t, w1.opts.seenFilter("job").Test("http://example.com"))
+	assert.False(t, w2.opts.seenFilter("job").Test("http://example.com"))
+	assert.False(t, DefaultOptions.seenFilter("job").Test("http://example.com"))
+}
+
+func TestLogCorrelation(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	var b bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	d, _ := db.NewMapConn()
+	msg := queue.NewMessage(queue.UUID(), "http://example.com/", 0)
+	msg.Tenant = "acme"
+	d.CreateJob(msg.JobUUID, msg.Tenant)
+	d.ViewPage(msg.JobUUID, msg.URL)
+
+	_, ok := messageCrawler(&recordQueue{}, d, msg, DefaultOptions)
+	assert.False(t, ok)
+
+	var line map[string]interface{}
+	dec := json.NewDecoder(&b)
+	for dec.More() && line["msg"] != "pageAlreadyViewed" {
+		line = nil
+		assert.NoError(t, dec.Decode(&line))
+	}
+
+	assert.Equal(t, "pageAlreadyViewed", line["msg"])
+	assert.Equal(t, msg.JobUUID, line[logging.JobKey])
+	assert.Equal(t, msg.ID, line[logging.MessageKey])
+	assert.Equal(t, msg.URL, line[logging.URLKey])
+	assert.Equal(t, msg.Tenant, line[logging.TenantKey])
+}
+
+func TestTracePropagation(t *testing.T) {
+	var b bytes.Buffer
+	prev := tracing.SetExporter(tracing.NewWriterExporter(&b))
+
+	s := sitetest.Start(sitetest.Site{
+		"/": {Links: []string{"/follow"}, Images: []string{"/logo.png"}},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	q := &recordQueue{}
+	parent := tracing.Start(tracing.SpanContext{}, "POST /crawl", tracing.KindServer)
+
+	msg := queue.NewMessage(queue.UUID(), s.PageURL("/"), 0)
+	msg.Traceparent = parent.Context().Traceparent()
+	msg.Tenant = "acme"
+	d.CreateJob(msg.JobUUID, msg.Tenant)
+	ProcessMessage(q, d, msg)
+	tracing.SetExporter(prev)
+
+	spans := make(map[string]tracing.SpanData)
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var sd tracing.SpanData
+		assert.NoError(t, dec.Decode(&sd))
+		if sd.TraceID == parent.Context().TraceID.String() {
+			spans[sd.Name] = sd
+		}
+	}
+
+	crawl := spans["crawl"]
+	assert.Equal(t, parent.Context().SpanID.String(), crawl.ParentID)
+	for _, name := range []string{"fetch", "parse", "queue.publish", "storage.view_page", "storage.save_many", "storage.done"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, crawl.SpanID, spans[name].ParentID, name)
+		}
+	}
+
+	if assert.Len(t, q.msgs, 1) {
+		assert.Equal(t, spans["queue.publish"].SpanID, q.msgs[0].SpanContext().SpanID.String())
+		assert.Equal(t, msg.Tenant, q.msgs[0].Tenant)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":  {Images: []string{"/logo.png"}},
+		"/a": {},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "acme")
+
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+	opts.Quotas = quota.Policy{Tenants: map[string]quota.Limits{"acme": {PagesPerDay: 1}}}
+
+	msg := queue.NewMessage(jobUUID, s.PageURL("/"), 0)
+	msg.Tenant = "acme"
+	c, ok := messageCrawler(&recordQueue{}, d, msg, opts)
+	if assert.True(t, ok) {
+		c.Crawl()
+	}
+
+	st, err := quota.New(d, opts.Quotas).Status("acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.Pages)
+	assert.True(t, st.Bytes > 0)
+
+	msg = queue.NewMessage(jobUUID, s.PageURL("/a"), 1)
+	msg.Tenant = "acme"
+	_, ok = messageCrawler(&recordQueue{}, d, msg, opts)
+	assert.False(t, ok)
+
+	info, err := d.Status(jobUUID)
+	assert.NoError(t, err)
+	assert.True(t, info.Cancelled)
+	// Quotas are checked after the job claims the page.
+	assert.Equal(t, 2, len(info.PageViews()))
+}
+
+func TestPageHashes(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":  {Images: []string{"/logo.png"}},
+		"/a": {Images: []string{"/bg.png"}},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+
+	crawl := func(path string) string {
+		jobUUID := queue.UUID()
+		d.CreateJob(jobUUID, "")
+
+		c, ok := messageCrawler(&recordQueue{}, d, queue.NewMessage(jobUUID, s.PageURL(path), 1), opts)
+		if assert.True(t, ok) {
+			c.Crawl()
+		}
+
+		h, err := d.(db.PageHashStore).PageHashes(jobUUID)
+		assert.NoError(t, err)
+		assert.Len(t, h, 1)
+		return h[s.PageURL(path)]
+	}
+
+	root := crawl("/")
+	assert.Len(t, root, 64)
+	assert.Equal(t, root, crawl("/"))
+	assert.NotEqual(t, root, crawl("/a"))
+}
+
+func TestIncrementalCrawl(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":  {Links: []string{"/a"}, Images: []string{"/logo.png"}, ETag: `"v1"`},
+		"/a": {},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+	template := queue.UUID()
+
+	crawl := func(template string) (string, *recordQueue) {
+		jobUUID := queue.UUID()
+		d.CreateJob(jobUUID, "")
+
+		msg := queue.NewMessage(jobUUID, s.PageURL("/"), 0)
+		msg.Template = template
+		q := &recordQueue{}
+		c, ok := messageCrawler(q, d, msg, opts)
+		if assert.True(t, ok) {
+			c.Crawl()
+		}
+		return jobUUID, q
+	}
+
+	first, _ := crawl(template)
+	p, err := d.(db.PageCache).CachedPage(template, s.PageURL("/"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, p) {
+		assert.Equal(t, `"v1"`, p.ETag)
+		assert.Equal(t, s.ImageURLs("/"), p.Images)
+		assert.Equal(t, []string{s.PageURL("/a")}, p.Links)
+	}
+
+	second, q := crawl(template)
+	assert.Equal(t, 1, s.NotModified("/"))
+	r, _ := d.Results(second)
+	assert.Equal(t, 1, len(r))
+	if assert.Len(t, q.msgs, 1) {
+		assert.Equal(t, s.PageURL("/a"), q.msgs[0].URL)
+		assert.Equal(t, template, q.msgs[0].Template)
+	}
+
+	hs := d.(db.PageHashStore)
+	h1, _ := hs.PageHashes(first)
+	h2, _ := hs.PageHashes(second)
+	assert.Equal(t, h1, h2)
+
+	// Jobs without a schedule always download the pages.
+	crawl("")
+	assert.Equal(t, 3, s.Hits("/"))
+	assert.Equal(t, 1, s.NotModified("/"))
+}
+
+func TestIncrementalCrawlWithoutPageCache(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/": {Images: []string{"/logo.png"}, ETag: `"v1"`},
+	})
+	defer s.Close()
+
+	m, _ := db.NewMapConn()
+	d := struct{ db.Connection }{m}
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+
+	for i := 0; i < 2; i++ {
+		jobUUID := queue.UUID()
+		d.CreateJob(jobUUID, "")
+
+		msg := queue.NewMessage(jobUUID, s.PageURL("/"), 0)
+		msg.Template = "nightly"
+		c, ok := messageCrawler(&recordQueue{}, d, msg, opts)
+		if assert.True(t, ok) {
+			c.Crawl()
+		}
+
+		r, _ := d.Results(jobUUID)
+		assert.Equal(t, 1, len(r))
+	}
+	assert.Equal(t, 2, s.Hits("/"))
+	assert.Equal(t, 0, s.NotModified("/"))
+}
+
+func TestSitemaps(t *testing.T) {
+	lastMod := time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC)
+	s := sitetest.Start(sitetest.Site{
+		"/":            {Links: []string{"/a"}},
+		"/sitemap.xml": {Links: []string{"/", "/b", "/c"}, Sitemap: true},
+		"/b":           {},
+		"/c":           {Images: []string{"/logo.png"}, LastMod: lastMod},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	msg := queue.NewMessage(jobUUID, s.PageURL("/"), 0)
+	msg.Sitemaps = true
+	msg.Template = queue.UUID()
+	q := &recordQueue{}
+	c, ok := messageCrawler(q, d, msg, opts)
+	if assert.True(t, ok) {
+		c.Crawl()
+	}
+
+	if assert.Len(t, q.msgs, 3) {
+		for i, path := range []string{"/b", "/c", "/a"} {
+			assert.Equal(t, s.PageURL(path), q.msgs[i].URL)
+			assert.False(t, q.msgs[i].Sitemaps)
+			assert.Equal(t, msg.Template, q.msgs[i].Template)
+		}
+		assert.Equal(t, 0, q.msgs[0].Depth)
+		assert.True(t, q.msgs[0].LastMod.IsZero())
+		assert.Equal(t, lastMod, q.msgs[1].LastMod)
+		assert.Equal(t, 1, q.msgs[2].Depth)
+	}
+
+	// Pages cached after their lastmod are not requested.
+	d.(db.PageCache).CachePage(msg.Template, s.PageURL("/c"), &db.CachedPage{
+		ETag:    `"v1"`,
+		Hash:    "aaaa",
+		Images:  []string{s.PageURL("/logo.png")},
+		Crawled: lastMod.Add(time.Hour),
+	})
+	c, ok = messageCrawler(q, d, q.msgs[1], opts)
+	if assert.True(t, ok) {
+		c.Crawl()
+	}
+	assert.Equal(t, 0, s.Hits("/c"))
+	h, _ := d.(db.PageHashStore).PageHashes(jobUUID)
+	assert.Equal(t, "aaaa", h[s.PageURL("/c")])
+}
+
+func TestNormalizeURLs(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":  {Links: []string{"/a", "/a#top", "/a?utm_source=foo", "/b/../a", "/x?b=2&a=1", "/x?a=1&b=2"}, Images: []string{"/logo.png", "/./logo.png#x"}},
+		"/a": {},
+		"/x": {},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	q := &recordQueue{}
+	c, ok := messageCrawler(q, d, queue.NewMessage(jobUUID, s.PageURL("/#top"), 0), opts)
+	if assert.True(t, ok) {
+		c.Crawl()
+	}
+
+	var links []string
+	for _, m := range q.msgs {
+		links = append(links, m.URL)
+	}
+	assert.Equal(t, []string{s.PageURL("/a"), s.PageURL("/x?a=1&b=2")}, links)
+
+	r, _ := d.Results(jobUUID)
+	assert.Equal(t, [][]byte{[]byte(s.PageURL("/logo.png"))}, r)
+
+	_, ok = messageCrawler(q, d, queue.NewMessage(jobUUID, s.PageURL("/?utm_medium=email"), 0), opts)
+	assert.False(t, ok)
+}
+
+func TestCanonical(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":     {Images: []string{"/logo.png"}},
+		"/copy": {Images: []string{"/copy.png"}, Canonical: "/"},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	opts := DefaultOptions
+	opts.CrawlDelay = 0
+
+	crawl := func(jobUUID, path string) bool {
+		c, ok := messageCrawler(&recordQueue{}, d, queue.NewMessage(jobUUID, s.PageURL(path), 0), opts)
+		if ok {
+			c.Crawl()
+		}
+		return ok
+	}
+
+	first := queue.UUID()
+	d.CreateJob(first, "")
+	assert.True(t, crawl(first, "/"))
+	assert.True(t, crawl(first, "/copy"))
+	r, _ := d.Results(first)
+	assert.Equal(t, [][]byte{[]byte(s.PageURL("/logo.png"))}, r)
+
+	// The copy is crawled in place of the canonical page when it's found first.
+	second := queue.UUID()
+	d.CreateJob(second, "")
+	assert.True(t, crawl(second, "/copy"))
+	assert.False(t, crawl(second, "/"))
+	r, _ = d.Results(second)
+	assert.Equal(t, [][]byte{[]byte(s.PageURL("/copy.png"))}, r)
+	assert.Equal(t, 2, s.Hits("/copy"))
+	assert.Equal(t, 1, s.Hits("/"))
+}
+
+func TestSeenCacheEviction(t *testing.T) {
+	c := newSeenCache(2, DefaultSeenErrorRate)
+
+	f := c.filter("job1")
+	assert.True(t, f == c.filter("job1"))
+
+	c.filter("job2")
+	c.filter("job3")
+	assert.Equal(t, 2, len(c.filters))
+	assert.False(t, f == c.filter("job1"))
+}
+
+type recordQueue struct {
+	urls []string
+	msgs []*queue.Message
+}
+
+func (q *recordQueue) Publish(msg *queue.Message) error {
+	q.urls = append(q.urls, msg.URL)
+	q.msgs = append(q.msgs, msg)
+	return nil
+}
+
+func (q *recordQueue) Subscribe(p queue.Processor) {}
+
+func (q *recordQueue) Unsubscribe() error {
+	return nil
+}
+
+func (q *recordQueue) Ping() error {
+	return nil
+}
+
+func (q *recordQueue) Close() error {
+	return nil
+}
+
 func loadContext(t *testing.T, s string) *fetchbot.Context {
 	u, err := url.Parse(s)
 	if err != nil {
@@ -0,0 +1,128 @@
+package crawler
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+)
+
+// conditionalCmd is a GET request that only downloads the page when it changed.
+type conditionalCmd struct {
+	*fetchbot.Cmd
+	header http.Header
+}
+
+// Header implements fetchbot.HeaderProvider.
+func (c conditionalCmd) Header() http.Header {
+	return c.header
+}
+
+// command returns the request for the url in the message.
+// Pages cached by previous jobs of the same schedule are requested with their validators.
+func (c Crawler) command() (fetchbot.Command, error) {
+	u, err := url.Parse(c.msg.URL)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &fetchbot.Cmd{U: u, M: "GET"}
+
+	if c.cached == nil || (c.cached.ETag == "" && c.cached.LastModified == "") {
+		return cmd, nil
+	}
+
+	h := http.Header{}
+	if c.cached.ETag != "" {
+		h.Set("If-None-Match", c.cached.ETag)
+	}
+	if c.cached.LastModified != "" {
+		h.Set("If-Modified-Since", c.cached.LastModified)
+	}
+	return conditionalCmd{Cmd: cmd, header: h}, nil
+}
+
+// cachedPage returns the page in the message as a previous job of the same schedule crawled it.
+// Jobs submitted to the api, and storages that don't implement db.PageCache, don't cache pages.
+func (c Crawler) cachedPage() *db.CachedPage {
+	pc, ok := db.AsPageCache(c.db)
+	if c.msg.Template == "" || !ok {
+		return nil
+	}
+
+	var p *db.CachedPage
+	err := c.traceStorage("cached_page", func() (err error) {
+		p, err = pc.CachedPage(c.msg.Template, c.msg.URL)
+		return err
+	})
+	if err != nil {
+		c.log.Error("cachedPageError", logging.Err(err))
+		return nil
+	}
+	return p
+}
+
+// reuseCachedPage saves the images and queues the links of a page that didn't change,
+// like if it was downloaded again.
+func (c Crawler) reuseCachedPage() {
+	c.log.Debug("pageNotModified")
+
+	c.savePageHash(c.cached.Hash)
+	c.saveImages(c.cached.Images)
+	c.enqueueLinks(c.cached.Links)
+}
+
+// cachePage stores the validators of a page and what the crawler found in it,
+// so the next job of the schedule doesn't download it again if it doesn't change.
+// Pages without validators are not cached, they can't be requested conditionally.
+func (c Crawler) cachePage(res *http.Response, hash string, images, links []string) {
+	if c.msg.Template == "" || res.StatusCode != http.StatusOK {
+		return
+	}
+
+	p := &db.CachedPage{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Hash:         hash,
+		Images:       images,
+		Links:        links,
+		Crawled:      time.Now().UTC(),
+	}
+	if p.ETag == "" && p.LastModified == "" {
+		return
+	}
+
+	c.storeCachedPage(p)
+}
+
+// refreshCachedPage records that the site said that the cached page is still current.
+func (c Crawler) refreshCachedPage() {
+	p := *c.cached
+	p.Crawled = time.Now().UTC()
+	c.storeCachedPage(&p)
+}
+
+// cacheIsFresh returns true when the sitemap of the site says that the page
+// didn't change since it was cached, so it's not requested at all.
+func (c Crawler) cacheIsFresh() bool {
+	if c.cached == nil || c.cached.Crawled.IsZero() || c.msg.LastMod.IsZero() {
+		return false
+	}
+	return !c.msg.LastMod.After(c.cached.Crawled)
+}
+
+func (c Crawler) storeCachedPage(p *db.CachedPage) {
+	pc, ok := db.AsPageCache(c.db)
+	if !ok {
+		return
+	}
+
+	err := c.traceStorage("cache_page", func() error {
+		return pc.CachePage(c.msg.Template, c.msg.URL, p)
+	})
+	if err != nil {
+		c.log.Error("cachePageError", logging.Err(err))
+	}
+}
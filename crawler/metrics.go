@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/calavera/crawler/metrics"
+)
+
+var (
+	pagesFetched = metrics.NewCounter("crawler_pages_fetched_total",
+		"Pages fetched by status code, error when the request failed.", "status", "job_uuid")
+	fetchDuration = metrics.NewHistogram("crawler_fetch_duration_seconds",
+		"Time until the response headers are received, by status code.", metrics.DefaultBuckets, "status")
+	imagesSaved = metrics.NewCounter("crawler_images_saved_total",
+		"Images saved in the storage.", "job_uuid")
+	sitemapURLs = metrics.NewCounter("crawler_sitemap_urls_total",
+		"Urls found in sitemaps and queued as seeds.", "job_uuid")
+	crawlsInFlight = metrics.NewGauge("crawler_worker_crawls_in_flight",
+		"Pages being crawled by the worker.")
+	scheduledMessages = metrics.NewGauge("crawler_worker_scheduled_messages",
+		"Messages received by the worker waiting to be crawled, by priority.", "priority")
+)
+
+// instrumentedTransport records the latency of every request sent by the crawlers.
+type instrumentedTransport struct {
+	rt http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.rt.RoundTrip(r)
+	fetchDuration.Observe(time.Since(start).Seconds(), statusLabel(res, err))
+	return res, err
+}
+
+func statusLabel(res *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(res.StatusCode)
+}
@@ -0,0 +1,60 @@
+package crawler
+
+import (
+	"io"
+
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/quota"
+)
+
+// countingReader counts the bytes of a response body read by the parser.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// recordUsage adds the page crawled to the daily usage of the tenant.
+func (c Crawler) recordUsage(bytes int64) {
+	if c.opts.Quotas.IsZero() {
+		return
+	}
+
+	err := c.traceStorage("add_usage", func() error {
+		return c.quota.Record(c.msg.Tenant, bytes)
+	})
+	if err != nil {
+		c.log.Error("recordUsageError", logging.Err(err))
+	}
+}
+
+// quotaExceeded logs why a page is not crawled.
+// Jobs of tenants that run out of their daily quotas are cancelled,
+// so they finish instead of dropping their pages until the next day.
+func (c Crawler) quotaExceeded(err error) {
+	e, ok := err.(*quota.ExceededError)
+	if !ok {
+		c.log.Error("quotaError", logging.Err(err))
+		return
+	}
+
+	c.log.Info("quotaExceeded", "quota", e.Quota, "limit", e.Limit)
+	if e.Quota != quota.PagesPerDay && e.Quota != quota.BytesPerDay {
+		return
+	}
+
+	if err := c.db.Cancel(c.jobUUID()); err != nil {
+		c.log.Error("cancelError", logging.Err(err))
+		return
+	}
+	c.log.Info("jobCancelled", "quota", e.Quota)
+}
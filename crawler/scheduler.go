@@ -0,0 +1,200 @@
+package crawler
+
+import (
+	"sync"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+)
+
+// priorityWeights are the turns that every priority gets in a scheduling round,
+// so high priority jobs go first without starving the jobs with lower priorities.
+var priorityWeights = map[queue.Priority]int{
+	queue.PriorityHigh:   4,
+	queue.PriorityNormal: 2,
+	queue.PriorityLow:    1,
+}
+
+// scheduledPerCrawl is the number of messages that a scheduler keeps waiting for every goroutine.
+// Deliveries wait when the scheduler is full, so the worker stops pulling messages from the queue.
+const scheduledPerCrawl = 16
+
+// delivery is a message received from the queue waiting to be processed.
+type delivery struct {
+	q   queue.Connection
+	d   db.Connection
+	msg *queue.Message
+}
+
+// level holds the messages of the jobs with the same priority.
+// Jobs take turns in round robin, a message each,
+// so a job with many pages doesn't delay the jobs submitted after it.
+type level struct {
+	priority queue.Priority
+	jobs     []string // jobs with messages, in turn order.
+	messages map[string][]delivery
+	next     int
+}
+
+func (l *level) push(dl delivery) {
+	j := dl.msg.JobUUID
+	if _, ok := l.messages[j]; !ok {
+		l.jobs = append(l.jobs, j)
+	}
+	l.messages[j] = append(l.messages[j], dl)
+}
+
+func (l *level) pop() delivery {
+	j := l.jobs[l.next]
+	m := l.messages[j]
+	dl := m[0]
+
+	if len(m) == 1 {
+		delete(l.messages, j)
+		l.jobs = append(l.jobs[:l.next], l.jobs[l.next+1:]...)
+	} else {
+		l.messages[j] = m[1:]
+		l.next++
+	}
+
+	if l.next >= len(l.jobs) {
+		l.next = 0
+	}
+	return dl
+}
+
+func (l *level) empty() bool {
+	return len(l.jobs) == 0
+}
+
+// scheduler processes the messages received by a worker with a fixed number of goroutines.
+// Priorities take weighted turns, and jobs with the same priority take turns between them.
+// It holds a bounded number of messages waiting.
+type scheduler struct {
+	*sync.Mutex
+	cond    *sync.Cond // signals new messages.
+	room    *sync.Cond // signals free space for more messages.
+	process queue.Processor
+	levels  map[queue.Priority]*level
+	turns   []queue.Priority // weighted round of priorities.
+	turn    int
+	size    int // messages waiting.
+	max     int // messages waiting that make push wait.
+	stopped bool
+}
+
+// newScheduler starts a scheduler that processes messages in n goroutines,
+// holding up to scheduledPerCrawl messages per goroutine.
+func newScheduler(n int, process queue.Processor) *scheduler {
+	s := &scheduler{
+		Mutex:   new(sync.Mutex),
+		process: process,
+		levels:  make(map[queue.Priority]*level),
+		max:     n * scheduledPerCrawl,
+	}
+	s.cond = sync.NewCond(s.Mutex)
+	s.room = sync.NewCond(s.Mutex)
+
+	for _, p := range queue.Priorities {
+		s.levels[p] = &level{priority: p, messages: make(map[string][]delivery)}
+		for i := 0; i < priorityWeights[p]; i++ {
+			s.turns = append(s.turns, p)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		go s.run()
+	}
+	return s
+}
+
+// push adds a message to the scheduler, waiting while the scheduler is full.
+// It returns false when the scheduler is stopped.
+func (s *scheduler) push(q queue.Connection, d db.Connection, msg *queue.Message) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for s.size >= s.max && !s.stopped {
+		s.room.Wait()
+	}
+	if s.stopped {
+		return false
+	}
+
+	l := s.levels[schedulingPriority(msg.Priority)]
+	l.push(delivery{q, d, msg})
+	s.size++
+	scheduledMessages.Inc(l.priority.String())
+	s.cond.Signal()
+	return true
+}
+
+// stop stops processing messages and returns the messages that were waiting.
+// Messages being processed are not interrupted.
+func (s *scheduler) stop() []delivery {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stopped = true
+	s.cond.Broadcast()
+	s.room.Broadcast()
+
+	var pending []delivery
+	for _, p := range queue.Priorities {
+		l := s.levels[p]
+		for !l.empty() {
+			pending = append(pending, l.pop())
+			scheduledMessages.Dec(p.String())
+			s.size--
+		}
+	}
+	return pending
+}
+
+func (s *scheduler) run() {
+	for {
+		dl, ok := s.next()
+		if !ok {
+			return
+		}
+		s.process(dl.q, dl.d, dl.msg)
+	}
+}
+
+// next waits for the next message to process.
+// It returns false when the scheduler is stopped.
+func (s *scheduler) next() (delivery, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for {
+		if s.stopped {
+			return delivery{}, false
+		}
+
+		for i := 0; i < len(s.turns); i++ {
+			p := s.turns[s.turn]
+			s.turn = (s.turn + 1) % len(s.turns)
+
+			if l := s.levels[p]; !l.empty() {
+				scheduledMessages.Dec(p.String())
+				s.size--
+				s.room.Signal()
+				return l.pop(), true
+			}
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// schedulingPriority maps unknown priorities, from newer nodes, to the closest known one.
+func schedulingPriority(p queue.Priority) queue.Priority {
+	switch {
+	case p > queue.PriorityHigh:
+		return queue.PriorityHigh
+	case p < queue.PriorityLow:
+		return queue.PriorityLow
+	}
+	return p
+}
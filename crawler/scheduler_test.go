@@ -0,0 +1,144 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerFairness(t *testing.T) {
+	release := make(chan struct{})
+	processed := make(chan string, 10)
+
+	s := newScheduler(1, func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		if msg.URL == "bulk-0" {
+			<-release
+		}
+		processed <- msg.URL
+	})
+	defer s.stop()
+
+	push := func(jobUUID, url string, p queue.Priority) {
+		msg := queue.NewMessage(jobUUID, url, 0)
+		msg.Priority = p
+		assert.True(t, s.push(nil, nil, msg))
+	}
+
+	push("bulk", "bulk-0", queue.PriorityNormal)
+	waitForScheduled(t, s)
+
+	push("bulk", "bulk-1", queue.PriorityNormal)
+	push("bulk", "bulk-2", queue.PriorityNormal)
+	push("bulk", "bulk-3", queue.PriorityNormal)
+	push("small", "small-0", queue.PriorityNormal)
+	push("small", "small-1", queue.PriorityNormal)
+	push("urgent", "urgent-0", queue.PriorityHigh)
+	push("later", "later-0", queue.PriorityLow)
+	close(release)
+
+	var order []string
+	for i := 0; i < 8; i++ {
+		select {
+		case u := <-processed:
+			order = append(order, u)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("messages not processed: %v", order)
+		}
+	}
+
+	pos := make(map[string]int)
+	for i, u := range order {
+		pos[u] = i
+	}
+
+	// bulk-0 was already running, and the other messages take turns:
+	// the urgent job goes in the first round, the small job alternates with the bulk job
+	// and the low priority job doesn't wait until the end.
+	assert.Equal(t, 0, pos["bulk-0"])
+	assert.True(t, pos["urgent-0"] < pos["bulk-2"], "%v", order)
+	assert.True(t, pos["small-0"] < pos["bulk-2"], "%v", order)
+	assert.True(t, pos["small-1"] < pos["bulk-3"], "%v", order)
+	assert.True(t, pos["later-0"] < pos["bulk-3"], "%v", order)
+	assert.True(t, pos["bulk-1"] < pos["bulk-2"] && pos["bulk-2"] < pos["bulk-3"], "%v", order)
+}
+
+func TestSchedulerStop(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	s := newScheduler(1, func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		started <- struct{}{}
+		<-release
+	})
+	defer close(release)
+
+	jobUUID := queue.UUID()
+	assert.True(t, s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/0", 0)))
+	<-started
+
+	assert.True(t, s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/1", 0)))
+	assert.True(t, s.push(nil, nil, queue.NewMessage(queue.UUID(), "http://example.com/2", 0)))
+
+	pending := s.stop()
+	assert.Len(t, pending, 2)
+	assert.False(t, s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/3", 0)))
+}
+
+func TestSchedulerFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	s := newScheduler(1, func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		started <- struct{}{}
+		<-release
+	})
+	defer close(release)
+	s.max = 1
+
+	jobUUID := queue.UUID()
+	assert.True(t, s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/0", 0)))
+	<-started
+	assert.True(t, s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/1", 0)))
+
+	// The scheduler is full, so the delivery waits until the scheduler stops.
+	pushed := make(chan bool)
+	go func() {
+		pushed <- s.push(nil, nil, queue.NewMessage(jobUUID, "http://example.com/2", 0))
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("message scheduled over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Len(t, s.stop(), 1)
+	assert.False(t, <-pushed)
+}
+
+func TestSchedulingPriority(t *testing.T) {
+	assert.Equal(t, queue.PriorityHigh, schedulingPriority(queue.Priority(7)))
+	assert.Equal(t, queue.PriorityLow, schedulingPriority(queue.Priority(-3)))
+	assert.Equal(t, queue.PriorityNormal, schedulingPriority(queue.PriorityNormal))
+}
+
+// waitForScheduled waits until the scheduler takes all the messages pushed.
+func waitForScheduled(t *testing.T, s *scheduler) {
+	for i := 0; i < 100; i++ {
+		s.Lock()
+		empty := true
+		for _, l := range s.levels {
+			empty = empty && l.empty()
+		}
+		s.Unlock()
+
+		if empty {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("messages not scheduled")
+}
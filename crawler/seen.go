@@ -0,0 +1,110 @@
+package crawler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/calavera/crawler/bloom"
+)
+
+// DefaultSeenErrorRate is the probability that the filter of a job says that it saw an url that it never saw.
+// Those urls are never crawled by the job, the filters trade that loss for fewer messages and storage requests.
+const DefaultSeenErrorRate = 0.01
+
+const (
+	seenCapacity      = 100000           // expected number of urls per job
+	seenMaxJobs       = 64               // number of job filters kept in memory
+	seenShareEvery    = 1000             // new urls that make a node share the filter of a job
+	seenShareInterval = 30 * time.Second // time after which a node shares the filter of a job with new urls
+)
+
+// seenCache is a bounded collection of bloom filters indexed by job.
+// It evicts the filter of the oldest job when it's full.
+// Every worker has its own cache, crawlers outside workers use a new filter for every message.
+type seenCache struct {
+	*sync.Mutex
+	filters   map[string]*seenFilter
+	jobs      []string
+	max       int
+	errorRate float64
+}
+
+func newSeenCache(max int, errorRate float64) *seenCache {
+	return &seenCache{
+		Mutex:     new(sync.Mutex),
+		filters:   map[string]*seenFilter{},
+		max:       max,
+		errorRate: errorRate,
+	}
+}
+
+// filter returns the filter for a job, creating it if it doesn't exist.
+func (c *seenCache) filter(jobUUID string) *seenFilter {
+	c.Lock()
+	defer c.Unlock()
+
+	if f, ok := c.filters[jobUUID]; ok {
+		return f
+	}
+
+	if len(c.jobs) >= c.max {
+		delete(c.filters, c.jobs[0])
+		c.jobs = c.jobs[1:]
+	}
+
+	f := newSeenFilter(c.errorRate)
+	c.filters[jobUUID] = f
+	c.jobs = append(c.jobs, jobUUID)
+
+	return f
+}
+
+// seenFilter is the filter of the urls seen by a job in this node.
+// It counts the urls added since the node shared it, so the node
+// doesn't send the whole filter to the storage after every page.
+type seenFilter struct {
+	*bloom.Filter
+	mu     *sync.Mutex
+	added  int       // urls added since the filter was shared.
+	shared time.Time // when the filter was shared, zero if it never was.
+}
+
+func newSeenFilter(errorRate float64) *seenFilter {
+	return &seenFilter{
+		Filter: bloom.NewWithEstimates(seenCapacity, errorRate),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// Add inserts an url in the filter.
+func (f *seenFilter) Add(u string) {
+	f.TestAndAdd(u)
+}
+
+// TestAndAdd inserts an url in the filter and returns whether it was probably there before.
+func (f *seenFilter) TestAndAdd(u string) bool {
+	if f.Filter.TestAndAdd(u) {
+		return true
+	}
+
+	f.mu.Lock()
+	f.added++
+	f.mu.Unlock()
+	return false
+}
+
+// shareDue returns true when the filter has seenShareEvery new urls,
+// or when it has new urls and it was shared more than seenShareInterval ago.
+// The first crawl of a job in a node always shares it, to get the urls seen by other nodes.
+// It resets the count of new urls when it returns true.
+func (f *seenFilter) shareDue(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.added == 0 || (f.added < seenShareEvery && now.Sub(f.shared) < seenShareInterval) {
+		return false
+	}
+	f.added = 0
+	f.shared = now
+	return true
+}
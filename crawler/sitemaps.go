@@ -0,0 +1,51 @@
+package crawler
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/sitemap"
+	"github.com/calavera/crawler/tracing"
+)
+
+// expandSitemaps queues the pages listed in the sitemaps of the site of the url as seeds of the job.
+// The pages keep the lastmod of the sitemap, so crawls of schedules skip the ones that didn't change.
+func (c Crawler) expandSitemaps() {
+	u, err := url.Parse(c.msg.URL)
+	if err != nil {
+		c.log.Debug("urlParseError", logging.Err(err))
+		return
+	}
+
+	span := tracing.Start(c.span.Context(), "sitemap", tracing.KindInternal)
+	defer span.End()
+
+	f := sitemap.Fetcher{Client: c.opts.httpClient(span.Context()), UserAgent: c.opts.UserAgent}
+	pages, err := f.Discover(u)
+	if err != nil {
+		c.log.Warn("sitemapError", logging.Err(err))
+		span.SetError(err)
+	}
+
+	var queued int
+	for _, p := range pages {
+		loc := c.opts.Normalize.String(p.Loc)
+		if c.seen.TestAndAdd(loc) {
+			continue
+		}
+
+		msg := c.newMessage(loc, 0)
+		msg.LastMod = p.LastMod
+		if err := queue.Enqueue(c.queue, c.db, span.Context(), msg); err != nil {
+			c.log.Error("publishingError", "link", loc, logging.Err(err))
+			continue
+		}
+		queued++
+	}
+
+	span.SetAttributes("sitemap.urls", strconv.Itoa(queued))
+	sitemapURLs.Add(float64(queued), c.jobLabel())
+	c.log.Info("sitemapsExpanded", "urls", queued)
+}
@@ -0,0 +1,220 @@
+package sitetest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+)
+
+const robots = "User-agent: *\nCrawl-delay: 0.001\n"
+
+// Page describes a page in a fixture site.
+type Page struct {
+	Links     []string      // paths linked from the page
+	Images    []string      // paths of the images included in the page
+	Status    int           // status code of the response, 200 by default
+	Redirect  string        // path where the page redirects to, if any
+	Delay     time.Duration // time to wait before responding
+	ETag      string        // validator of the page, requests that send it back get a 304
+	Sitemap   bool          // render the links of the page as a sitemap instead of html
+	LastMod   time.Time     // when the page changed, in the sitemaps that link it
+	Canonical string        // path in the <link rel=canonical> of the page, if any
+}
+
+// Site is a collection of pages indexed by path.
+type Site map[string]Page
+
+// Tree generates a site where every page links to fanout pages
+// until it reaches the given depth. The root page is at depth zero.
+// Every page includes a number of images, and pages are named after their position in the tree,
+// for instance "/", "/0", "/0/1".
+func Tree(depth, fanout, images int) Site {
+	s := Site{}
+	tree(s, "/", depth, fanout, images)
+	return s
+}
+
+func tree(s Site, path string, depth, fanout, images int) {
+	p := Page{}
+	prefix := path
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	for i := 0; i < images; i++ {
+		p.Images = append(p.Images, fmt.Sprintf("%s/image%d.png", prefix, i))
+	}
+
+	if depth > 0 {
+		for i := 0; i < fanout; i++ {
+			child := fmt.Sprintf("%s/%d", prefix, i)
+			p.Links = append(p.Links, child)
+			tree(s, child, depth-1, fanout, images)
+		}
+	}
+
+	s[path] = p
+}
+
+// Server serves a fixture site over http.
+// It counts the number of requests received by every page.
+type Server struct {
+	*httptest.Server
+	*sync.Mutex
+	site        Site
+	hits        map[string]int
+	notModified map[string]int
+}
+
+// Start starts a new server for a site.
+// The server includes a robots.txt with a very short crawl delay,
+// and it serves every image path in the site.
+func Start(site Site) *Server {
+	s := &Server{
+		Mutex:       new(sync.Mutex),
+		site:        site,
+		hits:        map[string]int{},
+		notModified: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// PageURL returns the absolute url for a path in the site.
+func (s *Server) PageURL(path string) string {
+	return s.Server.URL + path
+}
+
+// ImageURLs returns the absolute urls of the images in a set of pages, sorted alphabetically.
+func (s *Server) ImageURLs(paths ...string) []string {
+	seen := map[string]bool{}
+	var urls []string
+
+	for _, p := range paths {
+		for _, i := range s.site[p].Images {
+			if u := s.PageURL(i); !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// Hits returns the number of requests received by a path.
+func (s *Server) Hits(path string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.hits[path]
+}
+
+// NotModified returns the number of requests to a path answered with a 304.
+func (s *Server) NotModified(path string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.notModified[path]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/robots.txt" {
+		fmt.Fprint(w, robots)
+		return
+	}
+
+	s.Lock()
+	s.hits[r.URL.Path]++
+	s.Unlock()
+
+	p, ok := s.site[r.URL.Path]
+	if !ok {
+		if s.isImage(r.URL.Path) {
+			w.Header().Set("Content-Type", "image/png")
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if p.Delay > 0 {
+		time.Sleep(p.Delay)
+	}
+
+	if p.Redirect != "" {
+		http.Redirect(w, r, p.Redirect, http.StatusFound)
+		return
+	}
+
+	if p.Status != 0 && p.Status != http.StatusOK {
+		http.Error(w, http.StatusText(p.Status), p.Status)
+		return
+	}
+
+	if p.ETag != "" {
+		w.Header().Set("ETag", p.ETag)
+		if r.Header.Get("If-None-Match") == p.ETag {
+			s.Lock()
+			s.notModified[r.URL.Path]++
+			s.Unlock()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if p.Sitemap {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(s.renderSitemap(p))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(render(p))
+}
+
+func (s *Server) isImage(path string) bool {
+	for _, p := range s.site {
+		for _, i := range p.Images {
+			if i == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func render(p Page) []byte {
+	b := bytes.NewBufferString("<html>\n")
+	if p.Canonical != "" {
+		fmt.Fprintf(b, "  <head><link rel=\"canonical\" href=\"%s\"></head>\n", p.Canonical)
+	}
+	b.WriteString("  <body>\n")
+	for _, l := range p.Links {
+		fmt.Fprintf(b, "    <a href=\"%s\"></a>\n", l)
+	}
+	for _, i := range p.Images {
+		fmt.Fprintf(b, "    <img src=\"%s\" />\n", i)
+	}
+	b.WriteString("  </body>\n</html>\n")
+	return b.Bytes()
+}
+
+// renderSitemap lists the links of a page in a sitemap, with the lastmod of the pages that have one.
+func (s *Server) renderSitemap(p Page) []byte {
+	b := bytes.NewBufferString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	b.WriteString("<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n")
+	for _, l := range p.Links {
+		fmt.Fprintf(b, "  <url><loc>%s</loc>", s.PageURL(l))
+		if m := s.site[l].LastMod; !m.IsZero() {
+			fmt.Fprintf(b, "<lastmod>%s</lastmod>", m.UTC().Format(time.RFC3339))
+		}
+		b.WriteString("</url>\n")
+	}
+	b.WriteString("</urlset>\n")
+	return b.Bytes()
+}
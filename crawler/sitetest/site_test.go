@@ -0,0 +1,85 @@
+package sitetest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTree(t *testing.T) {
+	s := Tree(2, 2, 1)
+
+	assert.Equal(t, 7, len(s))
+	assert.Equal(t, []string{"/0", "/1"}, s["/"].Links)
+	assert.Equal(t, []string{"/0/0", "/0/1"}, s["/0"].Links)
+	assert.Equal(t, []string{"/0/1/image0.png"}, s["/0/1"].Images)
+	assert.Empty(t, s["/0/1"].Links)
+}
+
+func TestServer(t *testing.T) {
+	s := Start(Site{
+		"/":         Page{Links: []string{"/a"}, Images: []string{"/logo.png"}},
+		"/error":    Page{Status: http.StatusInternalServerError},
+		"/redirect": Page{Redirect: "/"},
+	})
+	defer s.Close()
+
+	res, err := http.Get(s.PageURL("/redirect"))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.True(t, strings.Contains(string(b), `<a href="/a"></a>`))
+	assert.True(t, strings.Contains(string(b), `<img src="/logo.png" />`))
+
+	res, err = http.Get(s.PageURL("/error"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	res, err = http.Get(s.PageURL("/logo.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.Equal(t, 1, s.Hits("/"))
+	assert.Equal(t, 1, s.Hits("/redirect"))
+	assert.Equal(t, []string{s.PageURL("/logo.png")}, s.ImageURLs("/", "/error"))
+}
+
+func TestServerSitemap(t *testing.T) {
+	s := Start(Site{
+		"/sitemap.xml": Page{Links: []string{"/", "/a"}, Sitemap: true},
+		"/a":           Page{LastMod: time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC)},
+	})
+	defer s.Close()
+
+	res, err := http.Get(s.PageURL("/sitemap.xml"))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Contains(t, string(b), "<url><loc>"+s.PageURL("/")+"</loc></url>")
+	assert.Contains(t, string(b), "<url><loc>"+s.PageURL("/a")+"</loc><lastmod>2015-06-01T03:00:00Z</lastmod></url>")
+}
+
+func TestServerETag(t *testing.T) {
+	s := Start(Site{"/": Page{ETag: `"v1"`}})
+	defer s.Close()
+
+	res, err := http.Get(s.PageURL("/"))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"v1"`, res.Header.Get("ETag"))
+
+	r, _ := http.NewRequest("GET", s.PageURL("/"), nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	res, err = http.DefaultClient.Do(r)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	assert.Equal(t, 2, s.Hits("/"))
+	assert.Equal(t, 1, s.NotModified("/"))
+}
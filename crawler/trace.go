@@ -0,0 +1,32 @@
+package crawler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/calavera/crawler/tracing"
+)
+
+// tracedTransport records a span for every request sent by a crawler,
+// as a child of the span of the crawl.
+// The trace context is not sent to the crawled sites.
+type tracedTransport struct {
+	rt     http.RoundTripper
+	parent tracing.SpanContext
+}
+
+func (t tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	s := tracing.Start(t.parent, "fetch", tracing.KindClient)
+	defer s.End()
+
+	s.SetAttributes("http.method", r.Method, "http.url", r.URL.String())
+
+	res, err := t.rt.RoundTrip(r)
+	if err != nil {
+		s.SetError(err)
+		return nil, err
+	}
+
+	s.SetAttributes("http.status_code", strconv.Itoa(res.StatusCode))
+	return res, nil
+}
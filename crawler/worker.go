@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/queue"
+)
+
+// Worker processes messages from the queue keeping track of the crawls in flight,
+// so a node can drain them before stopping.
+type Worker struct {
+	*sync.Mutex
+	crawls    map[*Crawler]bool
+	wg        *sync.WaitGroup
+	opts      Options
+	sched     *scheduler // nil when the concurrency is not limited.
+	stopping  bool
+	abandoned bool
+}
+
+// NewWorker creates a new worker ready to process messages with the given options.
+// Workers with limited concurrency schedule the messages by priority and job.
+// Every worker remembers the urls seen by the jobs that it crawls.
+func NewWorker(opts Options) *Worker {
+	opts.seen = newSeenCache(seenMaxJobs, opts.seenErrorRate())
+
+	w := &Worker{
+		Mutex:  new(sync.Mutex),
+		crawls: make(map[*Crawler]bool),
+		wg:     new(sync.WaitGroup),
+		opts:   opts,
+	}
+	if opts.Concurrency > 0 {
+		w.sched = newScheduler(opts.Concurrency, w.crawl)
+	}
+	return w
+}
+
+// Process is a queue.Processor that crawls the url in the message in a new goroutine,
+// or schedules it when the concurrency of the worker is limited.
+// Scheduling waits while the scheduler is full, so the queue stops delivering messages to the node.
+// Messages received after the worker starts draining are published again,
+// so other nodes can process them.
+func (w *Worker) Process(q queue.Connection, d db.Connection, msg *queue.Message) {
+	if w.sched == nil {
+		go w.crawl(q, d, msg)
+		return
+	}
+
+	if !w.sched.push(q, d, msg) {
+		w.requeue(q, d, msg)
+	}
+}
+
+func (w *Worker) crawl(q queue.Connection, d db.Connection, msg *queue.Message) {
+	if !w.start() {
+		w.requeue(q, d, msg)
+		return
+	}
+	defer w.wg.Done()
+
+	c, ok := messageCrawler(q, d, msg, w.opts)
+	if !ok {
+		return
+	}
+
+	if !w.track(c) {
+		c.log.Warn("crawlAbandoned")
+		c.span.End()
+		w.requeue(q, d, claimed(c.msg))
+		return
+	}
+	defer w.untrack(c)
+
+	c.Crawl()
+}
+
+// errDraining is returned by Ready when the worker stops processing new messages.
+var errDraining = errors.New("worker draining")
+
+// Ready returns an error when the worker cannot take more work,
+// because it's draining or because it has as many crawls in flight as its limit.
+func (w *Worker) Ready() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stopping {
+		return errDraining
+	}
+	if w.opts.MaxCrawls > 0 && len(w.crawls) >= w.opts.MaxCrawls {
+		return fmt.Errorf("worker saturated: %d crawls in flight", len(w.crawls))
+	}
+	return nil
+}
+
+// Drain stops processing new messages and waits for the crawls in flight to finish.
+// Scheduled messages that didn't start are published again.
+// Crawls that don't finish before the timeout are published again, so other nodes crawl their urls,
+// and they are marked as done and counted as queued, so the counters of their jobs don't leak when the node stops.
+// It returns the number of crawls abandoned.
+func (w *Worker) Drain(timeout time.Duration) int {
+	w.Lock()
+	w.stopping = true
+	w.Unlock()
+
+	if w.sched != nil {
+		for _, dl := range w.sched.stop() {
+			w.requeue(dl.q, dl.d, dl.msg)
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.abandoned = true
+	for c := range w.crawls {
+		c.log.Warn("crawlAbandoned")
+		c.queued()
+		w.requeue(c.queue, c.db, claimed(c.msg))
+		c.done()
+	}
+	return len(w.crawls)
+}
+
+func (w *Worker) start() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stopping {
+		return false
+	}
+	w.wg.Add(1)
+	return true
+}
+
+func (w *Worker) track(c *Crawler) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.abandoned {
+		return false
+	}
+	w.crawls[c] = true
+	crawlsInFlight.Inc()
+	return true
+}
+
+func (w *Worker) untrack(c *Crawler) {
+	w.Lock()
+	defer w.Unlock()
+
+	delete(w.crawls, c)
+	crawlsInFlight.Dec()
+}
+
+// claimed returns a copy of a message whose url was viewed by a crawl that didn't finish,
+// so the crawler that receives it doesn't skip it.
+func claimed(msg *queue.Message) *queue.Message {
+	m := *msg
+	m.Claimed = true
+	return &m
+}
+
+// requeue publishes a message again. The message is still counted as queued for its job,
+// so it stops counting when the queue doesn't take it.
+func (w *Worker) requeue(q queue.Connection, d db.Connection, msg *queue.Message) {
+	err := q.Publish(msg)
+	if err != nil {
+		msg.Logger().Error("requeueError", logging.Err(err))
+		if err := d.Skipped(msg.JobUUID); err != nil {
+			msg.Logger().Error("decQueuedError", logging.Err(err))
+		}
+		return
+	}
+	msg.Logger().Info("messageRequeued")
+}
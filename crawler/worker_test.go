@@ -0,0 +1,190 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/crawler/sitetest"
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerDrain(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/": {Images: []string{"/logo.png"}, Delay: 200 * time.Millisecond},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	w := NewWorker(DefaultOptions)
+	processed := make(chan struct{})
+	go func() {
+		w.crawl(&recordQueue{}, d, queue.NewMessage(jobUUID, s.PageURL("/"), crawlDepth))
+		close(processed)
+	}()
+	waitForHits(t, s, "/")
+
+	assert.Equal(t, 0, w.Drain(5*time.Second))
+	<-processed
+
+	info, _ := d.Status(jobUUID)
+	assert.Equal(t, 0, info.Processing)
+	assert.Equal(t, 1, info.Done)
+
+	images, _ := d.Results(jobUUID)
+	assert.Len(t, images, 1)
+}
+
+func TestWorkerDrainTimeout(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/": {Delay: time.Second},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	q := &recordQueue{}
+	w := NewWorker(DefaultOptions)
+	processed := make(chan struct{})
+	go func() {
+		w.crawl(q, d, queue.NewMessage(jobUUID, s.PageURL("/"), crawlDepth))
+		close(processed)
+	}()
+	waitForHits(t, s, "/")
+
+	assert.Equal(t, 1, w.Drain(10*time.Millisecond))
+
+	info, _ := d.Status(jobUUID)
+	assert.Equal(t, 0, info.Processing)
+	assert.Equal(t, 1, info.Done)
+
+	<-processed
+	info, _ = d.Status(jobUUID)
+	assert.Equal(t, 0, info.Processing)
+	assert.Equal(t, 1, info.Done)
+
+	// The url is published again, and other workers crawl it even if the job viewed it.
+	if assert.Len(t, q.msgs, 1) {
+		assert.True(t, q.msgs[0].Claimed)
+		NewWorker(DefaultOptions).crawl(q, d, q.msgs[0])
+	}
+	assert.Equal(t, 2, s.Hits("/"))
+
+	info, _ = d.Status(jobUUID)
+	assert.Equal(t, 0, info.Processing)
+	assert.Equal(t, 2, info.Done)
+}
+
+func TestWorkerRequeue(t *testing.T) {
+	d, _ := db.NewMapConn()
+	q := &recordQueue{}
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	w := NewWorker(DefaultOptions)
+	assert.Equal(t, 0, w.Drain(time.Second))
+
+	w.crawl(q, d, queue.NewMessage(jobUUID, "http://example.com", 0))
+	assert.Equal(t, []string{"http://example.com"}, q.urls)
+
+	view, _ := d.ViewPage(jobUUID, "http://example.com")
+	assert.True(t, view)
+}
+
+func TestWorkerProcess(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/": {Delay: 200 * time.Millisecond},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	// Crawls without a concurrency limit don't block the queue.
+	w := NewWorker(DefaultOptions)
+	w.Process(&recordQueue{}, d, queue.NewMessage(jobUUID, s.PageURL("/"), crawlDepth))
+	info, _ := d.Status(jobUUID)
+	assert.Equal(t, 0, info.Done)
+
+	waitForHits(t, s, "/")
+	assert.Equal(t, 0, w.Drain(5*time.Second))
+	info, _ = d.Status(jobUUID)
+	assert.Equal(t, 1, info.Done)
+}
+
+func TestWorkerDrainScheduled(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/":      {Delay: 200 * time.Millisecond},
+		"/other": {},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	q := &recordQueue{}
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	opts := DefaultOptions
+	opts.Concurrency = 1
+	w := NewWorker(opts)
+
+	w.Process(q, d, queue.NewMessage(jobUUID, s.PageURL("/"), crawlDepth))
+	waitForHits(t, s, "/")
+	w.Process(q, d, queue.NewMessage(jobUUID, s.PageURL("/other"), crawlDepth))
+
+	assert.Equal(t, 0, w.Drain(5*time.Second))
+	assert.Equal(t, []string{s.PageURL("/other")}, q.urls)
+
+	info, _ := d.Status(jobUUID)
+	assert.Equal(t, 0, info.Processing)
+	assert.Equal(t, 1, info.Done)
+}
+
+func TestWorkerReady(t *testing.T) {
+	s := sitetest.Start(sitetest.Site{
+		"/": {Delay: 200 * time.Millisecond},
+	})
+	defer s.Close()
+
+	d, _ := db.NewMapConn()
+	jobUUID := queue.UUID()
+	d.CreateJob(jobUUID, "")
+
+	opts := DefaultOptions
+	opts.MaxCrawls = 1
+	w := NewWorker(opts)
+	assert.NoError(t, w.Ready())
+
+	processed := make(chan struct{})
+	go func() {
+		w.crawl(&recordQueue{}, d, queue.NewMessage(jobUUID, s.PageURL("/"), crawlDepth))
+		close(processed)
+	}()
+	waitForHits(t, s, "/")
+	assert.Error(t, w.Ready())
+
+	<-processed
+	assert.NoError(t, w.Ready())
+
+	w.Drain(time.Second)
+	assert.Equal(t, errDraining, w.Ready())
+}
+
+// waitForHits waits until the fixture server receives a request for the path,
+// so the crawl is in flight.
+func waitForHits(t *testing.T, s *sitetest.Server, path string) {
+	for i := 0; i < 500; i++ {
+		if s.Hits(path) > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("page never requested: %s", path)
+}
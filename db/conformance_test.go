@@ -0,0 +1,18 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/db/dbtest"
+)
+
+func TestMapDbConformance(t *testing.T) {
+	dbtest.Run(t, db.NewMapConn)
+}
+
+func TestBoundedMapDbConformance(t *testing.T) {
+	dbtest.Run(t, func() (db.Connection, error) {
+		return db.NewBoundedMapConn(10, 1<<20)
+	})
+}
@@ -1,26 +1,275 @@
 package db
 
-import "sort"
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// MaxRuns is the number of runs kept in the history of a schedule.
+const MaxRuns = 100
+
+var (
+	// ErrJobNotFound is returned when the storage doesn't know a job.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrFull is returned by bounded storages when a write doesn't fit
+	// and they can't remove anything to make room for it.
+	ErrFull = errors.New("storage full")
+	// ErrScheduleNotFound is returned when the storage doesn't know a schedule.
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrUnsupported is returned by wrappers when the storage engine doesn't implement an optional interface.
+	ErrUnsupported = errors.New("operation not supported by the storage")
+)
 
 // Connection is an interface that defines how data is saved and retrieved from a storage.
+// Storages implement the optional interfaces below for the features that need more than crawling jobs,
+// use the As functions to check if a connection implements them.
 type Connection interface {
-	// Create the job in the database.
-	CreateJob(string) error
-	// Processing increments the counter of currently processing urls for a given job.
+	// Create the job in the database, owned by a tenant.
+	// The tenant is empty when clients are not authenticated.
+	CreateJob(string, string) error
+	// Queued increments the counter of urls waiting in the queue for a given job.
+	Queued(string) error
+	// Skipped decrements the counter of queued urls for a given job, when a url is not crawled.
+	Skipped(string) error
+	// Processing increments the counter of currently processing urls
+	// and decrements the counter of queued urls for a given job.
 	Processing(string) error
 	// Done increments the counter of done urls
 	// and decrements the counter of processing urls for a given job.
 	Done(string) error
 	// Save adds an image source to the set of images for a given job.
 	Save(string, string) error
-	// Status returns the processing and done counters of a given job.
+	// SaveMany adds several image sources to the set of images for a given job at once.
+	SaveMany(string, []string) error
+	// Status returns the queued, processing and done counters of a given job.
 	Status(string) (*Info, error)
 	// Results returns the processed images for a given job.
 	Results(string) ([][]byte, error)
 	// ViewPage decides whether a page needs to be crawled or not.
-	// One url should only be crawled once by a given job,
-	// but it depends on the guarantees that the storage provides.
+	// One url must only be crawled once by a given job,
+	// so concurrent calls for the same url must return true only once.
 	ViewPage(string, string) (bool, error)
+	// Cancel stops crawling new pages for a given job.
+	// ViewPage must return false for the pages of cancelled jobs.
+	Cancel(string) error
+	// ActiveJobs returns the jobs created by a tenant that have not finished yet.
+	ActiveJobs(string) ([]string, error)
+	// FinishJob removes a job from the active jobs of a tenant.
+	FinishJob(string, string) error
+	// Ping checks that the storage is reachable.
+	Ping() error
+	// Close releases the connection with the storage.
+	Close() error
+}
+
+// UsageStore is an interface that storages can implement
+// to enforce the quotas on the pages and the bytes crawled by the tenants.
+type UsageStore interface {
+	// Usage returns the pages crawled and the bytes downloaded by a tenant in a given day.
+	Usage(string, string) (*Usage, error)
+	// AddUsage adds pages crawled and bytes downloaded to the usage of a tenant in a given day.
+	AddUsage(string, string, int64, int64) error
+	// CountPage adds a page to the pages crawled by a given job and returns how many it crawled.
+	// Reading the counter must not depend on the number of pages of the job.
+	CountPage(string) (int64, error)
+}
+
+// ScheduleStore is an interface that storages can implement to keep the schedules of the tenants.
+type ScheduleStore interface {
+	// SaveSchedule creates a schedule, or replaces the one with the same id.
+	SaveSchedule(*Schedule) error
+	// Schedule returns the schedule with a given id.
+	Schedule(string) (*Schedule, error)
+	// Schedules returns the schedules of all the tenants, sorted by id.
+	Schedules() ([]*Schedule, error)
+	// DeleteSchedule removes a schedule and its runs.
+	// Storages that can't list the pages cached for the schedule keep them.
+	DeleteSchedule(string) error
+}
+
+// RunStore is an interface that storages can implement to keep the history of the schedules.
+type RunStore interface {
+	// AddRun adds a run to the history of a schedule, keeping the last MaxRuns.
+	AddRun(string, Run) error
+	// Runs returns the history of a schedule, from the newest run to the oldest.
+	Runs(string) ([]Run, error)
+}
+
+// LeaseStore is an interface that storages can implement
+// to elect the node that creates the jobs of the schedules.
+type LeaseStore interface {
+	// AcquireLease takes, or renews, a lease for a holder during a given time.
+	// It returns false when another holder has a lease that has not expired.
+	AcquireLease(string, string, time.Duration) (bool, error)
+}
+
+// PageCache is an interface that storages can implement
+// to recrawl the pages of the schedules with conditional requests.
+type PageCache interface {
+	// CachePage stores what a page had the last time that the jobs of a schedule crawled it.
+	CachePage(string, string, *CachedPage) error
+	// CachedPage returns a page cached for a schedule, nil when it's not cached.
+	CachedPage(string, string) (*CachedPage, error)
+}
+
+// PageHashStore is an interface that storages can implement
+// to find the pages whose content changed between two jobs.
+type PageHashStore interface {
+	// SavePageHash stores the hash of the content of a page crawled by a given job.
+	SavePageHash(string, string, string) error
+	// PageHashes returns the hashes of the pages crawled by a given job, by url.
+	PageHashes(string) (map[string]string, error)
+}
+
+// FilterStore is an interface that storages can implement
+// to share the probabilistic set of urls seen by a job between nodes.
+type FilterStore interface {
+	// MergeFilter merges the filter bits with the ones stored for a given job.
+	// It returns the result of the merge.
+	MergeFilter(string, []byte) ([]byte, error)
+}
+
+// Wrapper is implemented by connections that wrap a storage engine, like the ones that record metrics.
+// Wrappers implement every optional interface and return ErrUnsupported when the engine doesn't,
+// so the As functions check the engine that they wrap.
+type Wrapper interface {
+	// Unwrap returns the wrapped connection.
+	Unwrap() Connection
+}
+
+// AsUsageStore returns the connection as a UsageStore when its engine implements it.
+func AsUsageStore(c Connection) (UsageStore, bool) {
+	return as[UsageStore](c)
+}
+
+// AsScheduleStore returns the connection as a ScheduleStore when its engine implements it.
+func AsScheduleStore(c Connection) (ScheduleStore, bool) {
+	return as[ScheduleStore](c)
+}
+
+// AsRunStore returns the connection as a RunStore when its engine implements it.
+func AsRunStore(c Connection) (RunStore, bool) {
+	return as[RunStore](c)
+}
+
+// AsLeaseStore returns the connection as a LeaseStore when its engine implements it.
+func AsLeaseStore(c Connection) (LeaseStore, bool) {
+	return as[LeaseStore](c)
+}
+
+// AsPageCache returns the connection as a PageCache when its engine implements it.
+func AsPageCache(c Connection) (PageCache, bool) {
+	return as[PageCache](c)
+}
+
+// AsPageHashStore returns the connection as a PageHashStore when its engine implements it.
+func AsPageHashStore(c Connection) (PageHashStore, bool) {
+	return as[PageHashStore](c)
+}
+
+// AsFilterStore returns the connection as a FilterStore when its engine implements it.
+func AsFilterStore(c Connection) (FilterStore, bool) {
+	return as[FilterStore](c)
+}
+
+// as returns the connection as an optional interface when the connection
+// and all the connections that it wraps implement it.
+func as[T any](c Connection) (T, bool) {
+	var zero T
+	t, ok := c.(T)
+	if !ok {
+		return zero, false
+	}
+
+	for {
+		w, isWrapper := c.(Wrapper)
+		if !isWrapper {
+			return t, true
+		}
+		c = w.Unwrap()
+		if _, ok := c.(T); !ok {
+			return zero, false
+		}
+	}
+}
+
+// mergeBits merges the bits of two filters with the same size.
+func mergeBits(dst, src []byte) {
+	if len(dst) != len(src) {
+		return
+	}
+	for i, b := range src {
+		dst[i] |= b
+	}
+}
+
+// Usage stores the resources used by a tenant in a day.
+type Usage struct {
+	Pages int64 // pages crawled.
+	Bytes int64 // bytes downloaded.
+}
+
+// CachedPage holds the validators of a page and what the crawler found in it,
+// so later crawls send conditional requests and reuse the results when the page didn't change.
+type CachedPage struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Hash         string    `json:"hash"`    // hash of the content of the page.
+	Images       []string  `json:"images"`  // absolute urls of the images in the page.
+	Links        []string  `json:"links"`   // absolute urls of the links in the page.
+	Crawled      time.Time `json:"crawled"` // when the content was known to be current.
+}
+
+// Schedule is a job template that creates a new job every time that its cron expression matches.
+type Schedule struct {
+	ID       string    `json:"id"`
+	Tenant   string    `json:"tenant"` // owner of the jobs created.
+	Cron     string    `json:"cron"`
+	Seeds    []string  `json:"seeds"`
+	Priority string    `json:"priority"` // priority of the jobs, empty for normal.
+	Sitemaps bool      `json:"sitemaps"` // crawl the pages in the sitemaps of the seeds too.
+	Updated  time.Time `json:"updated"`  // runs are only due after this time.
+}
+
+// Run is a job created by a schedule.
+type Run struct {
+	JobUUID string    `json:"jobUUID"` // empty when the job was not created.
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"` // why the job was not created.
+}
+
+func (p *CachedPage) clone() *CachedPage {
+	c := *p
+	c.Images = append([]string(nil), p.Images...)
+	c.Links = append([]string(nil), p.Links...)
+	return &c
+}
+
+func (sc *Schedule) clone() *Schedule {
+	c := *sc
+	c.Seeds = append([]string(nil), sc.Seeds...)
+	return &c
+}
+
+// byID sorts schedules by id.
+type byID []*Schedule
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// byTime sorts runs from the newest to the oldest.
+type byTime []Run
+
+func (r byTime) Len() int           { return len(r) }
+func (r byTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byTime) Less(i, j int) bool { return r[i].Time.After(r[j].Time) }
+
+// lease is held by a node to be the only one doing some work in the cluster.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
 }
 
 // Page represents a visited url.
@@ -47,8 +296,11 @@ func (p Pages) Less(i, j int) bool {
 
 // Info stores information about a specific job.
 type Info struct {
+	Tenant     string // owner of the job, empty when clients are not authenticated.
+	Queued     int64  // urls published that no crawler started yet.
 	Processing int64
 	Done       int64
+	Cancelled  bool
 	pageViews  []Page
 }
 
@@ -0,0 +1,182 @@
+package dbtest
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The assertions of the suite only use the standard library,
+// so the engines can run it without vendoring other test dependencies.
+// They report the failure and return false, so tests can guard the checks that depend on them.
+
+func assertEqual(t *testing.T, expected, actual interface{}) bool {
+	t.Helper()
+	if !equal(expected, actual) {
+		t.Errorf("not equal:\nexpected: %#v\nactual  : %#v", expected, actual)
+		return false
+	}
+	return true
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	t.Helper()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return false
+	}
+	return true
+}
+
+func assertError(t *testing.T, err error) bool {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected an error")
+		return false
+	}
+	return true
+}
+
+func assertTrue(t *testing.T, v bool) bool {
+	t.Helper()
+	if !v {
+		t.Errorf("expected true")
+	}
+	return v
+}
+
+func assertFalse(t *testing.T, v bool) bool {
+	t.Helper()
+	if v {
+		t.Errorf("expected false")
+	}
+	return !v
+}
+
+func assertEmpty(t *testing.T, v interface{}) bool {
+	t.Helper()
+	if !empty(v) {
+		t.Errorf("expected empty, got %#v", v)
+		return false
+	}
+	return true
+}
+
+func assertNil(t *testing.T, v interface{}) bool {
+	t.Helper()
+	if !isNil(v) {
+		t.Errorf("expected nil, got %#v", v)
+		return false
+	}
+	return true
+}
+
+func assertNotNil(t *testing.T, v interface{}) bool {
+	t.Helper()
+	if isNil(v) {
+		t.Errorf("expected a value, got nil")
+		return false
+	}
+	return true
+}
+
+func assertLen(t *testing.T, v interface{}, n int) bool {
+	t.Helper()
+	if l := reflect.ValueOf(v).Len(); l != n {
+		t.Errorf("expected %d elements, got %d: %#v", n, l, v)
+		return false
+	}
+	return true
+}
+
+func assertContains(t *testing.T, list []string, el string) bool {
+	t.Helper()
+	if !contains(list, el) {
+		t.Errorf("%#v doesn't contain %q", list, el)
+		return false
+	}
+	return true
+}
+
+func assertNotContains(t *testing.T, list []string, el string) bool {
+	t.Helper()
+	if contains(list, el) {
+		t.Errorf("%#v contains %q", list, el)
+		return false
+	}
+	return true
+}
+
+// assertElementsMatch checks that two lists have the same elements, in any order.
+func assertElementsMatch(t *testing.T, expected, actual []string) bool {
+	t.Helper()
+	counts := map[string]int{}
+	for _, el := range expected {
+		counts[el]++
+	}
+	for _, el := range actual {
+		counts[el]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			t.Errorf("elements don't match:\nexpected: %#v\nactual  : %#v", expected, actual)
+			return false
+		}
+	}
+	return true
+}
+
+// equal compares two values deeply.
+// Untyped constants are converted to the type of the actual value,
+// so counters can be compared with plain numbers.
+func equal(expected, actual interface{}) bool {
+	if reflect.DeepEqual(expected, actual) {
+		return true
+	}
+	if expected == nil || actual == nil {
+		return false
+	}
+
+	e, a := reflect.ValueOf(expected), reflect.ValueOf(actual)
+	if e.Type().ConvertibleTo(a.Type()) && e.Kind() != reflect.String {
+		return reflect.DeepEqual(e.Convert(a.Type()).Interface(), actual)
+	}
+	return false
+}
+
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Chan, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr:
+		return rv.IsNil() || empty(rv.Elem().Interface())
+	default:
+		return rv.IsZero()
+	}
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func contains(list []string, el string) bool {
+	for _, v := range list {
+		if v == el {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,571 @@
+package dbtest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+)
+
+// Factory creates new connections to the storage engine under test.
+type Factory func() (db.Connection, error)
+
+// Suite verifies that a storage engine follows the semantics of db.Connection.
+// Every test runs with a new connection and a new job.
+// Tests of the optional interfaces are skipped when the engine doesn't implement them.
+type Suite struct {
+	t       *testing.T
+	factory Factory
+	conn    db.Connection
+	jobUUID string
+}
+
+// Run runs the conformance suite against the connections created by the factory.
+// Every method of the suite whose name starts with Test runs as a subtest.
+func Run(t *testing.T, f Factory) {
+	st := reflect.TypeOf(&Suite{})
+	for i := 0; i < st.NumMethod(); i++ {
+		m := st.Method(i)
+		if !strings.HasPrefix(m.Name, "Test") {
+			continue
+		}
+
+		t.Run(m.Name, func(t *testing.T) {
+			s := &Suite{t: t, factory: f}
+			s.SetupTest()
+			m.Func.Call([]reflect.Value{reflect.ValueOf(s)})
+		})
+	}
+}
+
+// T returns the test that is running.
+func (s *Suite) T() *testing.T {
+	return s.t
+}
+
+// SetupTest creates a new connection and a new job for every test.
+func (s *Suite) SetupTest() {
+	c, err := s.factory()
+	if err != nil {
+		s.T().Fatalf("unable to create the connection: %v", err)
+	}
+
+	s.conn = c
+	s.jobUUID = queue.UUID()
+
+	err = s.conn.CreateJob(s.jobUUID, "")
+	assertNoError(s.T(), err)
+}
+
+// TestCreateJob checks that new jobs have nothing processed.
+func (s *Suite) TestCreateJob() {
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), 0, i.Processing)
+	assertEqual(s.T(), 0, i.Done)
+	assertEmpty(s.T(), i.Tenant)
+	assertEmpty(s.T(), i.PageViews())
+
+	r, err := s.conn.Results(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEmpty(s.T(), r)
+}
+
+// TestJobTenant checks that jobs keep the tenant that owns them.
+func (s *Suite) TestJobTenant() {
+	other := queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(other, "acme"))
+	assertNoError(s.T(), s.conn.Processing(other))
+
+	i, err := s.conn.Status(other)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), "acme", i.Tenant)
+	assertEqual(s.T(), 1, i.Processing)
+}
+
+// TestActiveJobs checks that jobs are active for their tenant until they finish.
+func (s *Suite) TestActiveJobs() {
+	tenant := queue.UUID()
+	jobs, err := s.conn.ActiveJobs(tenant)
+	assertNoError(s.T(), err)
+	assertEmpty(s.T(), jobs)
+
+	first, second := queue.UUID(), queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(first, tenant))
+	assertNoError(s.T(), s.conn.CreateJob(second, tenant))
+
+	jobs, err = s.conn.ActiveJobs(tenant)
+	assertNoError(s.T(), err)
+	assertElementsMatch(s.T(), []string{first, second}, jobs)
+
+	assertNoError(s.T(), s.conn.FinishJob(tenant, first))
+	assertNoError(s.T(), s.conn.FinishJob(queue.UUID(), first))
+
+	jobs, err = s.conn.ActiveJobs(tenant)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), []string{second}, jobs)
+}
+
+// TestUsage checks that the usage of a tenant is counted by day.
+func (s *Suite) TestUsage() {
+	us, ok := db.AsUsageStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.UsageStore")
+	}
+
+	tenant := queue.UUID()
+	u, err := us.Usage(tenant, "2015-01-01")
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), db.Usage{}, *u)
+
+	assertNoError(s.T(), us.AddUsage(tenant, "2015-01-01", 1, 100))
+	assertNoError(s.T(), us.AddUsage(tenant, "2015-01-01", 2, 50))
+	assertNoError(s.T(), us.AddUsage(tenant, "2015-01-02", 1, 10))
+
+	u, err = us.Usage(tenant, "2015-01-02")
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), db.Usage{Pages: 1, Bytes: 10}, *u)
+
+	u, err = us.Usage(queue.UUID(), "2015-01-02")
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), db.Usage{}, *u)
+}
+
+// TestCountPage checks that the pages crawled are counted by job.
+func (s *Suite) TestCountPage() {
+	us, ok := db.AsUsageStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.UsageStore")
+	}
+
+	jobUUID := queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(jobUUID, ""))
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := us.CountPage(jobUUID)
+		assertNoError(s.T(), err)
+		assertEqual(s.T(), i, n)
+	}
+
+	other := queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(other, ""))
+	n, err := us.CountPage(other)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), int64(1), n)
+}
+
+// TestSchedules checks that schedules are saved, replaced and deleted.
+func (s *Suite) TestSchedules() {
+	ss, ok := db.AsScheduleStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.ScheduleStore")
+	}
+
+	sc := &db.Schedule{
+		ID:      queue.UUID(),
+		Tenant:  "acme",
+		Cron:    "0 3 * * *",
+		Seeds:   []string{"http://example.com", "http://example.org"},
+		Updated: time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC),
+	}
+	assertNoError(s.T(), ss.SaveSchedule(sc))
+
+	found, err := ss.Schedule(sc.ID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), sc, found)
+
+	sc.Cron = "@hourly"
+	sc.Priority = "low"
+	assertNoError(s.T(), ss.SaveSchedule(sc))
+
+	found, err = ss.Schedule(sc.ID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), sc, found)
+	assertContains(s.T(), scheduleIDs(s.T(), ss), sc.ID)
+
+	assertNoError(s.T(), ss.DeleteSchedule(sc.ID))
+	assertNoError(s.T(), ss.DeleteSchedule(queue.UUID()))
+
+	_, err = ss.Schedule(sc.ID)
+	assertEqual(s.T(), db.ErrScheduleNotFound, err)
+	assertNotContains(s.T(), scheduleIDs(s.T(), ss), sc.ID)
+}
+
+// TestRuns checks that the history of a schedule is sorted from the newest run
+// and that it only keeps the last runs.
+func (s *Suite) TestRuns() {
+	rs, ok := db.AsRunStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.RunStore")
+	}
+
+	id := queue.UUID()
+	runs, err := rs.Runs(id)
+	assertNoError(s.T(), err)
+	assertEmpty(s.T(), runs)
+
+	start := time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < db.MaxRuns+2; i++ {
+		r := db.Run{JobUUID: queue.UUID(), Time: start.Add(time.Duration(i) * time.Hour)}
+		if i == 1 {
+			r = db.Run{Time: r.Time, Error: "quota exceeded"}
+		}
+		assertNoError(s.T(), rs.AddRun(id, r))
+	}
+	assertNoError(s.T(), rs.AddRun(id, db.Run{JobUUID: queue.UUID(), Time: start.Add(-time.Hour)}))
+
+	runs, err = rs.Runs(id)
+	assertNoError(s.T(), err)
+	if assertLen(s.T(), runs, db.MaxRuns) {
+		assertEqual(s.T(), start.Add(time.Duration(db.MaxRuns+1)*time.Hour), runs[0].Time)
+		assertEqual(s.T(), start.Add(2*time.Hour), runs[db.MaxRuns-1].Time)
+	}
+
+	if ss, ok := db.AsScheduleStore(s.conn); ok {
+		assertNoError(s.T(), ss.DeleteSchedule(id))
+		runs, err = rs.Runs(id)
+		assertNoError(s.T(), err)
+		assertEmpty(s.T(), runs)
+	}
+}
+
+// TestAcquireLease checks that only one holder has a lease until it expires.
+func (s *Suite) TestAcquireLease() {
+	ls, ok := db.AsLeaseStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.LeaseStore")
+	}
+
+	name := queue.UUID()
+
+	ok, err := ls.AcquireLease(name, "node1", time.Minute)
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), ok)
+
+	ok, err = ls.AcquireLease(name, "node2", time.Minute)
+	assertNoError(s.T(), err)
+	assertFalse(s.T(), ok)
+
+	ok, err = ls.AcquireLease(name, "node1", time.Millisecond)
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), ok)
+
+	time.Sleep(10 * time.Millisecond)
+	ok, err = ls.AcquireLease(name, "node2", time.Minute)
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), ok)
+
+	ok, err = ls.AcquireLease(name, "node1", time.Minute)
+	assertNoError(s.T(), err)
+	assertFalse(s.T(), ok)
+}
+
+// TestNotFound checks that unknown jobs return errors.
+func (s *Suite) TestNotFound() {
+	_, err := s.conn.Status(queue.UUID())
+	assertEqual(s.T(), db.ErrJobNotFound, err)
+
+	_, err = s.conn.Results(queue.UUID())
+	assertEqual(s.T(), db.ErrJobNotFound, err)
+}
+
+// TestQueued checks that queued urls are counted until they are processed or skipped.
+func (s *Suite) TestQueued() {
+	assertNoError(s.T(), s.conn.Queued(s.jobUUID))
+	assertNoError(s.T(), s.conn.Queued(s.jobUUID))
+	assertNoError(s.T(), s.conn.Queued(s.jobUUID))
+
+	assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+	assertNoError(s.T(), s.conn.Skipped(s.jobUUID))
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), 1, i.Queued)
+	assertEqual(s.T(), 1, i.Processing)
+}
+
+// TestProcessing checks that processing urls are counted.
+func (s *Suite) TestProcessing() {
+	assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+	assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), 2, i.Processing)
+	assertEqual(s.T(), 0, i.Done)
+}
+
+// TestDone checks that done urls are not counted as processing anymore.
+func (s *Suite) TestDone() {
+	assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+	assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+	assertNoError(s.T(), s.conn.Done(s.jobUUID))
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), 1, i.Processing)
+	assertEqual(s.T(), 1, i.Done)
+}
+
+// TestSave checks that images are stored once.
+func (s *Suite) TestSave() {
+	assertNoError(s.T(), s.conn.Save(s.jobUUID, "http://example.com/logo.png"))
+	assertNoError(s.T(), s.conn.Save(s.jobUUID, "http://example.com/logo.png"))
+	assertNoError(s.T(), s.conn.Save(s.jobUUID, "http://example.com/bg.png"))
+
+	s.assertResults("http://example.com/logo.png", "http://example.com/bg.png")
+}
+
+// TestSaveMany checks that images saved at once are stored once.
+func (s *Suite) TestSaveMany() {
+	err := s.conn.SaveMany(s.jobUUID, []string{"http://example.com/logo.png", "http://example.com/bg.png"})
+	assertNoError(s.T(), err)
+
+	err = s.conn.SaveMany(s.jobUUID, []string{"http://example.com/logo.png"})
+	assertNoError(s.T(), err)
+
+	assertNoError(s.T(), s.conn.SaveMany(s.jobUUID, nil))
+
+	s.assertResults("http://example.com/logo.png", "http://example.com/bg.png")
+}
+
+// TestViewPage checks that pages are only viewed once and that hits are counted.
+func (s *Suite) TestViewPage() {
+	v, err := s.conn.ViewPage(s.jobUUID, "http://example.com")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+
+	v, err = s.conn.ViewPage(s.jobUUID, "http://example.com")
+	assertNoError(s.T(), err)
+	assertFalse(s.T(), v)
+
+	v, err = s.conn.ViewPage(s.jobUUID, "http://example.org")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+
+	p := i.PageViews()
+	if assertEqual(s.T(), 2, len(p)) {
+		assertEqual(s.T(), db.Page{URL: "http://example.com", Hits: 2}, p[0])
+		assertEqual(s.T(), db.Page{URL: "http://example.org", Hits: 1}, p[1])
+	}
+}
+
+// TestPageHashes checks that the last hash saved for a page wins.
+func (s *Suite) TestPageHashes() {
+	hs, ok := db.AsPageHashStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.PageHashStore")
+	}
+
+	h, err := hs.PageHashes(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEmpty(s.T(), h)
+
+	assertNoError(s.T(), hs.SavePageHash(s.jobUUID, "http://example.com", "aaaa"))
+	assertNoError(s.T(), hs.SavePageHash(s.jobUUID, "http://example.org", "bbbb"))
+	assertNoError(s.T(), hs.SavePageHash(s.jobUUID, "http://example.com", "cccc"))
+
+	h, err = hs.PageHashes(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), map[string]string{"http://example.com": "cccc", "http://example.org": "bbbb"}, h)
+
+	_, err = hs.PageHashes(queue.UUID())
+	assertEqual(s.T(), db.ErrJobNotFound, err)
+}
+
+// TestCachedPages checks that pages are cached by schedule and url.
+func (s *Suite) TestCachedPages() {
+	pc, ok := db.AsPageCache(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.PageCache")
+	}
+
+	template := queue.UUID()
+
+	p, err := pc.CachedPage(template, "http://example.com")
+	assertNoError(s.T(), err)
+	assertNil(s.T(), p)
+
+	page := &db.CachedPage{
+		ETag:         `"v1"`,
+		LastModified: "Mon, 01 Jun 2015 03:00:00 GMT",
+		Hash:         "aaaa",
+		Images:       []string{"http://example.com/logo.png"},
+		Links:        []string{"http://example.com/about"},
+		Crawled:      time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC),
+	}
+	assertNoError(s.T(), pc.CachePage(template, "http://example.com", page))
+
+	p, err = pc.CachedPage(template, "http://example.com")
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), page, p)
+
+	page.ETag = `"v2"`
+	assertNoError(s.T(), pc.CachePage(template, "http://example.com", page))
+
+	p, err = pc.CachedPage(template, "http://example.com")
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), `"v2"`, p.ETag)
+
+	p, err = pc.CachedPage(queue.UUID(), "http://example.com")
+	assertNoError(s.T(), err)
+	assertNil(s.T(), p)
+}
+
+// TestPing checks that the storage is reachable.
+func (s *Suite) TestPing() {
+	assertNoError(s.T(), s.conn.Ping())
+}
+
+// TestCancel checks that pages of cancelled jobs are not viewed.
+func (s *Suite) TestCancel() {
+	v, err := s.conn.ViewPage(s.jobUUID, "http://example.com")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertFalse(s.T(), i.Cancelled)
+
+	assertNoError(s.T(), s.conn.Cancel(s.jobUUID))
+	assertNoError(s.T(), s.conn.Cancel(s.jobUUID))
+
+	v, err = s.conn.ViewPage(s.jobUUID, "http://example.org")
+	assertNoError(s.T(), err)
+	assertFalse(s.T(), v)
+
+	i, err = s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), i.Cancelled)
+
+	other := queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(other, ""))
+
+	v, err = s.conn.ViewPage(other, "http://example.org")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+}
+
+// TestViewPageIsolation checks that pages viewed by a job are not viewed by other jobs.
+func (s *Suite) TestViewPageIsolation() {
+	other := queue.UUID()
+	assertNoError(s.T(), s.conn.CreateJob(other, ""))
+
+	v, err := s.conn.ViewPage(s.jobUUID, "http://example.com")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+
+	v, err = s.conn.ViewPage(other, "http://example.com")
+	assertNoError(s.T(), err)
+	assertTrue(s.T(), v)
+}
+
+// TestConcurrentViewPage checks that a page is only viewed once
+// when several goroutines view it at the same time.
+func (s *Suite) TestConcurrentViewPage() {
+	const n = 10
+
+	var wg sync.WaitGroup
+	views := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.conn.ViewPage(s.jobUUID, "http://example.com")
+			assertNoError(s.T(), err)
+			views <- v
+		}()
+	}
+	wg.Wait()
+	close(views)
+
+	crawled := 0
+	for v := range views {
+		if v {
+			crawled++
+		}
+	}
+	assertEqual(s.T(), 1, crawled)
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	if p := i.PageViews(); assertEqual(s.T(), 1, len(p)) {
+		assertEqual(s.T(), n, p[0].Hits)
+	}
+}
+
+// TestConcurrentCounters checks that counters don't lose updates
+// when several goroutines update them at the same time.
+func (s *Suite) TestConcurrentCounters() {
+	const n = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assertNoError(s.T(), s.conn.Processing(s.jobUUID))
+			assertNoError(s.T(), s.conn.Save(s.jobUUID, fmt.Sprintf("http://example.com/%d.png", i)))
+			assertNoError(s.T(), s.conn.Done(s.jobUUID))
+		}(i)
+	}
+	wg.Wait()
+
+	i, err := s.conn.Status(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), 0, i.Processing)
+	assertEqual(s.T(), n, i.Done)
+
+	r, err := s.conn.Results(s.jobUUID)
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), n, len(r))
+}
+
+// TestMergeFilter checks that filters are merged when the engine is able to share them.
+func (s *Suite) TestMergeFilter() {
+	fs, ok := db.AsFilterStore(s.conn)
+	if !ok {
+		s.T().Skip("the storage engine doesn't implement db.FilterStore")
+	}
+
+	b, err := fs.MergeFilter(s.jobUUID, []byte{1, 0})
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), []byte{1, 0}, b)
+
+	b, err = fs.MergeFilter(s.jobUUID, []byte{2, 4})
+	assertNoError(s.T(), err)
+	assertEqual(s.T(), []byte{3, 4}, b)
+}
+
+func scheduleIDs(t *testing.T, ss db.ScheduleStore) []string {
+	schedules, err := ss.Schedules()
+	assertNoError(t, err)
+
+	var ids []string
+	for _, sc := range schedules {
+		ids = append(ids, sc.ID)
+	}
+	return ids
+}
+
+func (s *Suite) assertResults(images ...string) {
+	r, err := s.conn.Results(s.jobUUID)
+	assertNoError(s.T(), err)
+
+	var found []string
+	for _, i := range r {
+		found = append(found, string(i))
+	}
+	assertEqual(s.T(), len(images), len(found))
+	for _, i := range images {
+		assertContains(s.T(), found, i)
+	}
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tpjg/goriakpbc"
+)
+
+// Driver opens connections to a storage engine.
+// Drivers are registered under the scheme of the urls that they open, like riak://.
+type Driver interface {
+	// Open connects to the storage engine described by the url.
+	Open(string) (Connection, error)
+}
+
+// DriverFunc is an adapter to use functions as drivers.
+type DriverFunc func(string) (Connection, error)
+
+// Open calls the function.
+func (f DriverFunc) Open(dsn string) (Connection, error) {
+	return f(dsn)
+}
+
+var (
+	driversMu = new(sync.RWMutex)
+	drivers   = make(map[string]Driver)
+)
+
+func init() {
+	Register("mem", DriverFunc(openMap))
+	Register("riak", DriverFunc(openRiak))
+}
+
+// Register makes a storage engine available under a url scheme.
+// Engines usually call it from the init function of their package.
+// It panics if the driver is nil or the scheme is already registered.
+func Register(scheme string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if d == nil {
+		panic("db: Register driver is nil")
+	}
+	if _, dup := drivers[scheme]; dup {
+		panic("db: Register called twice for driver " + scheme)
+	}
+	drivers[scheme] = d
+}
+
+// Drivers returns the sorted list of registered schemes.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	var schemes []string
+	for s := range drivers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open connects to the storage engine registered under the scheme of the url.
+func Open(dsn string) (Connection, error) {
+	scheme, err := Scheme(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driversMu.RLock()
+	d, ok := drivers[scheme]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("db: unknown driver %q (forgotten import?)", scheme)
+	}
+	return d.Open(dsn)
+}
+
+// Scheme returns the scheme of a url, without parsing the rest of it.
+// Drivers can use urls that are not valid for url.Parse, like lists of hosts.
+func Scheme(dsn string) (string, error) {
+	i := strings.Index(dsn, "://")
+	if i <= 0 {
+		return "", fmt.Errorf("db: missing scheme in url %q", dsn)
+	}
+	return dsn[:i], nil
+}
+
+// openMap opens a memory storage.
+// The limits of the storage are set with the query parameters maxJobs and maxBytes,
+// for instance mem://?maxJobs=100&maxBytes=10485760.
+func openMap(dsn string) (Connection, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	var maxJobs int
+	if v := q.Get("maxJobs"); v != "" {
+		if maxJobs, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("db: invalid maxJobs %q", v)
+		}
+	}
+
+	var maxBytes int64
+	if v := q.Get("maxBytes"); v != "" {
+		if maxBytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("db: invalid maxBytes %q", v)
+		}
+	}
+
+	return NewBoundedMapConn(maxJobs, maxBytes)
+}
+
+// openRiak connects to a Riak cluster through one of its nodes.
+// The number of connections is set with the query parameter poolSize, 5 by default,
+// for instance riak://127.0.0.1:8087?poolSize=10.
+func openRiak(dsn string) (Connection, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("db: missing Riak host in url %q", dsn)
+	}
+
+	poolSize := 5
+	if v := u.Query().Get("poolSize"); v != "" {
+		if poolSize, err = strconv.Atoi(v); err != nil || poolSize <= 0 {
+			return nil, fmt.Errorf("db: invalid poolSize %q", v)
+		}
+	}
+
+	rc := riak.NewPool(u.Host, poolSize)
+	if err := rc.Connect(); err != nil {
+		return nil, fmt.Errorf("Unable to connect to the Riak server: %v", err)
+	}
+
+	d, err := NewRiakConn(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("Unable to create the storage buckets: %v", err)
+	}
+	return d, nil
+}
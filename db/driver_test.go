@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenMemory(t *testing.T) {
+	c, err := Open("mem://")
+	assert.NoError(t, err)
+	assert.IsType(t, &MapConn{}, c)
+
+	c, err = Open("mem://?maxJobs=2&maxBytes=1024")
+	assert.NoError(t, err)
+	m := c.(*MapConn)
+	assert.Equal(t, 2, m.maxJobs)
+	assert.Equal(t, 1024, m.maxBytes)
+
+	for _, dsn := range []string{"mem://?maxJobs=two", "mem://?maxBytes=-1", "mem://?maxJobs=-1"} {
+		_, err = Open(dsn)
+		assert.Error(t, err, dsn)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, dsn := range []string{"", "127.0.0.1:8087", "redis://127.0.0.1:6379", "riak://", "riak://127.0.0.1:8087?poolSize=0"} {
+		_, err := Open(dsn)
+		assert.Error(t, err, dsn)
+	}
+}
+
+// openedTestDSN records the last url opened by the test driver.
+var openedTestDSN string
+
+func init() {
+	Register("test-db", DriverFunc(func(dsn string) (Connection, error) {
+		openedTestDSN = dsn
+		return NewMapConn()
+	}))
+}
+
+func TestRegisterDriver(t *testing.T) {
+	assert.Contains(t, Drivers(), "test-db")
+	assert.Contains(t, Drivers(), "mem")
+	assert.Contains(t, Drivers(), "riak")
+
+	_, err := Open("test-db://host/path")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-db://host/path", openedTestDSN)
+
+	assert.Panics(t, func() {
+		Register("test-db", DriverFunc(func(string) (Connection, error) { return nil, nil }))
+	})
+	assert.Panics(t, func() {
+		Register("test-nil", nil)
+	})
+}
@@ -1,8 +1,21 @@
 package db
 
 import (
+	"container/list"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/calavera/crawler/logging"
+)
+
+const (
+	jobOverhead      = 256 // approximate bytes used by an empty job
+	pageOverhead     = 128 // approximate bytes used by an empty cached page
+	scheduleOverhead = 128 // approximate bytes used by an empty schedule
+	runOverhead      = 64  // approximate bytes used by a run without error
+	usageOverhead    = 64  // approximate bytes used by the usage of a tenant in a day
 )
 
 // set is a very inneficient memory set designed for testing.
@@ -17,18 +30,33 @@ func (s *set) Values() [][]byte {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.values
+	v := make([][]byte, len(s.values))
+	copy(v, s.values)
+	return v
+}
+
+// Has returns true if the value is in the set.
+func (s *set) Has(el string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.keys[el]
+	return ok
 }
 
 // Add appends new values to the set.
-func (s *set) Add(el string) {
+// It returns false if the value was already in the set.
+func (s *set) Add(el string) bool {
 	s.Lock()
 	defer s.Unlock()
 
-	if _, ok := s.keys[el]; !ok {
-		s.keys[el] = el
-		s.values = append(s.values, []byte(el))
+	if _, ok := s.keys[el]; ok {
+		return false
 	}
+
+	s.keys[el] = el
+	s.values = append(s.values, []byte(el))
+	return true
 }
 
 func newSet() *set {
@@ -39,61 +67,181 @@ func newSet() *set {
 	}
 }
 
+// usageKey identifies the usage of a tenant in a day.
+type usageKey struct {
+	tenant string
+	day    string
+}
+
+// mapJob holds the information stored for a job.
+type mapJob struct {
+	uuid       string
+	tenant     string
+	images     *set
+	queued     int64
+	processing int64
+	done       int64
+	pages      int64 // pages counted for the quotas.
+	pageViews  map[string]int64
+	hashes     map[string]string // content hashes by url.
+	filter     []byte
+	cancelled  bool
+	size       int64         // approximate bytes used by the job
+	elem       *list.Element // position of the job in the lru list
+}
+
+// mapPage holds a page cached for a schedule.
+type mapPage struct {
+	template string
+	url      string
+	page     *CachedPage
+	size     int64         // approximate bytes used by the page
+	elem     *list.Element // position of the page in the lru list of cached pages
+}
+
 // MapConn implements the Connection interface using memory maps as backends.
-// This interface is only suitable for testing.
-// It offers no guarantees about the elements saved in it and it is not thread safe.
+// It's safe to use from concurrent goroutines.
+// It can be bounded by number of jobs and memory used,
+// evicting the least recently used jobs when the limits are reached.
+// Cached pages count toward the memory used, they are evicted before the jobs and they never evict jobs.
+// Schedules, runs and the usage of the tenants count toward the memory used too, but they are never evicted,
+// saving them fails with ErrFull when there is no room left.
+// Jobs with urls queued or processing are never evicted, writes fail with ErrFull when only those are left.
+// Writes for evicted jobs fail with ErrJobNotFound.
+// Data is not persisted nor shared between nodes, so it's only suitable for single node deployments.
 type MapConn struct {
-	images     map[string]*set
-	processing map[string]int64
-	done       map[string]int64
-	pageViews  map[string]map[string]int64
+	*sync.Mutex
+	jobs      map[string]*mapJob
+	active    map[string]map[string]bool // active jobs by tenant.
+	usage     map[usageKey]*Usage
+	schedules map[string]*Schedule
+	runs      map[string][]Run // newest first.
+	leases    map[string]lease
+	pages     map[string]map[string]*mapPage // cached pages by schedule and url.
+	pageLRU   *list.List
+	lru       *list.List
+	size      int64
+	pageBytes int64 // bytes of size used by cached pages.
+	maxJobs   int
+	maxBytes  int64
 }
 
-// NewMapConn creates a new map connection.
+// NewMapConn creates a new map connection without limits.
 func NewMapConn() (Connection, error) {
+	return NewBoundedMapConn(0, 0)
+}
+
+// NewBoundedMapConn creates a new map connection that keeps at most maxJobs jobs
+// and uses approximately maxBytes of memory.
+// Zero values disable the limits.
+func NewBoundedMapConn(maxJobs int, maxBytes int64) (Connection, error) {
+	if maxJobs < 0 || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid map limits: jobs=%d bytes=%d", maxJobs, maxBytes)
+	}
+
 	return &MapConn{
-		images:     map[string]*set{},
-		processing: map[string]int64{},
-		done:       map[string]int64{},
-		pageViews:  map[string]map[string]int64{},
+		Mutex:     new(sync.Mutex),
+		jobs:      map[string]*mapJob{},
+		active:    map[string]map[string]bool{},
+		usage:     map[usageKey]*Usage{},
+		schedules: map[string]*Schedule{},
+		runs:      map[string][]Run{},
+		leases:    map[string]lease{},
+		pages:     map[string]map[string]*mapPage{},
+		pageLRU:   list.New(),
+		lru:       list.New(),
+		maxJobs:   maxJobs,
+		maxBytes:  maxBytes,
 	}, nil
 }
 
-// Processing increments the counter of current urls processing.
-func (c *MapConn) Processing(jobUUID string) error {
-	var p int64
-	if v, ok := c.processing[jobUUID]; ok {
-		p = v
+// Queued increments the counter of urls waiting in the queue.
+func (c *MapConn) Queued(jobUUID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
+	}
+	j.queued++
+	return nil
+}
+
+// Skipped decrements the counter of urls waiting in the queue, when a url is not crawled.
+func (c *MapConn) Skipped(jobUUID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
 	}
-	c.processing[jobUUID] = p + 1
+	j.queued--
+	return nil
+}
+
+// Processing increments the counter of current urls processing
+// and decrements the counter of urls waiting in the queue.
+func (c *MapConn) Processing(jobUUID string) error {
+	c.Lock()
+	defer c.Unlock()
 
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
+	}
+	j.queued--
+	j.processing++
 	return nil
 }
 
 // Done increments the counter of urls processed
 // and decrements the counter of urls currently processing.
 func (c *MapConn) Done(jobUUID string) error {
-	var p int64
-	if v, ok := c.done[jobUUID]; ok {
-		p = v
-	}
-	c.done[jobUUID] = p + 1
+	c.Lock()
+	defer c.Unlock()
 
-	if v, ok := c.processing[jobUUID]; ok {
-		c.processing[jobUUID] = v - 1
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
 	}
+	j.done++
+	j.processing--
 
 	return nil
 }
 
 // Save stores new images found by a job in the database.
 func (c *MapConn) Save(jobUUID string, src string) error {
-	set := newSet()
-	if s, ok := c.images[jobUUID]; ok {
-		set = s
+	return c.SaveMany(jobUUID, []string{src})
+}
+
+// SaveMany stores several images found by a job in the database.
+func (c *MapConn) SaveMany(jobUUID string, srcs []string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
+	}
+
+	var n int64
+	for _, src := range srcs {
+		if !j.images.Has(src) {
+			n += int64(len(src))
+		}
+	}
+	if err := c.reserve(j, n); err != nil {
+		return err
+	}
+
+	for _, src := range srcs {
+		if j.images.Add(src) {
+			c.grow(j, int64(len(src)))
+		}
 	}
-	set.Add(src)
-	c.images[jobUUID] = set
 	return nil
 }
 
@@ -101,55 +249,549 @@ func (c *MapConn) Save(jobUUID string, src string) error {
 // It returns the currently processing urls and the urls already processed.
 // It also returns the urls detected by the job.
 func (c *MapConn) Status(jobUUID string) (*Info, error) {
-	var c1 int64
-	var ok bool
+	c.Lock()
+	defer c.Unlock()
 
-	if c1, ok = c.processing[jobUUID]; !ok {
-		return nil, fmt.Errorf("job not found") // nothing processed yet
+	j, ok := c.jobs[jobUUID]
+	if !ok {
+		return nil, ErrJobNotFound
 	}
-
-	c2 := c.done[jobUUID]
+	c.lru.MoveToFront(j.elem)
 
 	var pages []Page
-	if c.pageViews[jobUUID] != nil {
-		for k, v := range c.pageViews[jobUUID] {
-			pages = append(pages, Page{k, v})
-		}
+	for k, v := range j.pageViews {
+		pages = append(pages, Page{k, v})
 	}
 
 	return &Info{
-		Processing: c1,
-		Done:       c2,
+		Tenant:     j.tenant,
+		Queued:     j.queued,
+		Processing: j.processing,
+		Done:       j.done,
+		Cancelled:  j.cancelled,
 		pageViews:  pages,
 	}, nil
 }
 
 // Results returns the list of images crawled by a specific job.
 func (c *MapConn) Results(jobUUID string) ([][]byte, error) {
-	if s, ok := c.images[jobUUID]; ok {
-		return s.Values(), nil
+	c.Lock()
+	defer c.Unlock()
+
+	j, ok := c.jobs[jobUUID]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	c.lru.MoveToFront(j.elem)
+
+	return j.images.Values(), nil
+}
+
+// SavePageHash stores the hash of the content of a page crawled by a job.
+func (c *MapConn) SavePageHash(jobUUID, url, hash string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
+	}
+
+	n := int64(len(url) + len(hash))
+	if old, ok := j.hashes[url]; ok {
+		n = int64(len(hash) - len(old))
+	}
+	if err := c.reserve(j, n); err != nil {
+		return err
 	}
-	return nil, fmt.Errorf("job not found")
+
+	c.grow(j, n)
+	j.hashes[url] = hash
+
+	return nil
+}
+
+// PageHashes returns the hashes of the pages crawled by a job, by url.
+func (c *MapConn) PageHashes(jobUUID string) (map[string]string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	j, ok := c.jobs[jobUUID]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	c.lru.MoveToFront(j.elem)
+
+	hashes := make(map[string]string, len(j.hashes))
+	for u, h := range j.hashes {
+		hashes[u] = h
+	}
+	return hashes, nil
+}
+
+// CachePage stores a copy of a page crawled by the jobs of a schedule.
+// It replaces the page cached before for the same url.
+func (c *MapConn) CachePage(template, url string, p *CachedPage) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if old, ok := c.pages[template][url]; ok {
+		c.removePage(old)
+	}
+
+	// Pages only take the room of other pages, the cache never evicts jobs.
+	n := pageSize(url, p)
+	if c.maxBytes > 0 && c.size-c.pageBytes+n > c.maxBytes {
+		return ErrFull
+	}
+	c.evictPages(n)
+
+	mp := &mapPage{template: template, url: url, page: p.clone(), size: n}
+	mp.elem = c.pageLRU.PushFront(mp)
+	if c.pages[template] == nil {
+		c.pages[template] = map[string]*mapPage{}
+	}
+	c.pages[template][url] = mp
+	c.size += n
+	c.pageBytes += n
+
+	return nil
+}
+
+// CachedPage returns a copy of a page cached for a schedule, nil when it's not cached.
+func (c *MapConn) CachedPage(template, url string) (*CachedPage, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	p, ok := c.pages[template][url]
+	if !ok {
+		return nil, nil
+	}
+	c.pageLRU.MoveToFront(p.elem)
+	return p.page.clone(), nil
 }
 
 // ViewPage decides whether a url needs to be visited or not.
 // It assumed that you don't want to crawl the same url more than once
 // in the current job.
 func (c *MapConn) ViewPage(jobUUID string, url string) (bool, error) {
-	if _, ok := c.pageViews[jobUUID]; !ok {
-		c.pageViews[jobUUID] = map[string]int64{}
-	}
+	c.Lock()
+	defer c.Unlock()
 
-	if _, ok := c.pageViews[jobUUID][url]; ok {
-		c.pageViews[jobUUID][url]++
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return false, err
+	}
+	if j.cancelled {
+		return false, nil
+	}
+	if _, ok := j.pageViews[url]; ok {
+		j.pageViews[url]++
 		return false, nil
 	}
 
-	c.pageViews[jobUUID][url] = 1
+	if err := c.reserve(j, int64(len(url))); err != nil {
+		return false, err
+	}
+	j.pageViews[url] = 1
+	c.grow(j, int64(len(url)))
+
+	return true, nil
+}
+
+// CreateJob initializes the job in memory.
+// It's the only way to create jobs, writes for unknown jobs fail with ErrJobNotFound.
+func (c *MapConn) CreateJob(jobUUID, tenant string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err == ErrJobNotFound {
+		j, err = c.newJob(jobUUID)
+	}
+	if err != nil {
+		return err
+	}
+	j.tenant = tenant
+
+	if c.active[tenant] == nil {
+		c.active[tenant] = map[string]bool{}
+	}
+	c.active[tenant][jobUUID] = true
+	return nil
+}
+
+// ActiveJobs returns the jobs created by a tenant that have not finished yet.
+func (c *MapConn) ActiveJobs(tenant string) ([]string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var jobs []string
+	for j := range c.active[tenant] {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// FinishJob removes a job from the active jobs of a tenant.
+func (c *MapConn) FinishJob(tenant, jobUUID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.active[tenant], jobUUID)
+	if len(c.active[tenant]) == 0 {
+		delete(c.active, tenant)
+	}
+	return nil
+}
+
+// Usage returns the pages crawled and the bytes downloaded by a tenant in a given day.
+func (c *MapConn) Usage(tenant, day string) (*Usage, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	u := Usage{}
+	if v, ok := c.usage[usageKey{tenant, day}]; ok {
+		u = *v
+	}
+	return &u, nil
+}
+
+// AddUsage adds pages crawled and bytes downloaded to the usage of a tenant in a given day.
+// Only the usage of the last day is kept for every tenant.
+func (c *MapConn) AddUsage(tenant, day string, pages, bytes int64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	k := usageKey{tenant, day}
+	u, ok := c.usage[k]
+	if !ok {
+		for o := range c.usage {
+			if o.tenant == tenant && o.day < day {
+				delete(c.usage, o)
+				c.size -= usageSize(o)
+			}
+		}
+
+		n := usageSize(k)
+		if err := c.reserve(nil, n); err != nil {
+			return err
+		}
+		u = &Usage{}
+		c.usage[k] = u
+		c.size += n
+	}
+	u.Pages += pages
+	u.Bytes += bytes
+	return nil
+}
+
+// CountPage adds a page to the pages crawled by a given job and returns how many it crawled.
+func (c *MapConn) CountPage(jobUUID string) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return 0, err
+	}
+	j.pages++
+	return j.pages, nil
+}
+
+// SaveSchedule creates a schedule, or replaces the one with the same id.
+func (c *MapConn) SaveSchedule(sc *Schedule) error {
+	c.Lock()
+	defer c.Unlock()
+
+	n := scheduleSize(sc)
+	if old, ok := c.schedules[sc.ID]; ok {
+		n -= scheduleSize(old)
+	}
+	if err := c.reserve(nil, n); err != nil {
+		return err
+	}
+
+	c.schedules[sc.ID] = sc.clone()
+	c.size += n
+	return nil
+}
+
+// Schedule returns the schedule with a given id.
+func (c *MapConn) Schedule(id string) (*Schedule, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	sc, ok := c.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	return sc.clone(), nil
+}
+
+// Schedules returns the schedules of all the tenants, sorted by id.
+func (c *MapConn) Schedules() ([]*Schedule, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var schedules []*Schedule
+	for _, sc := range c.schedules {
+		schedules = append(schedules, sc.clone())
+	}
+	sort.Sort(byID(schedules))
+	return schedules, nil
+}
+
+// DeleteSchedule removes a schedule and its runs.
+func (c *MapConn) DeleteSchedule(id string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if sc, ok := c.schedules[id]; ok {
+		c.size -= scheduleSize(sc)
+	}
+	c.size -= runsSize(c.runs[id])
+
+	delete(c.schedules, id)
+	delete(c.runs, id)
+	for _, p := range c.pages[id] {
+		c.removePage(p)
+	}
+	return nil
+}
+
+// AddRun adds a run to the history of a schedule, keeping the last MaxRuns.
+func (c *MapConn) AddRun(id string, r Run) error {
+	c.Lock()
+	defer c.Unlock()
+
+	runs := append([]Run{r}, c.runs[id]...)
+	sort.Stable(byTime(runs))
+	if len(runs) > MaxRuns {
+		runs = runs[:MaxRuns]
+	}
+
+	n := runsSize(runs) - runsSize(c.runs[id])
+	if err := c.reserve(nil, n); err != nil {
+		return err
+	}
+	c.runs[id] = runs
+	c.size += n
+	return nil
+}
+
+// Runs returns the history of a schedule, from the newest run to the oldest.
+func (c *MapConn) Runs(id string) ([]Run, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	runs := make([]Run, len(c.runs[id]))
+	copy(runs, c.runs[id])
+	return runs, nil
+}
+
+// AcquireLease takes, or renews, a lease for a holder during a given time.
+func (c *MapConn) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if l, ok := c.leases[name]; ok && l.Holder != holder && now.Before(l.Expires) {
+		return false, nil
+	}
+	c.leases[name] = lease{Holder: holder, Expires: now.Add(ttl)}
 	return true, nil
 }
 
-// CreateJob is NOOP in the map storage.
-func (c *MapConn) CreateJob(jobUUID string) error {
+// Cancel marks the job as cancelled, so its pages are not viewed anymore.
+func (c *MapConn) Cancel(jobUUID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return err
+	}
+	j.cancelled = true
+	return nil
+}
+
+// MergeFilter merges the filter bits with the ones stored for a given job.
+func (c *MapConn) MergeFilter(jobUUID string, bits []byte) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	j, err := c.job(jobUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make([]byte, len(bits))
+	copy(merged, bits)
+	mergeBits(merged, j.filter)
+
+	n := int64(len(merged) - len(j.filter))
+	if err := c.reserve(j, n); err != nil {
+		return nil, err
+	}
+	c.grow(j, n)
+	j.filter = merged
+
+	return merged, nil
+}
+
+// Ping always succeeds, the data lives in the process.
+func (c *MapConn) Ping() error {
+	return nil
+}
+
+// Close does nothing, the data lives as long as the process.
+func (c *MapConn) Close() error {
+	return nil
+}
+
+// job returns the job with a given uuid and marks it as the most recently used.
+// It returns ErrJobNotFound when the job was never created or it was evicted,
+// so writes don't bring evicted jobs back.
+// It must be called holding the lock.
+func (c *MapConn) job(jobUUID string) (*mapJob, error) {
+	j, ok := c.jobs[jobUUID]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	c.lru.MoveToFront(j.elem)
+	return j, nil
+}
+
+// newJob creates an empty job with a given uuid.
+// It returns ErrFull when there is no room for a new job.
+// It must be called holding the lock.
+func (c *MapConn) newJob(jobUUID string) (*mapJob, error) {
+	if err := c.makeRoom(nil, 1, jobOverhead); err != nil {
+		return nil, err
+	}
+
+	j := &mapJob{
+		uuid:      jobUUID,
+		images:    newSet(),
+		pageViews: map[string]int64{},
+		hashes:    map[string]string{},
+	}
+	j.elem = c.lru.PushFront(j)
+	c.jobs[jobUUID] = j
+	c.grow(j, jobOverhead)
+
+	return j, nil
+}
+
+// grow updates the memory used by a job.
+// It must be called holding the lock.
+func (c *MapConn) grow(j *mapJob, n int64) {
+	j.size += n
+	c.size += n
+}
+
+// reserve makes room for n more bytes used by the current job.
+// It must be called holding the lock, before writing the bytes.
+func (c *MapConn) reserve(current *mapJob, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	return c.makeRoom(current, 0, n)
+}
+
+// makeRoom evicts the least recently used cached pages, and then the least recently used jobs,
+// until the connection has room for the given number of new jobs and bytes.
+// It never evicts the current job nor the jobs with urls queued or processing,
+// it returns ErrFull when only those are left.
+// It must be called holding the lock.
+func (c *MapConn) makeRoom(current *mapJob, jobs int, n int64) error {
+	c.evictPages(n)
+
+	for (c.maxJobs > 0 && len(c.jobs)+jobs > c.maxJobs) || (c.maxBytes > 0 && c.size+n > c.maxBytes) {
+		j := c.evictable(current)
+		if j == nil {
+			return ErrFull
+		}
+
+		c.lru.Remove(j.elem)
+		delete(c.jobs, j.uuid)
+		delete(c.active[j.tenant], j.uuid)
+		c.size -= j.size
+		logging.Job(j.uuid).Info("jobEvicted", "bytes", j.size)
+	}
+	return nil
+}
+
+// evictPages evicts the least recently used cached pages until the connection has room for n more bytes,
+// or until there are no pages left.
+// It must be called holding the lock.
+func (c *MapConn) evictPages(n int64) {
+	for c.maxBytes > 0 && c.size+n > c.maxBytes && c.pageLRU.Len() > 0 {
+		c.removePage(c.pageLRU.Back().Value.(*mapPage))
+	}
+}
+
+// removePage removes a page from the cache of its schedule.
+// It must be called holding the lock.
+func (c *MapConn) removePage(p *mapPage) {
+	c.pageLRU.Remove(p.elem)
+	delete(c.pages[p.template], p.url)
+	if len(c.pages[p.template]) == 0 {
+		delete(c.pages, p.template)
+	}
+	c.size -= p.size
+	c.pageBytes -= p.size
+}
+
+// pageSize returns the approximate bytes used by a cached page.
+func pageSize(url string, p *CachedPage) int64 {
+	n := pageOverhead + len(url) + len(p.ETag) + len(p.LastModified) + len(p.Hash)
+	for _, u := range p.Images {
+		n += len(u)
+	}
+	for _, u := range p.Links {
+		n += len(u)
+	}
+	return int64(n)
+}
+
+// usageSize returns the approximate bytes used by the usage of a tenant in a day.
+func usageSize(k usageKey) int64 {
+	return int64(usageOverhead + len(k.tenant) + len(k.day))
+}
+
+// scheduleSize returns the approximate bytes used by a schedule.
+func scheduleSize(sc *Schedule) int64 {
+	n := scheduleOverhead + len(sc.ID) + len(sc.Tenant) + len(sc.Cron) + len(sc.Priority)
+	for _, s := range sc.Seeds {
+		n += len(s)
+	}
+	return int64(n)
+}
+
+// runsSize returns the approximate bytes used by the history of a schedule.
+func runsSize(runs []Run) int64 {
+	var n int
+	for _, r := range runs {
+		n += runOverhead + len(r.JobUUID) + len(r.Error)
+	}
+	return int64(n)
+}
+
+// evictable returns the least recently used job that can be evicted, nil if there is none.
+// Jobs with urls processing, or waiting in the queue, are still running.
+// The urls queued by cancelled jobs are skipped, so they don't keep those jobs.
+func (c *MapConn) evictable(current *mapJob) *mapJob {
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		if j := e.Value.(*mapJob); j != current && idle(j) {
+			return j
+		}
+	}
 	return nil
 }
+
+// idle returns true when a job has no urls processing, nor urls waiting in the queue to be crawled.
+func idle(j *mapJob) bool {
+	return j.processing <= 0 && (j.queued <= 0 || j.cancelled)
+}
@@ -1,7 +1,11 @@
 package db
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -21,6 +25,7 @@ func TestSet(t *testing.T) {
 
 func TestMapDbProcessing(t *testing.T) {
 	m, _ := NewMapConn()
+	m.CreateJob("test", "")
 	m.Processing("test")
 
 	s, _ := m.Status("test")
@@ -29,6 +34,7 @@ func TestMapDbProcessing(t *testing.T) {
 
 func TestMapDbDone(t *testing.T) {
 	m, _ := NewMapConn()
+	m.CreateJob("test", "")
 	m.Processing("test")
 	m.Done("test")
 
@@ -51,6 +57,7 @@ func TestMapDbSave(t *testing.T) {
 	_, err := m.Results("test")
 	assert.Error(t, err)
 
+	m.CreateJob("test", "")
 	m.Save("test", "src1")
 	m.Save("test", "src2")
 
@@ -58,6 +65,7 @@ func TestMapDbSave(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(i))
 
+	m.CreateJob("test2", "")
 	m.Save("test2", "src")
 
 	i, err = m.Results("test2")
@@ -65,8 +73,25 @@ func TestMapDbSave(t *testing.T) {
 	assert.Equal(t, 1, len(i))
 }
 
+func TestMapDbUnknownJob(t *testing.T) {
+	m, _ := NewMapConn()
+
+	assert.Equal(t, ErrJobNotFound, m.Save("test", "src"))
+	assert.Equal(t, ErrJobNotFound, m.Queued("test"))
+	assert.Equal(t, ErrJobNotFound, m.Processing("test"))
+	assert.Equal(t, ErrJobNotFound, m.Cancel("test"))
+
+	view, err := m.ViewPage("test", "http://example.com")
+	assert.Equal(t, ErrJobNotFound, err)
+	assert.False(t, view)
+
+	_, err = m.Status("test")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
 func TestMapDbViewPage(t *testing.T) {
 	m, _ := NewMapConn()
+	m.CreateJob("test", "")
 	m.Processing("test")
 
 	v, _ := m.ViewPage("test", "test")
@@ -81,3 +106,245 @@ func TestMapDbViewPage(t *testing.T) {
 	s, _ := m.Status("test")
 	assert.Equal(t, 3, s.PageViews()[0].Hits)
 }
+
+func TestMapDbConcurrentViewPage(t *testing.T) {
+	m, _ := NewMapConn()
+	m.CreateJob("test", "")
+
+	var wg sync.WaitGroup
+	views := make(chan bool, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _ := m.ViewPage("test", "http://example.com")
+			views <- v
+		}()
+	}
+	wg.Wait()
+	close(views)
+
+	crawled := 0
+	for v := range views {
+		if v {
+			crawled++
+		}
+	}
+	assert.Equal(t, 1, crawled)
+}
+
+func TestMapDbSaveMany(t *testing.T) {
+	m, _ := NewMapConn()
+	m.CreateJob("test", "")
+
+	m.SaveMany("test", []string{"src1", "src2", "src1"})
+
+	i, err := m.Results("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(i))
+}
+
+func TestMapDbConcurrentAccess(t *testing.T) {
+	m, _ := NewMapConn()
+	m.CreateJob("test", "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Queued("test")
+			m.Processing("test")
+			m.ViewPage("test", fmt.Sprintf("http://example.com/%d", i))
+			m.Save("test", fmt.Sprintf("http://example.com/%d.png", i))
+			m.Status("test")
+			m.Results("test")
+			m.Done("test")
+		}(i)
+	}
+	wg.Wait()
+
+	s, _ := m.Status("test")
+	assert.Equal(t, 0, s.Queued)
+	assert.Equal(t, 0, s.Processing)
+	assert.Equal(t, 20, s.Done)
+	assert.Equal(t, 20, len(s.PageViews()))
+
+	r, _ := m.Results("test")
+	assert.Equal(t, 20, len(r))
+}
+
+func TestMapDbEvictJobs(t *testing.T) {
+	m, _ := NewBoundedMapConn(2, 0)
+
+	m.CreateJob("job1", "")
+	m.Save("job1", "src")
+	m.CreateJob("job2", "")
+	m.Save("job2", "src")
+	m.Results("job1")
+	m.CreateJob("job3", "")
+	m.Save("job3", "src")
+
+	_, err := m.Results("job1")
+	assert.NoError(t, err)
+	_, err = m.Results("job2")
+	assert.Error(t, err)
+	_, err = m.Results("job3")
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrJobNotFound, m.Save("job2", "src"))
+	_, err = m.Results("job2")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
+func TestMapDbEvictBytes(t *testing.T) {
+	m, _ := NewBoundedMapConn(0, 2*jobOverhead+100)
+
+	m.CreateJob("job1", "")
+	m.Save("job1", strings.Repeat("a", 50))
+	m.CreateJob("job2", "")
+	m.Save("job2", strings.Repeat("b", 50))
+	m.Save("job2", strings.Repeat("c", 50))
+
+	_, err := m.Results("job1")
+	assert.Error(t, err)
+
+	r, err := m.Results("job2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(r))
+}
+
+func TestMapDbKeepsJobsProcessing(t *testing.T) {
+	m, _ := NewBoundedMapConn(2, 0)
+
+	m.CreateJob("job1", "")
+	m.Processing("job1")
+	m.ViewPage("job1", "http://example.com")
+	m.CreateJob("job2", "")
+	m.Save("job2", "src")
+	m.CreateJob("job3", "")
+	m.Save("job3", "src")
+
+	s, err := m.Status("job1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(s.PageViews()))
+	_, err = m.Results("job2")
+	assert.Error(t, err)
+
+	m.Processing("job3")
+	assert.Equal(t, ErrFull, m.CreateJob("job4", ""))
+	_, err = m.Results("job4")
+	assert.Equal(t, ErrJobNotFound, err)
+
+	m.Done("job1")
+	assert.NoError(t, m.CreateJob("job4", ""))
+	_, err = m.Results("job1")
+	assert.Error(t, err)
+}
+
+func TestMapDbKeepsJobsQueued(t *testing.T) {
+	m, _ := NewBoundedMapConn(1, 0)
+
+	m.CreateJob("job1", "")
+	m.Queued("job1")
+	m.Queued("job1")
+	m.Processing("job1")
+	m.Done("job1")
+	assert.Equal(t, ErrFull, m.CreateJob("job2", ""))
+
+	m.Cancel("job1")
+	assert.NoError(t, m.CreateJob("job2", ""))
+	_, err := m.Status("job1")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
+func TestMapDbFullBytes(t *testing.T) {
+	m, _ := NewBoundedMapConn(0, jobOverhead+100)
+
+	m.CreateJob("job1", "")
+	m.Processing("job1")
+	assert.NoError(t, m.Save("job1", strings.Repeat("a", 50)))
+	assert.Equal(t, ErrFull, m.Save("job1", strings.Repeat("b", 51)))
+
+	view, err := m.ViewPage("job1", strings.Repeat("c", 60))
+	assert.Equal(t, ErrFull, err)
+	assert.False(t, view)
+
+	r, _ := m.Results("job1")
+	assert.Equal(t, 1, len(r))
+}
+
+func TestMapDbEvictCachedPages(t *testing.T) {
+	m, _ := NewBoundedMapConn(0, jobOverhead+2*pageOverhead+100)
+	c := m.(*MapConn)
+	c.CreateJob("job1", "")
+
+	p := &CachedPage{Hash: "aaaa"}
+	assert.NoError(t, c.CachePage("nightly", "http://example.com/1", p))
+	assert.NoError(t, c.CachePage("nightly", "http://example.com/2", p))
+	c.CachedPage("nightly", "http://example.com/1")
+	assert.NoError(t, c.CachePage("nightly", "http://example.com/3", p))
+
+	cached, _ := c.CachedPage("nightly", "http://example.com/2")
+	assert.Nil(t, cached)
+	cached, _ = c.CachedPage("nightly", "http://example.com/1")
+	assert.NotNil(t, cached)
+
+	big := &CachedPage{Links: []string{strings.Repeat("a", 2*pageOverhead)}}
+	assert.Equal(t, ErrFull, c.CachePage("nightly", "http://example.com/4", big))
+	_, err := c.Status("job1")
+	assert.NoError(t, err)
+	cached, _ = c.CachedPage("nightly", "http://example.com/1")
+	assert.NotNil(t, cached)
+
+	assert.NoError(t, c.Save("job1", strings.Repeat("b", 2*pageOverhead)))
+	cached, _ = c.CachedPage("nightly", "http://example.com/1")
+	assert.Nil(t, cached)
+
+	c.DeleteSchedule("nightly")
+	assert.Equal(t, int64(jobOverhead+2*pageOverhead), c.size)
+}
+
+func TestMapDbSchedulesSize(t *testing.T) {
+	m, _ := NewBoundedMapConn(0, jobOverhead+scheduleOverhead+MaxRuns*runOverhead+200)
+	c := m.(*MapConn)
+	c.CreateJob("job1", "")
+
+	sc := &Schedule{ID: "nightly", Seeds: []string{"http://example.com"}}
+	assert.NoError(t, c.SaveSchedule(sc))
+	for i := 0; i < 2*MaxRuns; i++ {
+		assert.NoError(t, c.AddRun(sc.ID, Run{Time: time.Unix(int64(i), 0)}))
+	}
+	assert.Equal(t, int64(jobOverhead+scheduleOverhead+MaxRuns*runOverhead+25), c.size)
+
+	sc.Seeds = append(sc.Seeds, strings.Repeat("a", 200))
+	assert.NoError(t, c.SaveSchedule(sc))
+	_, err := c.Status("job1")
+	assert.Equal(t, ErrJobNotFound, err)
+
+	sc.Seeds = append(sc.Seeds, strings.Repeat("b", 400))
+	assert.Equal(t, ErrFull, c.SaveSchedule(sc))
+
+	c.DeleteSchedule(sc.ID)
+	assert.Equal(t, int64(0), c.size)
+}
+
+func TestMapDbUsageSize(t *testing.T) {
+	m, _ := NewBoundedMapConn(0, jobOverhead+usageOverhead+20)
+	c := m.(*MapConn)
+	c.CreateJob("job1", "")
+	c.Processing("job1")
+
+	assert.NoError(t, c.AddUsage("acme", "2015-01-01", 1, 100))
+	assert.NoError(t, c.AddUsage("acme", "2015-01-02", 1, 100))
+	assert.Equal(t, int64(jobOverhead+usageOverhead+14), c.size)
+
+	assert.Equal(t, ErrFull, c.AddUsage("other", "2015-01-02", 1, 100))
+	u, _ := c.Usage("other", "2015-01-02")
+	assert.Equal(t, 0, u.Pages)
+}
+
+func TestMapDbInvalidLimits(t *testing.T) {
+	_, err := NewBoundedMapConn(-1, 0)
+	assert.Error(t, err)
+}
@@ -1,26 +1,65 @@
 package db
 
-import "github.com/tpjg/goriakpbc"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calavera/crawler/logging"
+	"github.com/tpjg/goriakpbc"
+)
 
 const (
-	setsType     = "sets"
-	mapsType     = "maps"
-	countersType = "counters"
+	setsType       = "sets"
+	mapsType       = "maps"
+	countersType   = "counters"
+	consistentType = "consistent"
 
 	jobsBucketKey        = "jobs"
+	pageClaimsBucketKey  = "pageClaims"
+	seenFiltersBucketKey = "seenFilters"
 	imagesSetKey         = "images"
+	queuedCounterKey     = "queued"
 	processingCounterKey = "processing"
 	doneCounterKey       = "done"
 	pageViewsKey         = "pagesView"
+	pageHashesKey        = "pageHashes"
+	cancelledFlagKey     = "cancelled"
+	tenantRegisterKey    = "tenant"
+	tenantsBucketKey     = "tenants"
+	activeJobsSetKey     = "activeJobs"
+	pagesCounterKey      = "pages"
+	bytesCounterKey      = "bytes"
+	schedulesBucketKey   = "schedules"
+	scheduleIndexKey     = "index"
+	scheduleIDsSetKey    = "ids"
+	templateRegisterKey  = "template"
+	runsSetKey           = "runs"
+	leasesBucketKey      = "leases"
+	pagesBucketKey       = "cachedPages"
 
 	objectNotFoundError = "Object not found"
+	claimFailedError    = "failed"
+	claimContentType    = "text/plain"
+	filterContentType   = "application/octet-stream"
+	leaseContentType    = "application/json"
+	pageContentType     = "application/json"
 )
 
 // RiakConn implements the Connection interface using Riak as a backend.
 // This is the prefered interface to use when running in a distributed environment.
 type RiakConn struct {
-	conn *riak.Client
-	jobs *riak.Bucket
+	conn      *riak.Client
+	jobs      *riak.Bucket
+	claims    *riak.Bucket
+	filters   *riak.Bucket
+	tenants   *riak.Bucket
+	schedules *riak.Bucket
+	leases    *riak.Bucket
+	pages     *riak.Bucket
 }
 
 // NewRiakConn creates a new new instance of the database to talk with Riak.
@@ -31,32 +70,90 @@ func NewRiakConn(conn *riak.Client) (Connection, error) {
 		return nil, err
 	}
 
+	c, err := conn.NewBucketType(consistentType, pageClaimsBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := conn.NewBucket(seenFiltersBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.SetAllowMult(true); err != nil {
+		return nil, err
+	}
+
+	t, err := conn.NewBucketType(mapsType, tenantsBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := conn.NewBucketType(mapsType, schedulesBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := conn.NewBucketType(consistentType, leasesBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := conn.NewBucket(pagesBucketKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &RiakConn{
-		conn: conn,
-		jobs: j,
+		conn:      conn,
+		jobs:      j,
+		claims:    c,
+		filters:   f,
+		tenants:   t,
+		schedules: s,
+		leases:    l,
+		pages:     p,
 	}, nil
 }
 
-// Processing increments the counter of currently processing urls for a given job.
+// Queued increments the counter of urls waiting in the queue for a given job.
+func (d RiakConn) Queued(jobUUID string) error {
+	m := d.jobMap(jobUUID)
+
+	c := m.AddCounter(queuedCounterKey)
+	c.Increment(1)
+
+	return m.Store()
+}
+
+// Skipped decrements the counter of urls waiting in the queue for a given job.
+func (d RiakConn) Skipped(jobUUID string) error {
+	m := d.jobMap(jobUUID)
+
+	c := m.AddCounter(queuedCounterKey)
+	c.Increment(-1)
+
+	return m.Store()
+}
+
+// Processing increments the counter of currently processing urls
+// and decrements the counter of queued urls for a given job, in a single map update.
 func (d RiakConn) Processing(jobUUID string) error {
-	m, err := d.jobs.FetchMap(jobUUID)
-	if err != nil {
-		return err
-	}
+	m := d.jobMap(jobUUID)
 
 	c := m.AddCounter(processingCounterKey)
 	c.Increment(1)
 
+	q := m.AddCounter(queuedCounterKey)
+	q.Increment(-1)
+
 	return m.Store()
 }
 
 // Done increments one element the counter of done urls
 // and decrements the counter of processing urls for a given job.
 func (d RiakConn) Done(jobUUID string) error {
-	m, err := d.jobs.FetchMap(jobUUID)
-	if err != nil {
-		return err
-	}
+	m := d.jobMap(jobUUID)
 
 	c := m.AddCounter(doneCounterKey)
 	c.Increment(1)
@@ -69,25 +166,45 @@ func (d RiakConn) Done(jobUUID string) error {
 
 // Save adds an image source to the set of images for a given job.
 func (d RiakConn) Save(jobUUID, src string) error {
-	m, err := d.jobs.FetchMap(jobUUID)
-	if err != nil {
-		return err
+	return d.SaveMany(jobUUID, []string{src})
+}
+
+// SaveMany adds several image sources to the set of images for a given job
+// in a single map update.
+func (d RiakConn) SaveMany(jobUUID string, srcs []string) error {
+	if len(srcs) == 0 {
+		return nil
 	}
 
+	m := d.jobMap(jobUUID)
+
 	s := m.AddSet(imagesSetKey)
-	s.Add([]byte(src))
+	for _, src := range srcs {
+		s.Add([]byte(src))
+	}
 	return m.Store()
 }
 
 // Status returns the processing and done counters of a given job.
 func (d RiakConn) Status(jobUUID string) (*Info, error) {
 	m, err := d.jobs.FetchMap(jobUUID)
+	if err == riak.NotFound {
+		return nil, ErrJobNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	info := &Info{}
 
+	if r := m.FetchRegister(tenantRegisterKey); r != nil {
+		info.Tenant = string(r.GetValue())
+	}
+
+	if c := m.FetchCounter(queuedCounterKey); c != nil {
+		info.Queued = c.GetValue()
+	}
+
 	if c := m.FetchCounter(processingCounterKey); c != nil {
 		info.Processing = c.GetValue()
 	}
@@ -96,6 +213,10 @@ func (d RiakConn) Status(jobUUID string) (*Info, error) {
 		info.Done = c.GetValue()
 	}
 
+	if f := m.FetchFlag(cancelledFlagKey); f != nil {
+		info.Cancelled = f.GetValue()
+	}
+
 	var pages []Page
 	if v := m.FetchMap(pageViewsKey); v != nil {
 		for k := range v.Values {
@@ -114,6 +235,9 @@ func (d RiakConn) Status(jobUUID string) (*Info, error) {
 // Results returns the processed images for a given job.
 func (d RiakConn) Results(jobUUID string) ([][]byte, error) {
 	m, err := d.jobs.FetchMap(jobUUID)
+	if err == riak.NotFound {
+		return nil, ErrJobNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -125,32 +249,532 @@ func (d RiakConn) Results(jobUUID string) ([][]byte, error) {
 	return sv, nil
 }
 
+// SavePageHash stores the hash of the content of a page crawled by a job
+// in a register of the job map, so the last crawl of the page wins.
+func (d RiakConn) SavePageHash(jobUUID, url, hash string) error {
+	m := d.jobMap(jobUUID)
+	m.AddMap(pageHashesKey).AddRegister(url).Update([]byte(hash))
+	return m.Store()
+}
+
+// PageHashes returns the hashes of the pages crawled by a job, by url.
+func (d RiakConn) PageHashes(jobUUID string) (map[string]string, error) {
+	m, err := d.jobs.FetchMap(jobUUID)
+	if err == riak.NotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	if h := m.FetchMap(pageHashesKey); h != nil {
+		for k := range h.Values {
+			if r := h.FetchRegister(k.Key); r != nil {
+				hashes[k.Key] = string(r.GetValue())
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// CachePage stores a page crawled by the jobs of a schedule as a json object.
+// Concurrent writes are resolved by Riak, the last one wins.
+func (d RiakConn) CachePage(template, url string, p *CachedPage) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	o := d.pages.NewObject(cachedPageKey(template, url))
+	o.ContentType = pageContentType
+	o.Data = b
+	return o.Store()
+}
+
+// CachedPage returns a page cached for a schedule, nil when it's not cached.
+func (d RiakConn) CachedPage(template, url string) (*CachedPage, error) {
+	o, err := d.pages.Get(cachedPageKey(template, url))
+	if err == riak.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p CachedPage
+	if err := json.Unmarshal(o.Data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
 // ViewPage decides whether a url needs to be visited or not.
 // It assumed that you don't want to crawl the same url more than once
 // in the current job.
+// The decision is taken by claiming the page in a strongly consistent bucket,
+// only one node can create the claim, the rest get a precondition failure.
+// The hits counter is updated without reading the job map first.
+// Pages of cancelled jobs are not claimed.
 func (d RiakConn) ViewPage(jobUUID string, url string) (bool, error) {
-	m, err := d.jobs.FetchMap(jobUUID)
+	cancelled, err := d.claims.Exists(cancelKey(jobUUID))
 	if err != nil {
 		return false, err
 	}
 
+	view := false
+	if !cancelled {
+		view, err = d.claimPage(jobUUID, url)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	m := d.jobMap(jobUUID)
 	v := m.AddMap(pageViewsKey)
 	c := v.AddCounter(url)
-
-	view := c.GetValue() == 0
 	c.Increment(1)
-	err = m.Store()
 
-	return view, err
+	return view, m.Store()
 }
 
 // CreateJob initializes the job map in the Riak cluster.
 // This operation must be performed before any crawling starts
 // to guarantee that the process stores the data properly.
-func (d RiakConn) CreateJob(jobUUID string) error {
+func (d RiakConn) CreateJob(jobUUID, tenant string) error {
+	m := d.jobMap(jobUUID)
+	if tenant != "" {
+		m.AddRegister(tenantRegisterKey).Update([]byte(tenant))
+	}
+	if err := m.Store(); err != nil {
+		return err
+	}
+
+	t := d.tenantMap(activeJobsKey(tenant))
+	t.AddSet(activeJobsSetKey).Add([]byte(jobUUID))
+	return t.Store()
+}
+
+// Cancel marks the job as cancelled in the job map, so its status reports it.
+// It also stores a marker next to the page claims,
+// so nodes can check it without fetching the whole job map.
+func (d RiakConn) Cancel(jobUUID string) error {
+	o := d.claims.NewObject(cancelKey(jobUUID))
+	o.ContentType = claimContentType
+	o.Data = []byte(jobUUID)
+
+	if err := o.Store(); err != nil {
+		if err.Error() != claimFailedError {
+			return err
+		}
+		logging.Job(jobUUID).Debug("jobAlreadyCancelled")
+	}
+
+	m := d.jobMap(jobUUID)
+	m.AddFlag(cancelledFlagKey).Enable()
+	return m.Store()
+}
+
+// MergeFilter merges the filter bits with the ones stored for a given job.
+// Filters are merged with a bitwise OR, so concurrent writes are stored as siblings
+// and resolved the next time that any node merges its filter.
+// The filter is not written back when the bits don't add anything to the stored ones.
+func (d RiakConn) MergeFilter(jobUUID string, bits []byte) ([]byte, error) {
+	o, err := d.filters.Get(jobUUID)
+	if err != nil && err != riak.NotFound {
+		return nil, err
+	}
+
+	merged := make([]byte, len(bits))
+	copy(merged, bits)
+
+	if o.Conflict() {
+		logging.Job(jobUUID).Debug("filterSiblingsMerged", "siblings", len(o.Siblings))
+		for _, s := range o.Siblings {
+			mergeBits(merged, s.Data)
+		}
+	} else {
+		mergeBits(merged, o.Data)
+		if err == nil && bytes.Equal(merged, o.Data) {
+			return merged, nil
+		}
+	}
+
+	o.ContentType = filterContentType
+	o.Data = merged
+	return merged, o.Store()
+}
+
+// ActiveJobs returns the jobs created by a tenant that have not finished yet.
+func (d RiakConn) ActiveJobs(tenant string) ([]string, error) {
+	m, err := d.tenants.FetchMap(activeJobsKey(tenant))
+	if err == riak.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []string
+	if s := m.FetchSet(activeJobsSetKey); s != nil {
+		for _, j := range s.GetValue() {
+			jobs = append(jobs, string(j))
+		}
+	}
+	return jobs, nil
+}
+
+// FinishJob removes a job from the active jobs of a tenant.
+// The map is fetched first because Riak needs its causal context to remove elements.
+func (d RiakConn) FinishJob(tenant, jobUUID string) error {
+	m, err := d.tenants.FetchMap(activeJobsKey(tenant))
+	if err == riak.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m.AddSet(activeJobsSetKey).Remove([]byte(jobUUID))
+	return m.Store()
+}
+
+// Usage returns the pages crawled and the bytes downloaded by a tenant in a given day.
+func (d RiakConn) Usage(tenant, day string) (*Usage, error) {
+	m, err := d.tenants.FetchMap(usageObjectKey(tenant, day))
+	if err == riak.NotFound {
+		return &Usage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Usage{}
+	if c := m.FetchCounter(pagesCounterKey); c != nil {
+		u.Pages = c.GetValue()
+	}
+	if c := m.FetchCounter(bytesCounterKey); c != nil {
+		u.Bytes = c.GetValue()
+	}
+	return u, nil
+}
+
+// AddUsage adds pages crawled and bytes downloaded to the usage of a tenant in a given day.
+func (d RiakConn) AddUsage(tenant, day string, pages, bytes int64) error {
+	m := d.tenantMap(usageObjectKey(tenant, day))
+	m.AddCounter(pagesCounterKey).Increment(pages)
+	m.AddCounter(bytesCounterKey).Increment(bytes)
+	return m.Store()
+}
+
+// CountPage adds a page to the pages crawled by a given job and returns how many it crawled.
+// The counter has its own object, because fetching the map of the job reads all its pages.
+func (d RiakConn) CountPage(jobUUID string) (int64, error) {
+	m := d.tenantMap(jobPagesKey(jobUUID))
+	m.AddCounter(pagesCounterKey).Increment(1)
+	if err := m.Store(); err != nil {
+		return 0, err
+	}
+
+	f, err := d.tenants.FetchMap(jobPagesKey(jobUUID))
+	if err != nil {
+		return 0, err
+	}
+	if c := f.FetchCounter(pagesCounterKey); c != nil {
+		return c.GetValue(), nil
+	}
+	return 0, nil
+}
+
+// SaveSchedule stores the schedule as json in a register of its map,
+// and adds its id to the index of schedules.
+func (d RiakConn) SaveSchedule(sc *Schedule) error {
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	m := d.scheduleMap(sc.ID)
+	m.AddRegister(templateRegisterKey).Update(b)
+	if err := m.Store(); err != nil {
+		return err
+	}
+
+	i := d.scheduleMap(scheduleIndexKey)
+	i.AddSet(scheduleIDsSetKey).Add([]byte(sc.ID))
+	return i.Store()
+}
+
+// Schedule returns the schedule with a given id.
+func (d RiakConn) Schedule(id string) (*Schedule, error) {
+	m, err := d.schedules.FetchMap(id)
+	if err == riak.NotFound {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := m.FetchRegister(templateRegisterKey)
+	if r == nil {
+		return nil, ErrScheduleNotFound
+	}
+
+	var sc Schedule
+	if err := json.Unmarshal(r.GetValue(), &sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// Schedules returns the schedules of all the tenants, sorted by id.
+// Schedules deleted while they are listed are skipped.
+func (d RiakConn) Schedules() ([]*Schedule, error) {
+	m, err := d.schedules.FetchMap(scheduleIndexKey)
+	if err == riak.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []*Schedule
+	if s := m.FetchSet(scheduleIDsSetKey); s != nil {
+		for _, id := range s.GetValue() {
+			sc, err := d.Schedule(string(id))
+			if err == ErrScheduleNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			schedules = append(schedules, sc)
+		}
+	}
+	sort.Sort(byID(schedules))
+	return schedules, nil
+}
+
+// DeleteSchedule removes the fields of the schedule map and its id from the index.
+// The pages cached for the schedule are kept, Riak can't list them without scanning the bucket.
+// Both maps are fetched first because Riak needs their causal context to remove elements.
+func (d RiakConn) DeleteSchedule(id string) error {
+	m, err := d.schedules.FetchMap(id)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	if err == nil {
+		m.RemoveRegister(templateRegisterKey)
+		m.RemoveSet(runsSetKey)
+		if err := m.Store(); err != nil {
+			return err
+		}
+	}
+
+	i, err := d.schedules.FetchMap(scheduleIndexKey)
+	if err == riak.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	i.AddSet(scheduleIDsSetKey).Remove([]byte(id))
+	return i.Store()
+}
+
+// AddRun adds a run to the set of runs of a schedule.
+// Runs are stored with their time in nanoseconds as a prefix, so they sort by time,
+// and the oldest ones are removed from the set when there are more than MaxRuns.
+func (d RiakConn) AddRun(id string, r Run) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	m, err := d.schedules.FetchMap(id)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	if err == riak.NotFound {
+		m = d.scheduleMap(id)
+	}
+
+	s := m.AddSet(runsSetKey)
+	e := fmt.Sprintf("%020d %s", r.Time.UnixNano(), b)
+	entries := append(runEntries(s.GetValue()), e)
+	sort.Strings(entries)
+
+	keep := true
+	for len(entries) > MaxRuns {
+		if entries[0] == e {
+			keep = false
+		} else {
+			s.Remove([]byte(entries[0]))
+		}
+		entries = entries[1:]
+	}
+	if keep {
+		s.Add([]byte(e))
+	}
+	return m.Store()
+}
+
+// Runs returns the history of a schedule, from the newest run to the oldest.
+func (d RiakConn) Runs(id string) ([]Run, error) {
+	m, err := d.schedules.FetchMap(id)
+	if err == riak.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	if s := m.FetchSet(runsSetKey); s != nil {
+		for _, e := range runEntries(s.GetValue()) {
+			i := strings.IndexByte(e, ' ')
+			if i < 0 {
+				continue
+			}
+
+			var r Run
+			if err := json.Unmarshal([]byte(e[i+1:]), &r); err != nil {
+				return nil, err
+			}
+			runs = append(runs, r)
+		}
+	}
+	sort.Stable(byTime(runs))
+	return runs, nil
+}
+
+// AcquireLease takes, or renews, a lease for a holder during a given time.
+// The lease is stored in a strongly consistent bucket,
+// so when two nodes write it at the same time, the one without the current vclock fails.
+// Expirations use the clock of every node, they must be in sync.
+func (d RiakConn) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	o, err := d.leases.Get(name)
+	if err != nil && err != riak.NotFound {
+		return false, err
+	}
+
+	now := time.Now()
+	if err == nil {
+		var l lease
+		if err := json.Unmarshal(o.Data, &l); err != nil {
+			return false, err
+		}
+		if l.Holder != holder && now.Before(l.Expires) {
+			return false, nil
+		}
+	}
+
+	b, err := json.Marshal(lease{Holder: holder, Expires: now.Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+
+	o.ContentType = leaseContentType
+	o.Data = b
+	if err := o.Store(); err != nil {
+		if err.Error() == claimFailedError {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Ping sends a ping request to the Riak node.
+func (d RiakConn) Ping() error {
+	return d.conn.Ping()
+}
+
+// Close closes the connections in the Riak client pool.
+func (d RiakConn) Close() error {
+	d.conn.Close()
+	return nil
+}
+
+// claimPage stores a new object for the url without causal context.
+// Riak rejects that write if the object already exists in a consistent bucket,
+// which means that another node claimed the page first.
+func (d RiakConn) claimPage(jobUUID, url string) (bool, error) {
+	o := d.claims.NewObject(claimKey(jobUUID, url))
+	o.ContentType = claimContentType
+	o.Data = []byte(url)
+
+	err := o.Store()
+	if err == nil {
+		return true, nil
+	}
+
+	if err.Error() == claimFailedError {
+		logging.Job(jobUUID).Debug("pageAlreadyClaimed", logging.URLKey, url)
+		return false, nil
+	}
+	return false, err
+}
+
+// jobMap initializes an empty map for a job.
+// Operations stored in this map are applied without fetching the map first.
+func (d RiakConn) jobMap(jobUUID string) *riak.RDtMap {
 	m := &riak.RDtMap{RDataTypeObject: riak.RDataTypeObject{Key: jobUUID, Bucket: d.jobs}}
 	m.Init(nil)
-	return m.Store()
+	return m
+}
+
+// tenantMap initializes an empty map in the tenants bucket.
+func (d RiakConn) tenantMap(key string) *riak.RDtMap {
+	m := &riak.RDtMap{RDataTypeObject: riak.RDataTypeObject{Key: key, Bucket: d.tenants}}
+	m.Init(nil)
+	return m
+}
+
+// scheduleMap initializes an empty map in the schedules bucket.
+func (d RiakConn) scheduleMap(key string) *riak.RDtMap {
+	m := &riak.RDtMap{RDataTypeObject: riak.RDataTypeObject{Key: key, Bucket: d.schedules}}
+	m.Init(nil)
+	return m
+}
+
+// runEntries returns the sorted entries of a set of runs.
+func runEntries(values [][]byte) []string {
+	var entries []string
+	for _, v := range values {
+		entries = append(entries, string(v))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// activeJobsKey never collides with the usage keys because of their prefixes.
+func activeJobsKey(tenant string) string {
+	return "jobs:" + tenant
+}
+
+func usageObjectKey(tenant, day string) string {
+	return fmt.Sprintf("usage:%s:%s", tenant, day)
+}
+
+func jobPagesKey(jobUUID string) string {
+	return "pages:" + jobUUID
+}
+
+func claimKey(jobUUID, url string) string {
+	return fmt.Sprintf("%s:%s", jobUUID, url)
+}
+
+// cancelKey never collides with the claim keys because job uuids are hexadecimal.
+func cancelKey(jobUUID string) string {
+	return fmt.Sprintf("cancelled:%s", jobUUID)
+}
+
+// cachedPageKey identifies a page cached for a schedule.
+// Schedule ids don't have spaces, so the url is everything after the first one.
+func cachedPageKey(template, url string) string {
+	return template + " " + url
 }
 
 func getCounter(bucket *riak.Bucket, jobUUID string) (int64, error) {
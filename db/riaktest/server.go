@@ -0,0 +1,464 @@
+package riaktest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+// Riak protocol buffers message codes used by the server.
+const (
+	errorResp      = 0
+	pingReq        = 1
+	pingResp       = 2
+	getReq         = 9
+	getResp        = 10
+	putReq         = 11
+	putResp        = 12
+	getBucketReq   = 19
+	getBucketResp  = 20
+	setBucketReq   = 21
+	setBucketResp  = 22
+	dtFetchReq     = 80
+	dtFetchResp    = 81
+	dtUpdateReq    = 82
+	dtUpdateResp   = 83
+	defaultType    = "default"
+	failedError    = "failed"
+	unknownMessage = "Unknown message code"
+)
+
+var errFailed = errors.New(failedError)
+
+// bucketType holds the properties of a bucket type.
+type bucketType struct {
+	datatype   string
+	consistent bool
+}
+
+// object is a key value object stored in the server, with all its siblings.
+type object struct {
+	vclock   []byte
+	siblings []*pb.RpbContent
+}
+
+// Server is an in-process server that speaks the subset of the Riak protocol buffers api
+// that the crawler uses: bucket properties, key value objects and maps with counters, sets and maps.
+// It's designed to run hermetic tests, it doesn't support clustering nor secondary indexes.
+//
+// It includes the bucket types that scripts/start-riak.sh creates:
+// `counters`, `sets`, `maps` and the strongly consistent `consistent`.
+type Server struct {
+	*sync.Mutex
+	listener  net.Listener
+	types     map[string]bucketType
+	allowMult map[string]bool
+	objects   map[string]*object
+	maps      map[string]*dtMap
+	vclock    uint64
+	conns     map[net.Conn]bool
+	wg        *sync.WaitGroup
+}
+
+// Start starts a new server listening in a random port in the loopback interface.
+func Start() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Mutex:    new(sync.Mutex),
+		listener: l,
+		types: map[string]bucketType{
+			defaultType:  {},
+			"counters":   {datatype: "counter"},
+			"sets":       {datatype: "set"},
+			"maps":       {datatype: "map"},
+			"consistent": {consistent: true},
+		},
+		allowMult: map[string]bool{},
+		objects:   map[string]*object{},
+		maps:      map[string]*dtMap{},
+		conns:     map[net.Conn]bool{},
+		wg:        new(sync.WaitGroup),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Addr returns the host and port where the server is listening.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops the server and disconnects all the clients.
+func (s *Server) Shutdown() {
+	s.listener.Close()
+
+	s.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.Lock()
+		s.conns[c] = true
+		s.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// serve reads messages with the format `<length:32> <msg_code:8> <pbmsg>`
+// and writes the responses with the same format.
+func (s *Server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		c.Close()
+		s.Lock()
+		delete(s.conns, c)
+		s.Unlock()
+	}()
+
+	for {
+		var h [5]byte
+		if _, err := io.ReadFull(c, h[:]); err != nil {
+			return
+		}
+
+		msg := make([]byte, binary.BigEndian.Uint32(h[:4])-1)
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+
+		code, resp, err := s.handle(h[4], msg)
+		if err != nil {
+			code = errorResp
+			resp = &pb.RpbErrorResp{Errmsg: []byte(err.Error()), Errcode: proto.Uint32(0)}
+		}
+
+		var b []byte
+		if resp != nil {
+			if b, err = proto.Marshal(resp); err != nil {
+				return
+			}
+		}
+
+		out := make([]byte, 5, len(b)+5)
+		binary.BigEndian.PutUint32(out, uint32(len(b)+1))
+		out[4] = code
+		if _, err := c.Write(append(out, b...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(code byte, msg []byte) (byte, proto.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch code {
+	case pingReq:
+		return pingResp, nil, nil
+	case getBucketReq:
+		req := &pb.RpbGetBucketReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		return getBucketResp, s.getBucket(req), nil
+	case setBucketReq:
+		req := &pb.RpbSetBucketReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		s.allowMult[bucketKey(req.Type, req.Bucket)] = req.Props.GetAllowMult()
+		return setBucketResp, nil, nil
+	case getReq:
+		req := &pb.RpbGetReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		return getResp, s.get(req), nil
+	case putReq:
+		req := &pb.RpbPutReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		resp, err := s.put(req)
+		return putResp, resp, err
+	case dtFetchReq:
+		req := &pb.DtFetchReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		resp, err := s.fetch(req)
+		return dtFetchResp, resp, err
+	case dtUpdateReq:
+		req := &pb.DtUpdateReq{}
+		if err := proto.Unmarshal(msg, req); err != nil {
+			return 0, nil, err
+		}
+		return dtUpdateResp, &pb.DtUpdateResp{}, s.update(req)
+	}
+
+	return 0, nil, errors.New(unknownMessage)
+}
+
+func (s *Server) getBucket(req *pb.RpbGetBucketReq) *pb.RpbGetBucketResp {
+	t := s.types[typeName(req.Type)]
+
+	return &pb.RpbGetBucketResp{
+		Props: &pb.RpbBucketProps{
+			NVal:       proto.Uint32(3),
+			AllowMult:  proto.Bool(s.allowMult[bucketKey(req.Type, req.Bucket)]),
+			Datatype:   []byte(t.datatype),
+			Consistent: proto.Bool(t.consistent),
+		},
+	}
+}
+
+func (s *Server) get(req *pb.RpbGetReq) *pb.RpbGetResp {
+	o, ok := s.objects[objectKey(req.Type, req.Bucket, req.Key)]
+	if !ok {
+		return &pb.RpbGetResp{}
+	}
+
+	return &pb.RpbGetResp{
+		Content: o.siblings,
+		Vclock:  o.vclock,
+	}
+}
+
+// put stores an object.
+// Writes without the current vclock fail in consistent buckets,
+// and they are stored as siblings in buckets that allow them.
+func (s *Server) put(req *pb.RpbPutReq) (*pb.RpbPutResp, error) {
+	k := objectKey(req.Type, req.Bucket, req.Key)
+	o, exists := s.objects[k]
+	current := exists && bytes.Equal(o.vclock, req.Vclock)
+
+	if exists && !current && s.types[typeName(req.Type)].consistent {
+		return nil, errFailed
+	}
+
+	now := time.Now()
+	c := req.Content
+	c.LastMod = proto.Uint32(uint32(now.Unix()))
+	c.LastModUsecs = proto.Uint32(uint32(now.Nanosecond() / 1000))
+
+	if exists && !current && s.allowMult[bucketKey(req.Type, req.Bucket)] {
+		o.siblings = append(o.siblings, c)
+	} else {
+		o = &object{siblings: []*pb.RpbContent{c}}
+		s.objects[k] = o
+	}
+	o.vclock = s.nextVclock()
+
+	return &pb.RpbPutResp{Vclock: o.vclock, Key: req.Key}, nil
+}
+
+func (s *Server) fetch(req *pb.DtFetchReq) (*pb.DtFetchResp, error) {
+	if s.types[typeName(req.Type)].datatype != "map" {
+		return nil, errors.New("Datatype not supported")
+	}
+
+	resp := &pb.DtFetchResp{Type: pb.DtFetchResp_MAP.Enum()}
+	if m, ok := s.maps[objectKey(req.Type, req.Bucket, req.Key)]; ok {
+		resp.Value = &pb.DtValue{MapValue: m.entries()}
+		resp.Context = s.nextVclock()
+	}
+
+	return resp, nil
+}
+
+func (s *Server) update(req *pb.DtUpdateReq) error {
+	if s.types[typeName(req.Type)].datatype != "map" || req.Op.MapOp == nil {
+		return errors.New("Datatype not supported")
+	}
+
+	k := objectKey(req.Type, req.Bucket, req.Key)
+	m, ok := s.maps[k]
+	if !ok {
+		m = newDtMap()
+		s.maps[k] = m
+	}
+	m.apply(req.Op.MapOp)
+
+	return nil
+}
+
+func (s *Server) nextVclock() []byte {
+	s.vclock++
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, s.vclock)
+	return b
+}
+
+// dtMap is a Riak map, with counters, sets, registers, flags and other maps as fields.
+type dtMap struct {
+	counters  map[string]int64
+	sets      map[string]map[string]bool
+	registers map[string][]byte
+	flags     map[string]bool
+	maps      map[string]*dtMap
+}
+
+func newDtMap() *dtMap {
+	return &dtMap{
+		counters:  map[string]int64{},
+		sets:      map[string]map[string]bool{},
+		registers: map[string][]byte{},
+		flags:     map[string]bool{},
+		maps:      map[string]*dtMap{},
+	}
+}
+
+func (m *dtMap) apply(op *pb.MapOp) {
+	for _, f := range op.Removes {
+		m.remove(f)
+	}
+
+	for _, u := range op.Updates {
+		n := string(u.Field.Name)
+
+		switch u.Field.GetType() {
+		case pb.MapField_COUNTER:
+			m.counters[n] += incr(u.CounterOp)
+		case pb.MapField_SET:
+			s, ok := m.sets[n]
+			if !ok {
+				s = map[string]bool{}
+				m.sets[n] = s
+			}
+			if u.SetOp != nil {
+				for _, a := range u.SetOp.Adds {
+					s[string(a)] = true
+				}
+				for _, r := range u.SetOp.Removes {
+					delete(s, string(r))
+				}
+			}
+		case pb.MapField_REGISTER:
+			m.registers[n] = u.RegisterOp
+		case pb.MapField_FLAG:
+			m.flags[n] = u.GetFlagOp() == pb.MapUpdate_ENABLE
+		case pb.MapField_MAP:
+			c, ok := m.maps[n]
+			if !ok {
+				c = newDtMap()
+				m.maps[n] = c
+			}
+			if u.MapOp != nil {
+				c.apply(u.MapOp)
+			}
+		}
+	}
+}
+
+func (m *dtMap) remove(f *pb.MapField) {
+	n := string(f.Name)
+
+	switch f.GetType() {
+	case pb.MapField_COUNTER:
+		delete(m.counters, n)
+	case pb.MapField_SET:
+		delete(m.sets, n)
+	case pb.MapField_REGISTER:
+		delete(m.registers, n)
+	case pb.MapField_FLAG:
+		delete(m.flags, n)
+	case pb.MapField_MAP:
+		delete(m.maps, n)
+	}
+}
+
+func (m *dtMap) entries() []*pb.MapEntry {
+	var e []*pb.MapEntry
+
+	for n, v := range m.counters {
+		e = append(e, &pb.MapEntry{Field: field(n, pb.MapField_COUNTER), CounterValue: proto.Int64(v)})
+	}
+
+	for n, v := range m.sets {
+		var values []string
+		for k := range v {
+			values = append(values, k)
+		}
+		sort.Strings(values)
+
+		var sv [][]byte
+		for _, k := range values {
+			sv = append(sv, []byte(k))
+		}
+		e = append(e, &pb.MapEntry{Field: field(n, pb.MapField_SET), SetValue: sv})
+	}
+
+	for n, v := range m.registers {
+		e = append(e, &pb.MapEntry{Field: field(n, pb.MapField_REGISTER), RegisterValue: v})
+	}
+
+	for n, v := range m.flags {
+		e = append(e, &pb.MapEntry{Field: field(n, pb.MapField_FLAG), FlagValue: proto.Bool(v)})
+	}
+
+	for n, v := range m.maps {
+		e = append(e, &pb.MapEntry{Field: field(n, pb.MapField_MAP), MapValue: v.entries()})
+	}
+
+	return e
+}
+
+func field(name string, t pb.MapField_MapFieldType) *pb.MapField {
+	return &pb.MapField{Name: []byte(name), Type: t.Enum()}
+}
+
+// incr returns the increment of a counter operation, one by default.
+func incr(op *pb.CounterOp) int64 {
+	if op == nil {
+		return 0
+	}
+	if op.Increment == nil {
+		return 1
+	}
+	return *op.Increment
+}
+
+func typeName(t []byte) string {
+	if len(t) == 0 {
+		return defaultType
+	}
+	return string(t)
+}
+
+func bucketKey(t, bucket []byte) string {
+	return typeName(t) + "/" + string(bucket)
+}
+
+func objectKey(t, bucket, key []byte) string {
+	return bucketKey(t, bucket) + "/" + string(key)
+}
@@ -0,0 +1,122 @@
+// Package diff compares what two jobs found, usually two crawls of the same site.
+// Images are compared by url. Pages are compared by url and by the hash of their content,
+// when both jobs crawled them.
+package diff
+
+import (
+	"sort"
+
+	"github.com/calavera/crawler/db"
+)
+
+// Changes lists the urls that differ between two jobs, sorted alphabetically.
+type Changes struct {
+	Added     []string `json:"added"`     // found by the new job only.
+	Removed   []string `json:"removed"`   // found by the old job only.
+	Changed   []string `json:"changed"`   // found by both jobs with different content hashes.
+	Unchanged int      `json:"unchanged"` // found by both jobs without known changes.
+}
+
+// Report holds the changes between an old job and a new job.
+type Report struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Images Changes `json:"images"`
+	Pages  Changes `json:"pages"`
+}
+
+// Jobs compares the images and the pages found by two jobs.
+// It returns db.ErrJobNotFound when any of the jobs doesn't exist.
+func Jobs(d db.Connection, from, to string) (*Report, error) {
+	oldImages, err := images(d, from)
+	if err != nil {
+		return nil, err
+	}
+	newImages, err := images(d, to)
+	if err != nil {
+		return nil, err
+	}
+
+	oldPages, err := pages(d, from)
+	if err != nil {
+		return nil, err
+	}
+	newPages, err := pages(d, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Report{
+		From:   from,
+		To:     to,
+		Images: Compare(oldImages, newImages),
+		Pages:  Compare(oldPages, newPages),
+	}, nil
+}
+
+// Compare finds the changes between two sets of urls with their content hashes.
+// Empty hashes are unknown, so urls are only changed when both hashes are known.
+func Compare(from, to map[string]string) Changes {
+	c := Changes{Added: []string{}, Removed: []string{}, Changed: []string{}}
+
+	for u, h := range to {
+		old, ok := from[u]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, u)
+		case old != "" && h != "" && old != h:
+			c.Changed = append(c.Changed, u)
+		default:
+			c.Unchanged++
+		}
+	}
+
+	for u := range from {
+		if _, ok := to[u]; !ok {
+			c.Removed = append(c.Removed, u)
+		}
+	}
+
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+	sort.Strings(c.Changed)
+	return c
+}
+
+// images returns the images found by a job.
+// Images are not downloaded, so their hashes are unknown.
+func images(d db.Connection, jobUUID string) (map[string]string, error) {
+	results, err := d.Results(jobUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string, len(results))
+	for _, r := range results {
+		m[string(r)] = ""
+	}
+	return m, nil
+}
+
+// pages returns the pages seen by a job, with the hashes of the ones that it crawled.
+// The hashes are empty when the storage doesn't implement db.PageHashStore.
+func pages(d db.Connection, jobUUID string) (map[string]string, error) {
+	info, err := d.Status(jobUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes map[string]string
+	if hs, ok := db.AsPageHashStore(d); ok {
+		hashes, err = hs.PageHashes(jobUUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := make(map[string]string, len(info.PageViews()))
+	for _, p := range info.PageViews() {
+		m[p.URL] = hashes[p.URL]
+	}
+	return m, nil
+}
@@ -0,0 +1,68 @@
+package diff
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	from := map[string]string{"/a": "1", "/b": "2", "/c": "", "/d": "4", "/e": "5"}
+	to := map[string]string{"/a": "1", "/b": "3", "/c": "3", "/d": "", "/f": ""}
+
+	c := Compare(from, to)
+	assert.Equal(t, []string{"/f"}, c.Added)
+	assert.Equal(t, []string{"/e"}, c.Removed)
+	assert.Equal(t, []string{"/b"}, c.Changed)
+	assert.Equal(t, 3, c.Unchanged)
+}
+
+func TestCompareEmpty(t *testing.T) {
+	c := Compare(nil, nil)
+	assert.NotNil(t, c.Added)
+	assert.NotNil(t, c.Removed)
+	assert.NotNil(t, c.Changed)
+	assert.Equal(t, 0, c.Unchanged)
+}
+
+func TestJobs(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	from := queue.UUID()
+	d.CreateJob(from, "")
+	d.SaveMany(from, []string{"http://example.com/logo.png", "http://example.com/bg.png"})
+	d.ViewPage(from, "http://example.com")
+	d.ViewPage(from, "http://example.com/about")
+	hs := d.(db.PageHashStore)
+	hs.SavePageHash(from, "http://example.com", "aaaa")
+	hs.SavePageHash(from, "http://example.com/about", "bbbb")
+
+	to := queue.UUID()
+	d.CreateJob(to, "")
+	d.SaveMany(to, []string{"http://example.com/logo.png", "http://example.com/new.png"})
+	d.ViewPage(to, "http://example.com")
+	d.ViewPage(to, "http://example.com/about")
+	d.ViewPage(to, "http://example.com/blog")
+	hs.SavePageHash(to, "http://example.com", "aaaa")
+	hs.SavePageHash(to, "http://example.com/about", "cccc")
+
+	r, err := Jobs(d, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, from, r.From)
+	assert.Equal(t, to, r.To)
+
+	assert.Equal(t, []string{"http://example.com/new.png"}, r.Images.Added)
+	assert.Equal(t, []string{"http://example.com/bg.png"}, r.Images.Removed)
+	assert.Empty(t, r.Images.Changed)
+	assert.Equal(t, 1, r.Images.Unchanged)
+
+	assert.Equal(t, []string{"http://example.com/blog"}, r.Pages.Added)
+	assert.Empty(t, r.Pages.Removed)
+	assert.Equal(t, []string{"http://example.com/about"}, r.Pages.Changed)
+	assert.Equal(t, 1, r.Pages.Unchanged)
+
+	_, err = Jobs(d, from, queue.UUID())
+	assert.Equal(t, db.ErrJobNotFound, err)
+}
@@ -0,0 +1,209 @@
+package functional
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/api"
+	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/crawler"
+	"github.com/calavera/crawler/crawler/sitetest"
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+const crawlTimeout = 10 * time.Second
+
+var statusRegexp = regexp.MustCompile(`- Processing: (-?\d+) URLs\n- Done: (\d+) URLs`)
+
+// fixtureSite includes redirections, errors and slow responses.
+var fixtureSite = sitetest.Site{
+	"/": sitetest.Page{
+		Links:  []string{"/a", "/b", "/redirect", "/error", "/slow", "/missing"},
+		Images: []string{"/images/logo.png"},
+	},
+	"/a": sitetest.Page{
+		Links:  []string{"/", "/a/deep"},
+		Images: []string{"/images/a.png", "/images/shared.png"},
+	},
+	"/a/deep": sitetest.Page{
+		Images: []string{"/images/deep.png"},
+	},
+	"/b": sitetest.Page{
+		Images: []string{"/images/shared.png"},
+	},
+	"/redirect": sitetest.Page{
+		Redirect: "/target",
+	},
+	"/target": sitetest.Page{
+		Images: []string{"/images/target.png"},
+	},
+	"/error": sitetest.Page{
+		Status: http.StatusInternalServerError,
+	},
+	"/slow": sitetest.Page{
+		Delay:  100 * time.Millisecond,
+		Images: []string{"/images/slow.png"},
+	},
+}
+
+func TestCrawlFixtureSite(t *testing.T) {
+	site := sitetest.Start(fixtureSite)
+	defer site.Close()
+
+	contexts, shutdown := testContexts(t)
+	defer shutdown()
+
+	for name, cx := range contexts {
+		jobUUID := submitAndWait(t, cx, []string{site.PageURL("/")}, 7)
+
+		assert.Equal(t, site.ImageURLs("/", "/a", "/b", "/target", "/slow"), results(t, cx, jobUUID), name)
+	}
+
+	assert.Equal(t, len(contexts), site.Hits("/a"))
+	assert.Equal(t, 0, site.Hits("/a/deep"))
+	assert.Equal(t, 0, site.Hits("/images/logo.png"))
+}
+
+func TestCrawlTreeSite(t *testing.T) {
+	site := sitetest.Start(sitetest.Tree(3, 3, 2))
+	defer site.Close()
+
+	contexts, shutdown := testContexts(t)
+	defer shutdown()
+
+	for name, cx := range contexts {
+		jobUUID := submitAndWait(t, cx, []string{site.PageURL("/")}, 4)
+
+		assert.Equal(t, site.ImageURLs("/", "/0", "/1", "/2"), results(t, cx, jobUUID), name)
+	}
+
+	assert.Equal(t, 0, site.Hits("/0/0"))
+}
+
+func TestCrawlPagesOnce(t *testing.T) {
+	site := sitetest.Start(sitetest.Site{
+		"/":  sitetest.Page{Links: []string{"/a", "/b"}},
+		"/a": sitetest.Page{Images: []string{"/images/a.png"}},
+		"/b": sitetest.Page{Images: []string{"/images/b.png"}},
+	})
+	defer site.Close()
+
+	d, _ := db.NewMapConn()
+	cx := context.Context{Db: d, Queue: queue.NewPoolConn(d)}
+	cx.Queue.Subscribe(crawler.NewWorker(crawler.DefaultOptions).Process)
+
+	seeds := []string{site.PageURL("/"), site.PageURL("/a"), site.PageURL("/a"), site.PageURL("/b")}
+	submitAndWait(t, cx, seeds, 3)
+
+	assert.Equal(t, 1, site.Hits("/"))
+	assert.Equal(t, 1, site.Hits("/a"))
+	assert.Equal(t, 1, site.Hits("/b"))
+}
+
+// testContexts returns the contexts to run the end to end tests with,
+// one with the memory engines and one with the Riak and Gnatsd engines.
+// The function returned closes the queues and stops the in-process servers.
+func testContexts(t *testing.T) (map[string]context.Context, func()) {
+	d, _ := db.NewMapConn()
+	mem := context.Context{Db: d, Queue: queue.NewPoolConn(d)}
+	mem.Queue.Subscribe(crawler.NewWorker(crawler.DefaultOptions).Process)
+
+	h, shutdownRiak := riakHost(t)
+	n, shutdownNats := natsNodes(t)
+
+	r := context.ConnectRiakDb(h)
+	dist := context.Context{Db: r, Queue: context.ConnectNatsQueue(n, r)}
+	dist.Queue.Subscribe(crawler.NewWorker(crawler.DefaultOptions).Process)
+
+	contexts := map[string]context.Context{
+		"memory":      mem,
+		"distributed": dist,
+	}
+
+	return contexts, func() {
+		mem.Queue.Close()
+		dist.Queue.Close()
+		shutdownNats()
+		shutdownRiak()
+	}
+}
+
+// submitAndWait sends the urls to the api and waits until the job has processed the expected number of pages.
+func submitAndWait(t *testing.T, cx context.Context, urls []string, pages int) string {
+	s := httptest.NewServer(api.Handler(cx))
+	defer s.Close()
+
+	res, err := http.Post(s.URL+"/crawl", "text/plain", strings.NewReader(strings.Join(urls, " ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	jobUUID := string(b)
+
+	if !assert.Equal(t, http.StatusCreated, res.StatusCode) {
+		t.FailNow()
+	}
+	assert.Equal(t, fmt.Sprintf("/status/%s", jobUUID), res.Header.Get("Location"))
+
+	deadline := time.Now().Add(crawlTimeout)
+	for time.Now().Before(deadline) {
+		processing, done := status(t, s.URL+res.Header.Get("Location"))
+		if processing == 0 && done == pages {
+			return jobUUID
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s didn't finish after %v", jobUUID, crawlTimeout)
+	return ""
+}
+
+func status(t *testing.T, u string) (int, int) {
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	m := statusRegexp.FindStringSubmatch(string(b))
+	if m == nil {
+		return -1, -1
+	}
+
+	processing, _ := strconv.Atoi(m[1])
+	done, _ := strconv.Atoi(m[2])
+	return processing, done
+}
+
+func results(t *testing.T, cx context.Context, jobUUID string) []string {
+	s := httptest.NewServer(api.Handler(cx))
+	defer s.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/results/%s", s.URL, jobUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	return sortedLines(string(b))
+}
+
+func sortedLines(s string) []string {
+	l := strings.Fields(s)
+	sort.Strings(l)
+	return l
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/calavera/crawler/context"
 	"github.com/calavera/crawler/db"
 	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/queue/queuetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -27,16 +28,26 @@ func (s *GnatsdTestSuite) TestPubSub() {
 	}
 
 	s.conn.Subscribe(processor)
-	s.conn.Publish(jobUUID, "http://example.com", 0)
+	s.conn.Publish(queue.NewMessage(jobUUID, "http://example.com", 0))
 	<-w
 }
 
 func TestGnatsdSuite(t *testing.T) {
-	if h, ok := context.ParseNatsNodes(); ok {
-		d, _ := db.NewMapConn()
-		s := &GnatsdTestSuite{
-			conn: context.ConnectNatsQueue(h, d),
-		}
-		suite.Run(t, s)
+	h, shutdown := natsNodes(t)
+	defer shutdown()
+
+	d, _ := db.NewMapConn()
+	s := &GnatsdTestSuite{
+		conn: context.ConnectNatsQueue(h, d),
 	}
+	suite.Run(t, s)
+}
+
+func TestGnatsdConformance(t *testing.T) {
+	h, shutdown := natsNodes(t)
+	defer shutdown()
+
+	queuetest.Run(t, func(d db.Connection) (queue.Connection, error) {
+		return context.ConnectNatsQueue(h, d), nil
+	})
 }
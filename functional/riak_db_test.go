@@ -5,6 +5,7 @@ import (
 
 	"github.com/calavera/crawler/context"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/db/dbtest"
 	"github.com/calavera/crawler/queue"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -19,7 +20,7 @@ type RiakTestSuite struct {
 func (s *RiakTestSuite) SetupTest() {
 	s.jobUUID = queue.UUID()
 
-	err := s.conn.CreateJob(s.jobUUID)
+	err := s.conn.CreateJob(s.jobUUID, "")
 	assert.NoError(s.T(), err)
 }
 
@@ -73,10 +74,21 @@ func (s *RiakTestSuite) TestSave() {
 }
 
 func TestRiakSuite(t *testing.T) {
-	if h, ok := context.ParseRiakHost(); ok {
-		s := &RiakTestSuite{
-			conn: context.ConnectRiakDb(h),
-		}
-		suite.Run(t, s)
+	h, shutdown := riakHost(t)
+	defer shutdown()
+
+	s := &RiakTestSuite{
+		conn: context.ConnectRiakDb(h),
 	}
+	suite.Run(t, s)
+}
+
+func TestRiakConformance(t *testing.T) {
+	h, shutdown := riakHost(t)
+	defer shutdown()
+
+	c := context.ConnectRiakDb(h)
+	dbtest.Run(t, func() (db.Connection, error) {
+		return c, nil
+	})
 }
@@ -0,0 +1,39 @@
+package functional
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/context"
+	"github.com/calavera/crawler/db/riaktest"
+	"github.com/calavera/crawler/queue/natsfake"
+)
+
+// riakHost returns the Riak host configured in the environment.
+// It starts an in-process Riak server when there is no host configured.
+// The function returned stops the in-process server.
+func riakHost(t *testing.T) (string, func()) {
+	if h, ok := context.ParseRiakHost(); ok {
+		return h, func() {}
+	}
+
+	s, err := riaktest.Start()
+	if err != nil {
+		t.Fatalf("unable to start the Riak server: %v", err)
+	}
+	return s.Addr(), s.Shutdown
+}
+
+// natsNodes returns the Gnatsd nodes configured in the environment.
+// It starts a fake Gnatsd server when there are no nodes configured.
+// The function returned stops the in-process server.
+func natsNodes(t *testing.T) ([]string, func()) {
+	if n, ok := context.ParseNatsNodes(); ok {
+		return n, func() {}
+	}
+
+	s, err := natsfake.Start()
+	if err != nil {
+		t.Fatalf("unable to start the Gnatsd server: %v", err)
+	}
+	return []string{s.URL()}, s.Shutdown
+}
@@ -0,0 +1,77 @@
+// Package logging configures the structured logger shared by the crawler nodes.
+// Packages log with the default slog logger, adding the keys defined here,
+// so a job can be traced across nodes in a log aggregator.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Keys added to the log lines.
+const (
+	NodeKey     = "node"       // node that writes the line.
+	JobKey      = "jobUUID"    // job that the line belongs to.
+	MessageKey  = "messageID"  // queue message that the line belongs to.
+	URLKey      = "url"        // url in the queue message.
+	TraceKey    = "traceID"    // trace that the line belongs to.
+	TenantKey   = "tenant"     // tenant that owns the job.
+	ScheduleKey = "scheduleID" // schedule that created the job.
+	ErrorKey    = "err"
+)
+
+// Formats supported by New.
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// New creates a logger that writes lines in the given format, logfmt or json,
+// and discards lines below the given level, debug, info, warn or error.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case FormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, supported formats: %s, %s", format, FormatLogfmt, FormatJSON)
+}
+
+// Setup replaces the default logger with a logger that adds the node to every line.
+// Lines written with the standard log package use the new logger too.
+func Setup(w io.Writer, format, level, nodeID string) error {
+	l, err := New(w, format, level)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(l.With(NodeKey, nodeID))
+	return nil
+}
+
+// ParseLevel parses the name of a level, like info or debug.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// Job returns the default logger with the job added to every line.
+func Job(jobUUID string) *slog.Logger {
+	return slog.Default().With(JobKey, jobUUID)
+}
+
+// Err returns the attribute used to log errors.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
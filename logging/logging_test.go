@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewJSON(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, FormatJSON, "info")
+	assert.NoError(t, err)
+
+	l.Debug("discarded")
+	l.Error("saveError", JobKey, "job", Err(errors.New("boom")))
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "ERROR", line["level"])
+	assert.Equal(t, "saveError", line["msg"])
+	assert.Equal(t, "job", line[JobKey])
+	assert.Equal(t, "boom", line[ErrorKey])
+}
+
+func TestNewLogfmt(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, FormatLogfmt, "DEBUG")
+	assert.NoError(t, err)
+
+	l.Debug("urlAlreadySeen", URLKey, "http://example.com")
+	assert.Contains(t, b.String(), "level=DEBUG msg=urlAlreadySeen url=http://example.com\n")
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "xml", "info")
+	assert.Error(t, err)
+
+	_, err = New(&bytes.Buffer{}, FormatJSON, "verbose")
+	assert.Error(t, err)
+}
+
+func TestSetup(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	var b bytes.Buffer
+	assert.NoError(t, Setup(&b, FormatLogfmt, "info", "node01"))
+
+	Job("job").Info("jobCreated")
+	assert.True(t, strings.HasSuffix(b.String(), "msg=jobCreated node=node01 jobUUID=job\n"), b.String())
+
+	assert.Error(t, Setup(&b, FormatLogfmt, "loud", "node01"))
+}
@@ -0,0 +1,266 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/calavera/crawler/db"
+)
+
+var (
+	storageDuration = NewHistogram("crawler_storage_operation_duration_seconds",
+		"Time spent in storage operations.", DefaultBuckets, "engine", "operation")
+	storageErrors = NewCounter("crawler_storage_errors_total",
+		"Storage operations that failed.", "engine", "operation")
+)
+
+// instrumentedDb records the latency and the errors of the operations of a storage engine.
+// It implements every optional interface of the storages, the operations that
+// the engine doesn't implement return db.ErrUnsupported.
+type instrumentedDb struct {
+	conn   db.Connection
+	engine string
+}
+
+// InstrumentDb wraps a storage connection to record metrics labeled with the engine name.
+// Use the db.As functions to check the optional interfaces of the engine.
+func InstrumentDb(c db.Connection, engine string) db.Connection {
+	return &instrumentedDb{conn: c, engine: engine}
+}
+
+// Unwrap returns the connection with the engine.
+func (i *instrumentedDb) Unwrap() db.Connection {
+	return i.conn
+}
+
+func (i *instrumentedDb) CreateJob(jobUUID, tenant string) error {
+	defer i.observe("create_job", time.Now())
+	return i.check("create_job", i.conn.CreateJob(jobUUID, tenant))
+}
+
+func (i *instrumentedDb) Queued(jobUUID string) error {
+	defer i.observe("queued", time.Now())
+	return i.check("queued", i.conn.Queued(jobUUID))
+}
+
+func (i *instrumentedDb) Skipped(jobUUID string) error {
+	defer i.observe("skipped", time.Now())
+	return i.check("skipped", i.conn.Skipped(jobUUID))
+}
+
+func (i *instrumentedDb) Processing(jobUUID string) error {
+	defer i.observe("processing", time.Now())
+	return i.check("processing", i.conn.Processing(jobUUID))
+}
+
+func (i *instrumentedDb) Done(jobUUID string) error {
+	defer i.observe("done", time.Now())
+	return i.check("done", i.conn.Done(jobUUID))
+}
+
+func (i *instrumentedDb) Save(jobUUID, src string) error {
+	defer i.observe("save", time.Now())
+	return i.check("save", i.conn.Save(jobUUID, src))
+}
+
+func (i *instrumentedDb) SaveMany(jobUUID string, srcs []string) error {
+	defer i.observe("save_many", time.Now())
+	return i.check("save_many", i.conn.SaveMany(jobUUID, srcs))
+}
+
+func (i *instrumentedDb) Status(jobUUID string) (*db.Info, error) {
+	defer i.observe("status", time.Now())
+	info, err := i.conn.Status(jobUUID)
+	return info, i.check("status", err)
+}
+
+func (i *instrumentedDb) Results(jobUUID string) ([][]byte, error) {
+	defer i.observe("results", time.Now())
+	r, err := i.conn.Results(jobUUID)
+	return r, i.check("results", err)
+}
+
+func (i *instrumentedDb) SavePageHash(jobUUID, url, hash string) error {
+	defer i.observe("save_page_hash", time.Now())
+	st, ok := i.conn.(db.PageHashStore)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("save_page_hash", st.SavePageHash(jobUUID, url, hash))
+}
+
+func (i *instrumentedDb) PageHashes(jobUUID string) (map[string]string, error) {
+	defer i.observe("page_hashes", time.Now())
+	st, ok := i.conn.(db.PageHashStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	h, err := st.PageHashes(jobUUID)
+	return h, i.check("page_hashes", err)
+}
+
+func (i *instrumentedDb) CachePage(template, url string, p *db.CachedPage) error {
+	defer i.observe("cache_page", time.Now())
+	st, ok := i.conn.(db.PageCache)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("cache_page", st.CachePage(template, url, p))
+}
+
+func (i *instrumentedDb) CachedPage(template, url string) (*db.CachedPage, error) {
+	defer i.observe("cached_page", time.Now())
+	st, ok := i.conn.(db.PageCache)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	p, err := st.CachedPage(template, url)
+	return p, i.check("cached_page", err)
+}
+
+func (i *instrumentedDb) ViewPage(jobUUID, url string) (bool, error) {
+	defer i.observe("view_page", time.Now())
+	v, err := i.conn.ViewPage(jobUUID, url)
+	return v, i.check("view_page", err)
+}
+
+func (i *instrumentedDb) Cancel(jobUUID string) error {
+	defer i.observe("cancel", time.Now())
+	return i.check("cancel", i.conn.Cancel(jobUUID))
+}
+
+func (i *instrumentedDb) Ping() error {
+	defer i.observe("ping", time.Now())
+	return i.check("ping", i.conn.Ping())
+}
+
+func (i *instrumentedDb) ActiveJobs(tenant string) ([]string, error) {
+	defer i.observe("active_jobs", time.Now())
+	jobs, err := i.conn.ActiveJobs(tenant)
+	return jobs, i.check("active_jobs", err)
+}
+
+func (i *instrumentedDb) FinishJob(tenant, jobUUID string) error {
+	defer i.observe("finish_job", time.Now())
+	return i.check("finish_job", i.conn.FinishJob(tenant, jobUUID))
+}
+
+func (i *instrumentedDb) Usage(tenant, day string) (*db.Usage, error) {
+	defer i.observe("usage", time.Now())
+	st, ok := i.conn.(db.UsageStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	u, err := st.Usage(tenant, day)
+	return u, i.check("usage", err)
+}
+
+func (i *instrumentedDb) AddUsage(tenant, day string, pages, bytes int64) error {
+	defer i.observe("add_usage", time.Now())
+	st, ok := i.conn.(db.UsageStore)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("add_usage", st.AddUsage(tenant, day, pages, bytes))
+}
+
+func (i *instrumentedDb) CountPage(jobUUID string) (int64, error) {
+	defer i.observe("count_page", time.Now())
+	st, ok := i.conn.(db.UsageStore)
+	if !ok {
+		return 0, db.ErrUnsupported
+	}
+	n, err := st.CountPage(jobUUID)
+	return n, i.check("count_page", err)
+}
+
+func (i *instrumentedDb) SaveSchedule(sc *db.Schedule) error {
+	defer i.observe("save_schedule", time.Now())
+	st, ok := i.conn.(db.ScheduleStore)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("save_schedule", st.SaveSchedule(sc))
+}
+
+func (i *instrumentedDb) Schedule(id string) (*db.Schedule, error) {
+	defer i.observe("schedule", time.Now())
+	st, ok := i.conn.(db.ScheduleStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	sc, err := st.Schedule(id)
+	return sc, i.check("schedule", err)
+}
+
+func (i *instrumentedDb) Schedules() ([]*db.Schedule, error) {
+	defer i.observe("schedules", time.Now())
+	st, ok := i.conn.(db.ScheduleStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	s, err := st.Schedules()
+	return s, i.check("schedules", err)
+}
+
+func (i *instrumentedDb) DeleteSchedule(id string) error {
+	defer i.observe("delete_schedule", time.Now())
+	st, ok := i.conn.(db.ScheduleStore)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("delete_schedule", st.DeleteSchedule(id))
+}
+
+func (i *instrumentedDb) AddRun(id string, r db.Run) error {
+	defer i.observe("add_run", time.Now())
+	st, ok := i.conn.(db.RunStore)
+	if !ok {
+		return db.ErrUnsupported
+	}
+	return i.check("add_run", st.AddRun(id, r))
+}
+
+func (i *instrumentedDb) Runs(id string) ([]db.Run, error) {
+	defer i.observe("runs", time.Now())
+	st, ok := i.conn.(db.RunStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	r, err := st.Runs(id)
+	return r, i.check("runs", err)
+}
+
+func (i *instrumentedDb) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	defer i.observe("acquire_lease", time.Now())
+	st, ok := i.conn.(db.LeaseStore)
+	if !ok {
+		return false, db.ErrUnsupported
+	}
+	ok, err := st.AcquireLease(name, holder, ttl)
+	return ok, i.check("acquire_lease", err)
+}
+
+func (i *instrumentedDb) Close() error {
+	return i.conn.Close()
+}
+
+func (i *instrumentedDb) MergeFilter(jobUUID string, bits []byte) ([]byte, error) {
+	defer i.observe("merge_filter", time.Now())
+	fs, ok := i.conn.(db.FilterStore)
+	if !ok {
+		return nil, db.ErrUnsupported
+	}
+	b, err := fs.MergeFilter(jobUUID, bits)
+	return b, i.check("merge_filter", err)
+}
+
+func (i *instrumentedDb) observe(op string, start time.Time) {
+	storageDuration.Observe(time.Since(start).Seconds(), i.engine, op)
+}
+
+func (i *instrumentedDb) check(op string, err error) error {
+	if err != nil {
+		storageErrors.Inc(i.engine, op)
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+
+	textContentType = "text/plain; version=0.0.4"
+)
+
+// DefaultBuckets are the histogram buckets used for latencies, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry where the metrics of the crawler are registered.
+var Default = NewRegistry()
+
+// Registry holds a set of metrics and writes them in the Prometheus text format.
+type Registry struct {
+	*sync.Mutex
+	families    []*family
+	constLabels []labelPair
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{Mutex: new(sync.Mutex)}
+}
+
+// SetConstLabel adds a label with the same value to every metric in the registry,
+// like the node that exposes the metrics.
+func (r *Registry) SetConstLabel(name, value string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for i, l := range r.constLabels {
+		if l.name == name {
+			r.constLabels[i].value = value
+			return
+		}
+	}
+	r.constLabels = append(r.constLabels, labelPair{name, value})
+}
+
+// NewCounter registers a counter that can only go up.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, counterType, labels, nil)}
+}
+
+// NewGauge registers a gauge that can go up and down.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, gaugeType, labels, nil)}
+}
+
+// NewHistogram registers a histogram with the given upper bounds for its buckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{r.register(name, help, histogramType, labels, b)}
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	families := append([]*family(nil), r.families...)
+	constLabels := append([]labelPair(nil), r.constLabels...)
+	r.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw, constLabels)
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the registry.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", textContentType)
+	r.WriteTo(w)
+}
+
+// NewCounter registers a counter in the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge in the default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram in the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Handler serves the metrics in the default registry.
+func Handler() http.Handler {
+	return Default
+}
+
+// Counter is a metric that can only go up.
+type Counter struct {
+	*family
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds a positive value to the counter with the given label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	c.update(labels, func(s *series) { s.value += v })
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	*family
+}
+
+// Set sets the value of the gauge with the given label values.
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.update(labels, func(s *series) { s.value = v })
+}
+
+// Add adds a value, that can be negative, to the gauge with the given label values.
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.update(labels, func(s *series) { s.value += v })
+}
+
+// Inc adds one to the gauge with the given label values.
+func (g *Gauge) Inc(labels ...string) {
+	g.Add(1, labels...)
+}
+
+// Dec subtracts one from the gauge with the given label values.
+func (g *Gauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	*family
+}
+
+// Observe adds an observation to the histogram with the given label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.update(labels, func(s *series) {
+		for i, b := range h.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.value += v
+		s.count++
+	})
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// family is a metric with all its series, one per combination of label values.
+type family struct {
+	*sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64  // value of counters and gauges, sum of histograms.
+	count  uint64   // observations of histograms.
+	counts []uint64 // cumulative observations per bucket of histograms.
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, buckets []float64) *family {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: metric registered twice " + name)
+		}
+	}
+
+	f := &family{
+		Mutex:   new(sync.Mutex),
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// update applies a change to the series with the given label values.
+// Missing label values are empty, extra values are ignored.
+func (f *family) update(values []string, fn func(*series)) {
+	lv := make([]string, len(f.labels))
+	copy(lv, values)
+	key := strings.Join(lv, "\xff")
+
+	f.Lock()
+	defer f.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: lv, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+func (f *family) write(w *countWriter, constLabels []labelPair) {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		labels := append([]labelPair(nil), constLabels...)
+		for i, n := range f.labels {
+			labels = append(labels, labelPair{n, s.labels[i]})
+		}
+
+		if f.typ != histogramType {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(labels), formatValue(s.value))
+			continue
+		}
+
+		for i, b := range f.buckets {
+			bl := append(labels, labelPair{"le", formatValue(b)})
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(bl), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(append(labels, labelPair{"le", "+Inf"})), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(labels), s.count)
+	}
+}
+
+func formatLabels(labels []labelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", l.name, escapeLabel(l.value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// countWriter keeps the bytes written and the first error found.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("pages_total", "Pages fetched.", "status")
+	g := r.NewGauge("in_flight", "Crawls in flight.")
+
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc("404")
+	c.Add(-1, "404")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	assert.Equal(t, `# HELP pages_total Pages fetched.
+# TYPE pages_total counter
+pages_total{status="200"} 3
+pages_total{status="404"} 1
+# HELP in_flight Crawls in flight.
+# TYPE in_flight gauge
+in_flight 1
+`, write(r))
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.5}, "op")
+
+	h.Observe(0.2, "get")
+	h.Observe(0.7, "get")
+	h.Observe(3, "get")
+
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.5"} 1
+latency_seconds_bucket{op="get",le="1"} 2
+latency_seconds_bucket{op="get",le="+Inf"} 3
+latency_seconds_sum{op="get"} 3.9
+latency_seconds_count{op="get"} 3
+`, write(r))
+}
+
+func TestConstLabelsAndEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.SetConstLabel("node", "a")
+	r.SetConstLabel("node", "b")
+	c := r.NewCounter("saved_total", "Images\nsaved.", "job_uuid")
+
+	c.Inc("x\"y\\z")
+	c.Inc()
+
+	assert.Equal(t, `# HELP saved_total Images\nsaved.
+# TYPE saved_total counter
+saved_total{node="b",job_uuid=""} 1
+saved_total{node="b",job_uuid="x\"y\\z"} 1
+`, write(r))
+}
+
+func TestEmptyMetricsAreNotWritten(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("unused_total", "Unused.")
+	assert.Equal(t, "", write(r))
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup_total", "Dup.")
+	assert.Panics(t, func() { r.NewGauge("dup_total", "Dup.") })
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("served_total", "Served.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, textContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "served_total 1\n")
+}
+
+func write(r *Registry) string {
+	var b bytes.Buffer
+	r.WriteTo(&b)
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+)
+
+var (
+	queuePublished = NewCounter("crawler_queue_published_total",
+		"Messages published in the queue.", "engine")
+	queueConsumed = NewCounter("crawler_queue_consumed_total",
+		"Messages received from the queue.", "engine")
+	queueErrors = NewCounter("crawler_queue_errors_total",
+		"Messages that could not be published.", "engine")
+)
+
+// instrumentedQueue counts the messages published and received by a queue engine.
+type instrumentedQueue struct {
+	conn   queue.Connection
+	engine string
+}
+
+// InstrumentQueue wraps a queue connection to record metrics labeled with the engine name.
+// Processors receive the wrapped connection, so the messages that they publish are counted too.
+func InstrumentQueue(q queue.Connection, engine string) queue.Connection {
+	return &instrumentedQueue{conn: q, engine: engine}
+}
+
+func (i *instrumentedQueue) Publish(msg *queue.Message) error {
+	err := i.conn.Publish(msg)
+	if err != nil {
+		queueErrors.Inc(i.engine)
+		return err
+	}
+	queuePublished.Inc(i.engine)
+	return nil
+}
+
+func (i *instrumentedQueue) Subscribe(p queue.Processor) {
+	i.conn.Subscribe(func(_ queue.Connection, d db.Connection, m *queue.Message) {
+		queueConsumed.Inc(i.engine)
+		p(i, d, m)
+	})
+}
+
+func (i *instrumentedQueue) Unsubscribe() error {
+	return i.conn.Unsubscribe()
+}
+
+func (i *instrumentedQueue) Ping() error {
+	return i.conn.Ping()
+}
+
+func (i *instrumentedQueue) Close() error {
+	return i.conn.Close()
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/db/dbtest"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/queue/queuetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedDbConformance(t *testing.T) {
+	dbtest.Run(t, func() (db.Connection, error) {
+		d, err := db.NewMapConn()
+		return InstrumentDb(d, "mem"), err
+	})
+}
+
+func TestInstrumentedCoreDbConformance(t *testing.T) {
+	dbtest.Run(t, func() (db.Connection, error) {
+		d, err := db.NewMapConn()
+		return InstrumentDb(coreDb{d}, "core"), err
+	})
+}
+
+func TestInstrumentedQueueConformance(t *testing.T) {
+	pools := map[db.Connection]*queue.PoolConn{}
+	queuetest.Run(t, func(d db.Connection) (queue.Connection, error) {
+		if p, ok := pools[d]; ok {
+			return InstrumentQueue(p.Connect(), "test"), nil
+		}
+
+		p := queue.NewPoolConn(d).(*queue.PoolConn)
+		pools[d] = p
+		return InstrumentQueue(p, "test"), nil
+	})
+}
+
+func TestInstrumentedDbMetrics(t *testing.T) {
+	d, _ := db.NewMapConn()
+	engine := queue.UUID()
+	c := InstrumentDb(d, engine)
+
+	c.Status("missing")
+	c.CreateJob("job", "")
+	c.Status("job")
+
+	out := write(Default)
+	assert.Contains(t, out, `crawler_storage_errors_total{engine="`+engine+`",operation="status"} 1`)
+	assert.Contains(t, out, `crawler_storage_operation_duration_seconds_count{engine="`+engine+`",operation="status"} 2`)
+	assert.Contains(t, out, `crawler_storage_operation_duration_seconds_count{engine="`+engine+`",operation="create_job"} 1`)
+}
+
+func TestInstrumentedDbKeepsOptionalStores(t *testing.T) {
+	d, _ := db.NewMapConn()
+	_, isStore := db.AsFilterStore(d)
+	_, ok := db.AsFilterStore(InstrumentDb(d, "mem"))
+	assert.Equal(t, isStore, ok)
+
+	_, ok = db.AsScheduleStore(InstrumentDb(d, "mem"))
+	assert.True(t, ok)
+
+	c := InstrumentDb(coreDb{d}, "core")
+	_, ok = db.AsScheduleStore(c)
+	assert.False(t, ok)
+	_, ok = db.AsFilterStore(c)
+	assert.False(t, ok)
+	_, err := c.(db.UsageStore).CountPage("job")
+	assert.Equal(t, db.ErrUnsupported, err)
+}
+
+// coreDb hides the optional interfaces of a storage.
+type coreDb struct {
+	db.Connection
+}
+
+func TestInstrumentedQueueMetrics(t *testing.T) {
+	d, _ := db.NewMapConn()
+	engine := queue.UUID()
+	q := InstrumentQueue(queue.NewPoolConn(d), engine)
+	defer q.Close()
+
+	received := make(chan queue.Connection, 1)
+	q.Subscribe(func(c queue.Connection, _ db.Connection, _ *queue.Message) {
+		received <- c
+	})
+
+	assert.NoError(t, q.Publish(queue.NewMessage("job", "http://example.com", 0)))
+	assert.Equal(t, q, <-received)
+
+	out := write(Default)
+	assert.Contains(t, out, `crawler_queue_published_total{engine="`+engine+`"} 1`)
+	assert.Contains(t, out, `crawler_queue_consumed_total{engine="`+engine+`"} 1`)
+}
@@ -0,0 +1,23 @@
+package queue_test
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/queue/queuetest"
+)
+
+func TestPoolConnConformance(t *testing.T) {
+	// Every test uses a new storage, the connections created for the same test share their channel.
+	pools := map[db.Connection]*queue.PoolConn{}
+	queuetest.Run(t, func(d db.Connection) (queue.Connection, error) {
+		if p, ok := pools[d]; ok {
+			return p.Connect(), nil
+		}
+
+		p := queue.NewPoolConn(d).(*queue.PoolConn)
+		pools[d] = p
+		return p, nil
+	})
+}
@@ -1,14 +1,57 @@
 package queue
 
-import "github.com/calavera/crawler/db"
+import (
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/tracing"
+)
 
 // Processor defines a function interface to process messages.
 type Processor func(Connection, db.Connection, *Message)
 
 // Connection is an interface that defines how messages are published are received from a queue.
 type Connection interface {
-	// Publish pushes new messages to the queue.
-	Publish(string, string, uint) error
+	// Publish pushes a new message to the queue.
+	Publish(*Message) error
 	// Subscribe pulls messages from the queue and processes them using the processor function.
 	Subscribe(Processor)
+	// Unsubscribe stops receiving messages, without releasing the connection.
+	// Nodes that unsubscribe can still publish messages for other nodes to process.
+	Unsubscribe() error
+	// Ping checks that the queue is reachable,
+	// and that the connection still receives messages if it subscribed to the queue.
+	// It returns an error after unsubscribing or closing the connection.
+	Ping() error
+	// Close stops receiving messages and releases the connection.
+	// Publishing messages after closing the connection returns an error.
+	Close() error
+}
+
+// PublishTraced publishes the message inside a span, child of the parent context.
+// The message carries the context of that span,
+// so the node that processes the message continues the trace.
+func PublishTraced(q Connection, parent tracing.SpanContext, msg *Message) error {
+	s := tracing.Start(parent, "queue.publish", tracing.KindProducer)
+	defer s.End()
+
+	s.SetAttributes("message.id", msg.ID, logging.URLKey, msg.URL)
+	msg.Traceparent = s.Context().Traceparent()
+
+	err := q.Publish(msg)
+	s.SetError(err)
+	return err
+}
+
+// Enqueue counts the message as queued for its job in the storage and publishes it with PublishTraced.
+// Jobs with queued messages are not finished, so the message stops counting when the queue doesn't take it.
+func Enqueue(q Connection, d db.Connection, parent tracing.SpanContext, msg *Message) error {
+	if err := d.Queued(msg.JobUUID); err != nil {
+		return err
+	}
+
+	if err := PublishTraced(q, parent, msg); err != nil {
+		d.Skipped(msg.JobUUID)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apcera/nats"
+	"github.com/calavera/crawler/db"
+)
+
+// Driver opens connections to a queue engine.
+// Drivers are registered under the scheme of the urls that they open, like nats://.
+type Driver interface {
+	// Open connects to the queue engine described by the url.
+	// Messages received are processed with the storage connection.
+	Open(string, db.Connection) (Connection, error)
+}
+
+// DriverFunc is an adapter to use functions as drivers.
+type DriverFunc func(string, db.Connection) (Connection, error)
+
+// Open calls the function.
+func (f DriverFunc) Open(dsn string, d db.Connection) (Connection, error) {
+	return f(dsn, d)
+}
+
+var (
+	driversMu = new(sync.RWMutex)
+	drivers   = make(map[string]Driver)
+)
+
+func init() {
+	Register("mem", DriverFunc(openPool))
+	Register("nats", DriverFunc(openNats))
+}
+
+// Register makes a queue engine available under a url scheme.
+// Engines usually call it from the init function of their package.
+// It panics if the driver is nil or the scheme is already registered.
+func Register(scheme string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if d == nil {
+		panic("queue: Register driver is nil")
+	}
+	if _, dup := drivers[scheme]; dup {
+		panic("queue: Register called twice for driver " + scheme)
+	}
+	drivers[scheme] = d
+}
+
+// Drivers returns the sorted list of registered schemes.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	var schemes []string
+	for s := range drivers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open connects to the queue engine registered under the scheme of the url.
+func Open(dsn string, d db.Connection) (Connection, error) {
+	scheme, err := db.Scheme(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driversMu.RLock()
+	dr, ok := drivers[scheme]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("queue: unknown driver %q (forgotten import?)", scheme)
+	}
+	return dr.Open(dsn, d)
+}
+
+// NatsURL returns the url to connect with a list of Gnatsd servers,
+// like nats://127.0.0.1:4222,127.0.0.1:4223.
+func NatsURL(servers []string) string {
+	hosts := make([]string, len(servers))
+	for i, s := range servers {
+		hosts[i] = strings.TrimPrefix(s, "nats://")
+	}
+	return "nats://" + strings.Join(hosts, ",")
+}
+
+// openPool opens a channel queue, only suitable for single node deployments.
+func openPool(dsn string, d db.Connection) (Connection, error) {
+	return NewPoolConn(d), nil
+}
+
+// openNats connects to a cluster of Gnatsd servers.
+// The url includes the servers separated by comma,
+// and the connection settings as query parameters timeout, reconnectWait and maxReconnect,
+// for instance nats://127.0.0.1:4222,127.0.0.1:4223?timeout=5s.
+func openNats(dsn string, d db.Connection) (Connection, error) {
+	hosts, query := strings.TrimPrefix(dsn, "nats://"), ""
+	if i := strings.Index(hosts, "?"); i >= 0 {
+		hosts, query = hosts[:i], hosts[i+1:]
+	}
+
+	opts := nats.DefaultOptions
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			opts.Servers = append(opts.Servers, "nats://"+h)
+		}
+	}
+	if len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("queue: missing Gnatsd servers in url %q", dsn)
+	}
+
+	if err := natsOptions(&opts, query); err != nil {
+		return nil, err
+	}
+
+	nc, err := opts.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the Gnatsd servers: %v", err)
+	}
+
+	ec, err := nats.NewEncodedConn(nc, "json")
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("Unable to encode the connection for json messages: %v", err)
+	}
+
+	return NewNatsConn(d, ec), nil
+}
+
+func natsOptions(opts *nats.Options, query string) error {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"timeout", &opts.Timeout},
+		{"reconnectWait", &opts.ReconnectWait},
+	} {
+		if v := q.Get(o.key); v != "" {
+			if *o.dst, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("queue: invalid %s %q", o.key, v)
+			}
+		}
+	}
+
+	if v := q.Get("maxReconnect"); v != "" {
+		if opts.MaxReconnect, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("queue: invalid maxReconnect %q", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/calavera/crawler/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsURL(t *testing.T) {
+	assert.Equal(t, "nats://127.0.0.1:4222", NatsURL([]string{"nats://127.0.0.1:4222"}))
+	assert.Equal(t, "nats://a:4222,b:4222", NatsURL([]string{"nats://a:4222", "b:4222"}))
+}
+
+func TestOpenMemory(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	q, err := Open("mem://", d)
+	assert.NoError(t, err)
+	assert.IsType(t, &PoolConn{}, q)
+	q.Close()
+}
+
+func TestOpenErrors(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	for _, dsn := range []string{"", "127.0.0.1:4222", "amqp://127.0.0.1", "nats://", "nats://127.0.0.1:4222?timeout=soon", "nats://127.0.0.1:4222?maxReconnect=many"} {
+		_, err := Open(dsn, d)
+		assert.Error(t, err, dsn)
+	}
+}
+
+// openedTestDSN records the last url opened by the test driver.
+var openedTestDSN string
+
+func init() {
+	Register("test-queue", DriverFunc(func(dsn string, d db.Connection) (Connection, error) {
+		openedTestDSN = dsn
+		return NewPoolConn(d), nil
+	}))
+}
+
+func TestRegisterDriver(t *testing.T) {
+	d, _ := db.NewMapConn()
+
+	assert.Contains(t, Drivers(), "test-queue")
+	assert.Contains(t, Drivers(), "mem")
+	assert.Contains(t, Drivers(), "nats")
+
+	q, err := Open("test-queue://host", d)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-queue://host", openedTestDSN)
+	q.Close()
+
+	assert.Panics(t, func() {
+		Register("test-queue", DriverFunc(func(string, db.Connection) (Connection, error) { return nil, nil }))
+	})
+}
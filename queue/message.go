@@ -1,17 +1,54 @@
 package queue
 
+import (
+	"log/slog"
+	"time"
+
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/tracing"
+)
+
 // Message is the structure that the crawler sends and receives in the queue.
 type Message struct {
-	Depth   uint   // depth level where the url was found
-	JobUUID string // unique identifiler for the job that trigerred this message
-	URL     string // url to crawl
+	ID          string    // unique identifier for the message, used to correlate log lines
+	Depth       uint      // depth level where the url was found
+	JobUUID     string    // unique identifiler for the job that trigerred this message
+	URL         string    // url to crawl
+	Traceparent string    // context of the span that published the message, in the W3C traceparent format
+	Tenant      string    // tenant that owns the job, empty when clients are not authenticated
+	Priority    Priority  // scheduling priority of the job
+	Template    string    // schedule that created the job, its crawls reuse the pages cached by previous runs
+	Sitemaps    bool      // crawl the pages listed in the sitemaps of the site of the url too
+	LastMod     time.Time // when the page changed according to a sitemap, zero when unknown
+	Claimed     bool      // the job viewed the url already, in a crawl abandoned by a node that stopped
 }
 
 // NewMessage creates new messages to crawl an url.
 func NewMessage(jobUUID, url string, d uint) *Message {
 	return &Message{
+		ID:      UUID(),
 		Depth:   d,
 		JobUUID: jobUUID,
 		URL:     url,
 	}
 }
+
+// Logger returns the default logger with the job, the id and the url of the message
+// added to every line, and the tenant and the trace when the message has them.
+func (m *Message) Logger() *slog.Logger {
+	l := slog.Default().With(logging.JobKey, m.JobUUID, logging.MessageKey, m.ID, logging.URLKey, m.URL)
+	if m.Tenant != "" {
+		l = l.With(logging.TenantKey, m.Tenant)
+	}
+	if sc := m.SpanContext(); sc.IsValid() {
+		l = l.With(logging.TraceKey, sc.TraceID.String())
+	}
+	return l
+}
+
+// SpanContext returns the context of the span that published the message.
+// It's not valid when the message was published outside of a trace.
+func (m *Message) SpanContext() tracing.SpanContext {
+	sc, _ := tracing.ParseTraceparent(m.Traceparent)
+	return sc
+}
@@ -12,4 +12,22 @@ func TestNewMessage(t *testing.T) {
 	assert.Equal(t, "test", m.JobUUID)
 	assert.Equal(t, "http://example.com", m.URL)
 	assert.Equal(t, 0, m.Depth)
+	assert.NotEmpty(t, m.ID)
+	assert.NotEqual(t, m.ID, NewMessage("test", "http://example.com", 0).ID)
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range Priorities {
+		parsed, err := ParsePriority(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+
+	p, err := ParsePriority("")
+	assert.NoError(t, err)
+	assert.Equal(t, PriorityNormal, p)
+	assert.Equal(t, PriorityNormal, NewMessage("test", "http://example.com", 0).Priority)
+
+	_, err = ParsePriority("urgent")
+	assert.Error(t, err)
 }
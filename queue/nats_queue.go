@@ -1,43 +1,146 @@
 package queue
 
 import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
 	"github.com/apcera/nats"
 	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
 )
 
 const (
 	crawlerTopic = "crawl-url"
 	queueName    = "crawler-queue"
+	pingTimeout  = 2 * time.Second
 )
 
+// errInvalidSubscription is returned by Ping when Gnatsd dropped a subscription,
+// for instance because the node was too slow processing messages.
+var errInvalidSubscription = errors.New("queue subscription is no longer valid")
+
+// errNoSubscriptions is returned by Ping when the connection tried to subscribe and it failed,
+// so the node doesn't process messages.
+var errNoSubscriptions = errors.New("queue subscription failed")
+
 // NatsConn implements the queue.Connection interface using Gnatsd as a queue.
+// Processors run in the goroutine of the subscription, one message at a time,
+// so the subscription stops pulling messages while a processor blocks,
+// and the client drops the messages that don't fit in its buffer.
+// Processors that take long must start their own goroutines.
 type NatsConn struct {
-	db   db.Connection
-	conn *nats.EncodedConn
-	proc Processor
+	*sync.Mutex
+	db           db.Connection
+	conn         *nats.EncodedConn
+	proc         Processor
+	subs         []*nats.Subscription
+	subscribed   bool // Subscribe was called, nodes that only publish never call it.
+	unsubscribed bool
 }
 
 // NewNatsConn initializes the connection to Gnatsd.
 // It assumes that the client has been initialized by the application context.
 func NewNatsConn(d db.Connection, conn *nats.EncodedConn) Connection {
 	return &NatsConn{
-		db:   d,
-		conn: conn,
+		Mutex: new(sync.Mutex),
+		db:    d,
+		conn:  conn,
 	}
 }
 
 // Publish enqueues new messages in the queue for a given job.
-func (q *NatsConn) Publish(jobUUID, url string, depth uint) error {
-	msg := NewMessage(jobUUID, url, depth)
-	return q.conn.Publish(crawlerTopic, msg)
+func (q *NatsConn) Publish(msg *Message) error {
+	if err := q.conn.Publish(crawlerTopic, msg); err != nil {
+		return err
+	}
+	msg.Logger().Debug("messagePublished", "topic", crawlerTopic)
+	return nil
 }
 
 // Subscribe subscribes the job group to a specific topic to process messages.
+// It waits until Gnatsd registers the subscription, so messages published
+// by other nodes after it returns are delivered.
 func (q *NatsConn) Subscribe(processor Processor) {
+	q.Lock()
 	q.proc = processor
-	q.conn.QueueSubscribe(crawlerTopic, queueName, q.processMessage)
+	q.subscribed = true
+	q.Unlock()
+
+	sub, err := q.conn.QueueSubscribe(crawlerTopic, queueName, q.processMessage)
+	if err == nil {
+		if err = q.conn.Flush(); err != nil {
+			sub.Unsubscribe()
+		}
+	}
+	if err != nil {
+		slog.Error("subscribeError", "topic", crawlerTopic, logging.Err(err))
+		return
+	}
+
+	q.Lock()
+	q.subs = append(q.subs, sub)
+	q.Unlock()
+}
+
+// Unsubscribe removes the subscriptions of this connection from the job group,
+// so Gnatsd delivers new messages to other nodes.
+func (q *NatsConn) Unsubscribe() error {
+	q.Lock()
+	defer q.Unlock()
+
+	q.unsubscribed = true
+	for _, s := range q.subs {
+		if err := s.Unsubscribe(); err != nil {
+			return err
+		}
+	}
+	q.subs = nil
+	return q.conn.Flush()
 }
 
+// Ping checks that the subscriptions are valid and that Gnatsd answers in time.
+// Connections that subscribed fail when they don't have any subscription left,
+// connections that only publish messages don't need them.
+func (q *NatsConn) Ping() error {
+	if q.conn.Conn.IsClosed() {
+		return ErrClosed
+	}
+
+	q.Lock()
+	subscribed, unsubscribed := q.subscribed, q.unsubscribed
+	subs := append([]*nats.Subscription(nil), q.subs...)
+	q.Unlock()
+
+	if unsubscribed {
+		return ErrUnsubscribed
+	}
+	if subscribed && len(subs) == 0 {
+		return errNoSubscriptions
+	}
+	for _, s := range subs {
+		if !s.IsValid() {
+			return errInvalidSubscription
+		}
+	}
+	return q.conn.FlushTimeout(pingTimeout)
+}
+
+// processMessage runs the processor in the goroutine of the subscription,
+// so messages are not pulled while it blocks.
 func (q *NatsConn) processMessage(m *Message) {
-	go q.proc(q, q.db, m)
+	m.Logger().Debug("messageDelivered", "topic", crawlerTopic)
+
+	q.Lock()
+	proc := q.proc
+	q.Unlock()
+
+	proc(q, q.db, m)
+}
+
+// Close closes the connection with Gnatsd.
+func (q *NatsConn) Close() error {
+	q.conn.Close()
+	return nil
 }
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue/natsfake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsPingSubscriptions(t *testing.T) {
+	s, err := natsfake.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	d, _ := db.NewMapConn()
+	c, err := Open(s.URL(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Nodes that only publish messages don't subscribe.
+	q := c.(*NatsConn)
+	assert.NoError(t, q.Ping())
+
+	q.Subscribe(func(Connection, db.Connection, *Message) {})
+	assert.NoError(t, q.Ping())
+
+	// Nodes whose subscriptions failed don't process messages.
+	q.Lock()
+	q.subs = nil
+	q.Unlock()
+	assert.Equal(t, errNoSubscriptions, q.Ping())
+}
+
+func TestNatsBlockingProcessor(t *testing.T) {
+	s, err := natsfake.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	d, _ := db.NewMapConn()
+	c, err := Open(s.URL(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	q := c.(*NatsConn)
+	release := make(chan struct{})
+	processed := make(chan *Message, 2)
+	q.Subscribe(func(_ Connection, _ db.Connection, m *Message) {
+		processed <- m
+		<-release
+	})
+
+	jobUUID := UUID()
+	assert.NoError(t, q.Publish(NewMessage(jobUUID, "http://example.com/0", 0)))
+	assert.NoError(t, q.Publish(NewMessage(jobUUID, "http://example.com/1", 0)))
+
+	<-processed
+	select {
+	case m := <-processed:
+		t.Fatalf("message processed over the limit: %v", m.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not processed after the first one finished")
+	}
+}
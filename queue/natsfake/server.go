@@ -0,0 +1,314 @@
+package natsfake
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	infoProto = "INFO {\"server_id\":\"natsfake\",\"version\":\"0.5.6\",\"auth_required\":false,\"ssl_required\":false,\"max_payload\":1048576}\r\n"
+	okProto   = "+OK\r\n"
+	pongProto = "PONG\r\n"
+	errProto  = "-ERR '%s'\r\n"
+	msgProto  = "MSG %s %s %s%d\r\n"
+)
+
+// Server is a fake Gnatsd server that speaks the subset of the Nats protocol
+// that the crawler uses: publish, subscribe, unsubscribe and queue groups.
+// It's designed to run hermetic tests, it's not the real Gnatsd server
+// and it doesn't support clustering nor authentication.
+type Server struct {
+	*sync.Mutex
+	listener net.Listener
+	clients  map[*client]bool
+	subs     []*subscription
+	next     int // round robin index for queue groups
+	wg       *sync.WaitGroup
+}
+
+type client struct {
+	*sync.Mutex
+	conn    net.Conn
+	w       *bufio.Writer
+	verbose bool
+}
+
+type subscription struct {
+	client  *client
+	subject string
+	queue   string
+	sid     string
+}
+
+// Start starts a new server listening in a random port in the loopback interface.
+func Start() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Mutex:    new(sync.Mutex),
+		listener: l,
+		clients:  map[*client]bool{},
+		wg:       new(sync.WaitGroup),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// URL returns the url that clients must use to connect to the server.
+func (s *Server) URL() string {
+	return fmt.Sprintf("nats://%s", s.listener.Addr())
+}
+
+// Shutdown stops the server and disconnects all the clients.
+func (s *Server) Shutdown() {
+	s.listener.Close()
+
+	s.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &client{
+			Mutex: new(sync.Mutex),
+			conn:  conn,
+			w:     bufio.NewWriter(conn),
+		}
+
+		s.Lock()
+		s.clients[c] = true
+		s.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.wg.Done()
+	defer s.disconnect(c)
+
+	c.send(infoProto)
+
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "CONNECT":
+			c.verbose = strings.Contains(line, `"verbose":true`)
+			c.ok()
+		case "PING":
+			c.send(pongProto)
+		case "PONG":
+		case "SUB":
+			err = s.subscribe(c, args[1:])
+		case "UNSUB":
+			err = s.unsubscribe(c, args[1:])
+		case "PUB":
+			err = s.publish(c, r, args[1:])
+		default:
+			err = fmt.Errorf("Unknown Protocol Operation")
+		}
+
+		if err != nil {
+			c.send(fmt.Sprintf(errProto, err))
+			if err == io.EOF {
+				return
+			}
+		}
+	}
+}
+
+// subscribe handles `SUB <subject> [queue group] <sid>`.
+func (s *Server) subscribe(c *client, args []string) error {
+	sub := &subscription{client: c}
+	switch len(args) {
+	case 2:
+		sub.subject, sub.sid = args[0], args[1]
+	case 3:
+		sub.subject, sub.queue, sub.sid = args[0], args[1], args[2]
+	default:
+		return fmt.Errorf("Invalid Subject")
+	}
+
+	s.Lock()
+	s.subs = append(s.subs, sub)
+	s.Unlock()
+
+	c.ok()
+	return nil
+}
+
+// unsubscribe handles `UNSUB <sid> [max msgs]`.
+// The maximum number of messages is ignored and the subscription is removed right away.
+func (s *Server) unsubscribe(c *client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Invalid Subscription")
+	}
+
+	s.Lock()
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if sub.client != c || sub.sid != args[0] {
+			subs = append(subs, sub)
+		}
+	}
+	s.subs = subs
+	s.Unlock()
+
+	c.ok()
+	return nil
+}
+
+// publish handles `PUB <subject> [reply to] <#bytes>\r\n<payload>\r\n`.
+func (s *Server) publish(c *client, r *bufio.Reader, args []string) error {
+	var subject, reply, size string
+	switch len(args) {
+	case 2:
+		subject, size = args[0], args[1]
+	case 3:
+		subject, reply, size = args[0], args[1], args[2]
+	default:
+		return fmt.Errorf("Invalid Subject")
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return fmt.Errorf("Invalid Message Size")
+	}
+
+	payload := make([]byte, n+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return io.EOF
+	}
+	payload = payload[:n]
+
+	for _, sub := range s.match(subject) {
+		sub.client.deliver(sub, subject, reply, payload)
+	}
+
+	c.ok()
+	return nil
+}
+
+// match selects the subscriptions that receive a message.
+// Subscriptions without queue group receive every message,
+// only one subscription receives the message in each queue group.
+func (s *Server) match(subject string) []*subscription {
+	s.Lock()
+	defer s.Unlock()
+
+	var subs []*subscription
+	groups := map[string][]*subscription{}
+
+	for _, sub := range s.subs {
+		if !matchSubject(sub.subject, subject) {
+			continue
+		}
+		if sub.queue == "" {
+			subs = append(subs, sub)
+		} else {
+			groups[sub.queue] = append(groups[sub.queue], sub)
+		}
+	}
+
+	for _, g := range groups {
+		s.next++
+		subs = append(subs, g[s.next%len(g)])
+	}
+
+	return subs
+}
+
+func (s *Server) disconnect(c *client) {
+	c.conn.Close()
+
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.clients, c)
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if sub.client != c {
+			subs = append(subs, sub)
+		}
+	}
+	s.subs = subs
+}
+
+func (c *client) deliver(sub *subscription, subject, reply string, payload []byte) {
+	if reply != "" {
+		reply += " "
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(c.w, msgProto, subject, sub.sid, reply, len(payload))
+	c.w.Write(payload)
+	c.w.WriteString("\r\n")
+	c.w.Flush()
+}
+
+func (c *client) ok() {
+	if c.verbose {
+		c.send(okProto)
+	}
+}
+
+func (c *client) send(proto string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.w.WriteString(proto)
+	c.w.Flush()
+}
+
+// matchSubject checks whether a subject matches a subscription,
+// supporting `*` and `>` wildcards.
+func matchSubject(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	t := strings.Split(subject, ".")
+
+	for i, tok := range p {
+		if tok == ">" {
+			return len(t) > i
+		}
+		if i >= len(t) || (tok != "*" && tok != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
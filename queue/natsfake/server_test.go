@@ -0,0 +1,27 @@
+package natsfake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchSubject(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"crawl-url", "crawl-url", true},
+		{"crawl-url", "crawl-urls", false},
+		{"crawl.*", "crawl.url", true},
+		{"crawl.*", "crawl.url.high", false},
+		{"crawl.>", "crawl.url.high", true},
+		{"crawl.>", "crawl", false},
+		{"*.url", "crawl.url", true},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, matchSubject(tc.pattern, tc.subject), "%s -> %s", tc.pattern, tc.subject)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 func TestPoolConn(t *testing.T) {
 	d, _ := db.NewMapConn()
+	d.CreateJob("test", "")
 	q := NewPoolConn(d)
 
 	done := make(chan bool)
@@ -19,7 +20,7 @@ func TestPoolConn(t *testing.T) {
 
 	q.Subscribe(processor)
 
-	q.Publish("test", "http://example.com", 0)
+	q.Publish(NewMessage("test", "http://example.com", 0))
 	<-done
 
 	r, _ := d.Results("test")
@@ -1,27 +1,74 @@
 package queue
 
-import "github.com/calavera/crawler/db"
+import (
+	"errors"
+	"sync"
+
+	"github.com/calavera/crawler/db"
+)
+
+var (
+	// ErrClosed is returned when messages are published in a closed connection.
+	ErrClosed = errors.New("queue connection closed")
+	// ErrUnsubscribed is returned when messages are published in a channel nobody listens to.
+	ErrUnsubscribed = errors.New("queue connection unsubscribed")
+)
 
 // PoolConn implements queue.Connection using a channel as a backend.
 // This interface is only suitable for testing.
 // It offers no guarantees about the elements pushed and pulled from the queue.
 type PoolConn struct {
-	db db.Connection
-	q  chan *Message
+	db    db.Connection
+	q     chan *Message
+	quit  chan struct{}
+	close *sync.Once
+	unsub chan struct{}
+	stop  *sync.Once
 }
 
 // NewPoolConn initializes the channel connection
 func NewPoolConn(d db.Connection) Connection {
 	return &PoolConn{
-		db: d,
-		q:  make(chan *Message),
+		db:    d,
+		q:     make(chan *Message),
+		quit:  make(chan struct{}),
+		close: new(sync.Once),
+		unsub: make(chan struct{}),
+		stop:  new(sync.Once),
+	}
+}
+
+// Connect returns another connection to the channel of this one, like a different node
+// connected to the same queue. It subscribes, unsubscribes and closes independently.
+func (p *PoolConn) Connect() Connection {
+	return &PoolConn{
+		db:    p.db,
+		q:     p.q,
+		quit:  make(chan struct{}),
+		close: new(sync.Once),
+		unsub: make(chan struct{}),
+		stop:  new(sync.Once),
 	}
 }
 
 // Publish sends messages to the channel for a specific job
-func (p *PoolConn) Publish(jobUUID, url string, depth uint) error {
-	p.q <- NewMessage(jobUUID, url, depth)
-	return nil
+func (p *PoolConn) Publish(msg *Message) error {
+	if p.closed() {
+		return ErrClosed
+	}
+	if p.unsubscribed() {
+		return ErrUnsubscribed
+	}
+
+	select {
+	case p.q <- msg:
+		msg.Logger().Debug("messagePublished")
+		return nil
+	case <-p.quit:
+		return ErrClosed
+	case <-p.unsub:
+		return ErrUnsubscribed
+	}
 }
 
 // Subscribe receives messages from the channel to process them
@@ -30,8 +77,62 @@ func (p *PoolConn) Subscribe(processor Processor) {
 		for {
 			select {
 			case msg := <-p.q:
+				if p.closed() {
+					return
+				}
+				msg.Logger().Debug("messageDelivered")
 				go processor(p, p.db, msg)
+			case <-p.quit:
+				return
+			case <-p.unsub:
+				return
 			}
 		}
 	}()
 }
+
+// Unsubscribe stops receiving messages from the channel.
+// Since there are no other nodes listening to the channel,
+// publishing messages after unsubscribing returns an error.
+func (p *PoolConn) Unsubscribe() error {
+	p.stop.Do(func() {
+		close(p.unsub)
+	})
+	return nil
+}
+
+// Close stops receiving messages from the channel.
+func (p *PoolConn) Close() error {
+	p.close.Do(func() {
+		close(p.quit)
+	})
+	return nil
+}
+
+// Ping checks that the connection is not closed nor unsubscribed.
+func (p *PoolConn) Ping() error {
+	if p.closed() {
+		return ErrClosed
+	}
+	if p.unsubscribed() {
+		return ErrUnsubscribed
+	}
+	return nil
+}
+
+func (p *PoolConn) closed() bool {
+	return isClosed(p.quit)
+}
+
+func (p *PoolConn) unsubscribed() bool {
+	return isClosed(p.unsub)
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
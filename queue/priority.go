@@ -0,0 +1,45 @@
+package queue
+
+import "fmt"
+
+// Priority is the scheduling priority of the messages of a job.
+// The zero value is the normal priority,
+// so messages published by older nodes are scheduled as normal.
+type Priority int
+
+// Priorities that jobs can have.
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+// Priorities is the list of priorities from the highest to the lowest.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+var priorityNames = map[Priority]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if n, ok := priorityNames[p]; ok {
+		return n
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority with a given name, low, normal or high.
+// Empty names are the normal priority.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return PriorityNormal, nil
+	}
+	for p, n := range priorityNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, expected low, normal or high", name)
+}
@@ -0,0 +1,85 @@
+package queuetest
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The assertions of the suite only use the standard library,
+// so the engines can run it without vendoring other test dependencies.
+// They report the failure and return false, so tests can guard the checks that depend on them.
+
+func assertEqual(t *testing.T, expected, actual interface{}) bool {
+	t.Helper()
+	if !equal(expected, actual) {
+		t.Errorf("not equal:\nexpected: %#v\nactual  : %#v", expected, actual)
+		return false
+	}
+	return true
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	t.Helper()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return false
+	}
+	return true
+}
+
+func assertError(t *testing.T, err error) bool {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected an error")
+		return false
+	}
+	return true
+}
+
+func assertTrue(t *testing.T, v bool) bool {
+	t.Helper()
+	if !v {
+		t.Errorf("expected true")
+	}
+	return v
+}
+
+func assertNotNil(t *testing.T, v interface{}) bool {
+	t.Helper()
+	if isNil(v) {
+		t.Errorf("expected a value, got nil")
+		return false
+	}
+	return true
+}
+
+// equal compares two values deeply.
+// Untyped constants are converted to the type of the actual value,
+// so counters can be compared with plain numbers.
+func equal(expected, actual interface{}) bool {
+	if reflect.DeepEqual(expected, actual) {
+		return true
+	}
+	if expected == nil || actual == nil {
+		return false
+	}
+
+	e, a := reflect.ValueOf(expected), reflect.ValueOf(actual)
+	if e.Type().ConvertibleTo(a.Type()) && e.Kind() != reflect.String {
+		return reflect.DeepEqual(e.Convert(a.Type()).Interface(), actual)
+	}
+	return false
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+package queuetest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+)
+
+// deliveryTimeout is the time that the suite waits for messages to be delivered.
+const deliveryTimeout = 5 * time.Second
+
+// Factory creates new connections to the queue engine under test.
+// Connections created by the same factory must share the same queue.
+type Factory func(db.Connection) (queue.Connection, error)
+
+// Suite verifies that a queue engine follows the semantics of queue.Connection.
+// Every test runs with a new connection.
+type Suite struct {
+	t       *testing.T
+	factory Factory
+	db      db.Connection
+	conn    queue.Connection
+}
+
+// Run runs the conformance suite against the connections created by the factory.
+// Every method of the suite whose name starts with Test runs as a subtest.
+func Run(t *testing.T, f Factory) {
+	st := reflect.TypeOf(&Suite{})
+	for i := 0; i < st.NumMethod(); i++ {
+		m := st.Method(i)
+		if !strings.HasPrefix(m.Name, "Test") {
+			continue
+		}
+
+		t.Run(m.Name, func(t *testing.T) {
+			s := &Suite{t: t, factory: f}
+			s.SetupTest()
+			defer s.TearDownTest()
+			m.Func.Call([]reflect.Value{reflect.ValueOf(s)})
+		})
+	}
+}
+
+// T returns the test that is running.
+func (s *Suite) T() *testing.T {
+	return s.t
+}
+
+// SetupTest creates a new connection for every test.
+func (s *Suite) SetupTest() {
+	s.db, _ = db.NewMapConn()
+	s.conn = s.newConn()
+}
+
+// TearDownTest closes the connection created for the test.
+func (s *Suite) TearDownTest() {
+	s.conn.Close()
+}
+
+// TestDelivery checks that published messages reach the processor, with all their fields.
+func (s *Suite) TestDelivery() {
+	jobUUID := queue.UUID()
+	msgs := make(chan *queue.Message, 1)
+
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		assertNotNil(s.T(), q)
+		assertEqual(s.T(), s.db, d)
+		msgs <- m
+	})
+
+	msg := queue.NewMessage(jobUUID, "http://example.com", 0)
+	msg.Traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	msg.Tenant = "acme"
+	msg.Priority = queue.PriorityHigh
+	msg.Template = "nightly"
+	msg.Sitemaps = true
+	msg.LastMod = time.Date(2015, 6, 1, 3, 0, 0, 0, time.UTC)
+	msg.Claimed = true
+	assertNoError(s.T(), s.conn.Publish(msg))
+
+	m := s.receive(msgs)
+	if assertNotNil(s.T(), m) {
+		assertEqual(s.T(), jobUUID, m.JobUUID)
+		assertEqual(s.T(), "http://example.com", m.URL)
+		assertEqual(s.T(), 0, m.Depth)
+		assertEqual(s.T(), msg.ID, m.ID)
+		assertEqual(s.T(), msg.Traceparent, m.Traceparent)
+		assertEqual(s.T(), msg.Tenant, m.Tenant)
+		assertEqual(s.T(), msg.Priority, m.Priority)
+		assertEqual(s.T(), msg.Template, m.Template)
+		assertEqual(s.T(), msg.Sitemaps, m.Sitemaps)
+		assertTrue(s.T(), msg.LastMod.Equal(m.LastMod))
+		assertEqual(s.T(), msg.Claimed, m.Claimed)
+	}
+}
+
+// TestDepth checks that the depth of the messages is kept.
+func (s *Suite) TestDepth() {
+	jobUUID := queue.UUID()
+	msgs := make(chan *queue.Message, 1)
+
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+	})
+
+	assertNoError(s.T(), s.conn.Publish(queue.NewMessage(jobUUID, "http://example.com", 2)))
+
+	if m := s.receive(msgs); assertNotNil(s.T(), m) {
+		assertEqual(s.T(), 2, m.Depth)
+	}
+}
+
+// TestPublishFromProcessor checks that processors can publish new messages
+// using the connection that they receive.
+func (s *Suite) TestPublishFromProcessor() {
+	jobUUID := queue.UUID()
+	msgs := make(chan *queue.Message, 2)
+
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+		if m.Depth == 0 {
+			assertNoError(s.T(), q.Publish(queue.NewMessage(m.JobUUID, "http://example.com/follow", m.Depth+1)))
+		}
+	})
+
+	assertNoError(s.T(), s.conn.Publish(queue.NewMessage(jobUUID, "http://example.com", 0)))
+
+	s.receive(msgs)
+	if m := s.receive(msgs); assertNotNil(s.T(), m) {
+		assertEqual(s.T(), "http://example.com/follow", m.URL)
+		assertEqual(s.T(), 1, m.Depth)
+	}
+}
+
+// TestAllDelivered checks that every message is delivered.
+// Engines don't need to keep the order of the messages.
+func (s *Suite) TestAllDelivered() {
+	const n = 20
+	jobUUID := queue.UUID()
+	msgs := make(chan *queue.Message, n)
+
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+	})
+
+	for i := 0; i < n; i++ {
+		assertNoError(s.T(), s.conn.Publish(queue.NewMessage(jobUUID, fmt.Sprintf("http://example.com/%d", i), 0)))
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		if m := s.receive(msgs); m != nil {
+			seen[m.URL] = true
+		}
+	}
+	assertEqual(s.T(), n, len(seen))
+}
+
+// TestCompetingConsumers checks that every message is processed only once
+// when there are several subscribers.
+func (s *Suite) TestCompetingConsumers() {
+	const n = 20
+	jobUUID := queue.UUID()
+
+	var mu sync.Mutex
+	deliveries := map[string]int{}
+	msgs := make(chan *queue.Message, 2*n)
+	processor := func(q queue.Connection, d db.Connection, m *queue.Message) {
+		mu.Lock()
+		deliveries[m.URL]++
+		mu.Unlock()
+		msgs <- m
+	}
+
+	other := s.newConn()
+	defer other.Close()
+
+	s.conn.Subscribe(processor)
+	s.conn.Subscribe(processor)
+	other.Subscribe(processor)
+
+	for i := 0; i < n; i++ {
+		assertNoError(s.T(), s.conn.Publish(queue.NewMessage(jobUUID, fmt.Sprintf("http://example.com/%d", i), 0)))
+	}
+
+	for i := 0; i < n; i++ {
+		s.receive(msgs)
+	}
+
+	// Wait a little bit more to catch duplicated deliveries.
+	select {
+	case m := <-msgs:
+		s.T().Errorf("message delivered more than once: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEqual(s.T(), n, len(deliveries))
+	for u, c := range deliveries {
+		if c != 1 {
+			s.T().Errorf("message delivered %d times: %s", c, u)
+		}
+	}
+}
+
+// TestSharedQueue checks that messages published in a connection
+// reach the subscribers of other connections created by the factory.
+func (s *Suite) TestSharedQueue() {
+	msgs := make(chan *queue.Message, 1)
+	other := s.newConn()
+	defer other.Close()
+
+	other.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+	})
+
+	msg := queue.NewMessage(queue.UUID(), "http://example.com", 0)
+	go s.conn.Publish(msg)
+
+	if m := s.receive(msgs); m != nil {
+		assertEqual(s.T(), msg.ID, m.ID)
+	}
+}
+
+// TestUnsubscribe checks that connections stop processing messages after unsubscribing,
+// and that they can still be closed afterwards.
+func (s *Suite) TestUnsubscribe() {
+	msgs := make(chan *queue.Message, 1)
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+	})
+
+	assertNoError(s.T(), s.conn.Unsubscribe())
+	s.conn.Publish(queue.NewMessage(queue.UUID(), "http://example.com", 0))
+
+	select {
+	case m := <-msgs:
+		s.T().Errorf("message processed after unsubscribing: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assertNoError(s.T(), s.conn.Close())
+}
+
+// TestPing checks that connections are healthy until they unsubscribe or close.
+func (s *Suite) TestPing() {
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {})
+	assertNoError(s.T(), s.conn.Ping())
+
+	assertNoError(s.T(), s.conn.Unsubscribe())
+	assertError(s.T(), s.conn.Ping())
+
+	c := s.newConn()
+	assertNoError(s.T(), c.Close())
+	assertError(s.T(), c.Ping())
+}
+
+// TestClose checks that closed connections don't publish nor process messages.
+func (s *Suite) TestClose() {
+	msgs := make(chan *queue.Message, 1)
+	s.conn.Subscribe(func(q queue.Connection, d db.Connection, m *queue.Message) {
+		msgs <- m
+	})
+
+	assertNoError(s.T(), s.conn.Close())
+	assertError(s.T(), s.conn.Publish(queue.NewMessage(queue.UUID(), "http://example.com", 0)))
+
+	select {
+	case m := <-msgs:
+		s.T().Errorf("message processed after closing the connection: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assertNoError(s.T(), s.conn.Close())
+}
+
+func (s *Suite) newConn() queue.Connection {
+	c, err := s.factory(s.db)
+	if err != nil {
+		s.T().Fatalf("unable to create the connection: %v", err)
+	}
+	return c
+}
+
+func (s *Suite) receive(msgs chan *queue.Message) *queue.Message {
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(deliveryTimeout):
+		s.T().Errorf("message not delivered after %v", deliveryTimeout)
+		return nil
+	}
+}
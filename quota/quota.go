@@ -0,0 +1,284 @@
+package quota
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/metrics"
+	"github.com/calavera/crawler/queue"
+)
+
+// dayLayout is the format of the days that the usage is counted by, in UTC.
+const dayLayout = "2006-01-02"
+
+// Names of the quotas reported in the errors and the metrics.
+const (
+	ConcurrentJobs = "concurrentJobs"
+	PagesPerJob    = "pagesPerJob"
+	PagesPerDay    = "pagesPerDay"
+	BytesPerDay    = "bytesPerDay"
+)
+
+var quotaExceeded = metrics.NewCounter("crawler_quota_exceeded_total",
+	"Jobs and pages rejected because a tenant exceeded a quota.", "quota")
+
+// Limits are the quotas of a tenant. Zero values disable the limits.
+type Limits struct {
+	ConcurrentJobs int   `json:"concurrentJobs"` // jobs with pages in flight.
+	PagesPerJob    int64 `json:"pagesPerJob"`    // pages crawled by a job, including the seeds.
+	PagesPerDay    int64 `json:"pagesPerDay"`    // pages crawled by all the jobs of the tenant in a day.
+	BytesPerDay    int64 `json:"bytesPerDay"`    // bytes downloaded by all the jobs of the tenant in a day.
+}
+
+// IsZero returns true when the limits don't restrict anything.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// CountsUsage returns true when the limits need the usage kept in the storage,
+// all of them but the concurrent jobs.
+func (l Limits) CountsUsage() bool {
+	return l.PagesPerJob > 0 || l.PagesPerDay > 0 || l.BytesPerDay > 0
+}
+
+// Policy holds the quotas of every tenant.
+type Policy struct {
+	Default Limits            // limits of the tenants without their own.
+	Tenants map[string]Limits // limits by tenant name.
+}
+
+// Limits returns the quotas of a tenant.
+func (p Policy) Limits(tenant string) Limits {
+	if l, ok := p.Tenants[tenant]; ok {
+		return l
+	}
+	return p.Default
+}
+
+// IsZero returns true when no tenant has quotas.
+func (p Policy) IsZero() bool {
+	if !p.Default.IsZero() {
+		return false
+	}
+	for _, l := range p.Tenants {
+		if !l.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// CountsUsage returns true when any tenant has limits that need the usage kept in the storage.
+func (p Policy) CountsUsage() bool {
+	if p.Default.CountsUsage() {
+		return true
+	}
+	for _, l := range p.Tenants {
+		if l.CountsUsage() {
+			return true
+		}
+	}
+	return false
+}
+
+// ExceededError is returned when a tenant reaches one of its quotas.
+type ExceededError struct {
+	Tenant string
+	Quota  string
+	Limit  int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s is limited to %d", e.Quota, e.Limit)
+}
+
+// Status holds the quotas of a tenant and how much of them it uses.
+type Status struct {
+	Tenant     string `json:"tenant"`
+	Day        string `json:"day"`
+	Limits     Limits `json:"limits"`
+	ActiveJobs int    `json:"activeJobs"`
+	Pages      int64  `json:"pages"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// Tracker enforces the quotas of a policy with the usage kept in a storage,
+// so the quotas are shared by all the nodes that use the same storage.
+// Checks and updates are not atomic,
+// concurrent jobs and pages can exceed the quotas by the work in flight.
+// Storages that don't implement db.UsageStore only enforce the concurrent jobs,
+// the other limits return db.ErrUnsupported.
+type Tracker struct {
+	db     db.Connection
+	usage  db.UsageStore // nil when the storage doesn't keep the usage.
+	policy Policy
+	now    func() time.Time
+}
+
+// New creates a tracker that enforces a policy with the usage kept in a storage.
+func New(d db.Connection, p Policy) *Tracker {
+	u, _ := db.AsUsageStore(d)
+	return &Tracker{
+		db:     d,
+		usage:  u,
+		policy: p,
+		now:    time.Now,
+	}
+}
+
+// Admit checks that a tenant can create a new job with a number of seeds.
+// It returns an ExceededError when the job would exceed the quotas of the tenant.
+func (t *Tracker) Admit(tenant string, seeds int) error {
+	l := t.policy.Limits(tenant)
+	if l.IsZero() {
+		return nil
+	}
+
+	if l.PagesPerJob > 0 && int64(seeds) > l.PagesPerJob {
+		return exceeded(tenant, PagesPerJob, l.PagesPerJob)
+	}
+
+	if l.ConcurrentJobs > 0 {
+		jobs, err := t.activeJobs(tenant)
+		if err != nil {
+			return err
+		}
+		if len(jobs) >= l.ConcurrentJobs {
+			return exceeded(tenant, ConcurrentJobs, int64(l.ConcurrentJobs))
+		}
+	}
+
+	return t.checkDaily(tenant, l)
+}
+
+// Allow checks that the job in a message can crawl one more page, and counts the page for the job.
+// Crawlers call it after the job claims the page, so every page is counted once.
+// It returns an ExceededError when the page would exceed the quotas of the tenant of the job.
+func (t *Tracker) Allow(msg *queue.Message) error {
+	l := t.policy.Limits(msg.Tenant)
+	if !l.CountsUsage() {
+		return nil
+	}
+	if t.usage == nil {
+		return db.ErrUnsupported
+	}
+
+	// Claimed messages were counted by the crawl that claimed their page.
+	if l.PagesPerJob > 0 && !msg.Claimed {
+		n, err := t.usage.CountPage(msg.JobUUID)
+		if err != nil {
+			return err
+		}
+		if n > l.PagesPerJob {
+			return exceeded(msg.Tenant, PagesPerJob, l.PagesPerJob)
+		}
+	}
+
+	return t.checkDaily(msg.Tenant, l)
+}
+
+// Record adds a page crawled and its bytes to the usage of a tenant.
+// It doesn't record anything when the policy has no quotas, or the storage doesn't keep the usage.
+func (t *Tracker) Record(tenant string, bytes int64) error {
+	if t.policy.IsZero() || t.usage == nil {
+		return nil
+	}
+	return t.usage.AddUsage(tenant, t.day(), 1, bytes)
+}
+
+// Status returns the quotas of a tenant and its usage.
+// The pages and the bytes are zero when the storage doesn't keep the usage.
+func (t *Tracker) Status(tenant string) (*Status, error) {
+	jobs, err := t.activeJobs(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Status{
+		Tenant:     tenant,
+		Day:        t.day(),
+		Limits:     t.policy.Limits(tenant),
+		ActiveJobs: len(jobs),
+	}
+	if t.usage == nil {
+		return st, nil
+	}
+
+	u, err := t.usage.Usage(tenant, st.Day)
+	if err != nil {
+		return nil, err
+	}
+	st.Pages = u.Pages
+	st.Bytes = u.Bytes
+	return st, nil
+}
+
+func (t *Tracker) checkDaily(tenant string, l Limits) error {
+	if l.PagesPerDay == 0 && l.BytesPerDay == 0 {
+		return nil
+	}
+	if t.usage == nil {
+		return db.ErrUnsupported
+	}
+
+	u, err := t.usage.Usage(tenant, t.day())
+	if err != nil {
+		return err
+	}
+
+	if l.PagesPerDay > 0 && u.Pages >= l.PagesPerDay {
+		return exceeded(tenant, PagesPerDay, l.PagesPerDay)
+	}
+	if l.BytesPerDay > 0 && u.Bytes >= l.BytesPerDay {
+		return exceeded(tenant, BytesPerDay, l.BytesPerDay)
+	}
+	return nil
+}
+
+// activeJobs returns the jobs of a tenant that still have pages to crawl.
+// Jobs that finished, were cancelled or are not in the storage anymore
+// are removed from the active jobs of the tenant.
+func (t *Tracker) activeJobs(tenant string) ([]string, error) {
+	jobs, err := t.db.ActiveJobs(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []string
+	for _, j := range jobs {
+		info, err := t.db.Status(j)
+		if err != nil && err != db.ErrJobNotFound {
+			return nil, err
+		}
+		if err == nil && !finished(info) {
+			active = append(active, j)
+			continue
+		}
+
+		if err := t.db.FinishJob(tenant, j); err != nil {
+			return nil, err
+		}
+	}
+	return active, nil
+}
+
+func (t *Tracker) day() string {
+	return t.now().UTC().Format(dayLayout)
+}
+
+// finished returns true when a job was cancelled, or when it has seen pages
+// and it has no urls waiting in the queue or being crawled.
+// Jobs that have not seen any page yet are still waiting for their seeds.
+// Jobs whose messages are lost by the queue stay active until they are cancelled.
+func finished(info *db.Info) bool {
+	if info.Cancelled {
+		return true
+	}
+	return info.Queued <= 0 && info.Processing <= 0 && len(info.PageViews()) > 0
+}
+
+func exceeded(tenant, quota string, limit int64) *ExceededError {
+	quotaExceeded.Inc(quota)
+	return &ExceededError{Tenant: tenant, Quota: quota, Limit: limit}
+}
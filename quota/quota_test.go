@@ -0,0 +1,155 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTracker(limits Limits) (*Tracker, db.Connection) {
+	d, _ := db.NewMapConn()
+	t := New(d, Policy{Tenants: map[string]Limits{"acme": limits}})
+	t.now = func() time.Time {
+		return time.Date(2015, 6, 1, 23, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	}
+	return t, d
+}
+
+func assertExceeded(t *testing.T, quota string, err error) {
+	if e, ok := err.(*ExceededError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, quota, e.Quota)
+	}
+}
+
+func TestPolicyLimits(t *testing.T) {
+	p := Policy{}
+	assert.True(t, p.IsZero())
+
+	p.Tenants = map[string]Limits{"acme": {PagesPerJob: 10}, "other": {}}
+	assert.False(t, p.IsZero())
+	assert.Equal(t, Limits{PagesPerJob: 10}, p.Limits("acme"))
+	assert.Equal(t, Limits{}, p.Limits("unknown"))
+
+	p.Default = Limits{ConcurrentJobs: 1}
+	assert.Equal(t, Limits{ConcurrentJobs: 1}, p.Limits("unknown"))
+	assert.Equal(t, Limits{}, p.Limits("other"))
+	assert.True(t, p.CountsUsage())
+
+	p.Tenants = nil
+	assert.False(t, p.CountsUsage())
+}
+
+func TestAdmitSeeds(t *testing.T) {
+	tr, _ := newTracker(Limits{PagesPerJob: 2})
+
+	assert.NoError(t, tr.Admit("acme", 2))
+	assertExceeded(t, PagesPerJob, tr.Admit("acme", 3))
+	assert.NoError(t, tr.Admit("other", 3))
+}
+
+func TestAdmitConcurrentJobs(t *testing.T) {
+	tr, d := newTracker(Limits{ConcurrentJobs: 2})
+
+	first, second := queue.UUID(), queue.UUID()
+	d.CreateJob(first, "acme")
+	assert.NoError(t, tr.Admit("acme", 1))
+
+	d.CreateJob(second, "acme")
+	assertExceeded(t, ConcurrentJobs, tr.Admit("acme", 1))
+
+	d.Queued(first)
+	d.ViewPage(first, "http://example.com")
+	d.Processing(first)
+	d.Queued(first)
+	d.Done(first)
+	assertExceeded(t, ConcurrentJobs, tr.Admit("acme", 1))
+
+	d.ViewPage(first, "http://example.com/about")
+	d.Processing(first)
+	d.Done(first)
+	assert.NoError(t, tr.Admit("acme", 1))
+
+	jobs, _ := d.ActiveJobs("acme")
+	assert.Equal(t, []string{second}, jobs)
+
+	d.CreateJob(queue.UUID(), "acme")
+	assertExceeded(t, ConcurrentJobs, tr.Admit("acme", 1))
+
+	d.Cancel(second)
+	assert.NoError(t, tr.Admit("acme", 1))
+}
+
+func TestAdmitDaily(t *testing.T) {
+	tr, _ := newTracker(Limits{PagesPerDay: 2, BytesPerDay: 100})
+
+	assert.NoError(t, tr.Record("acme", 60))
+	assert.NoError(t, tr.Admit("acme", 1))
+
+	assert.NoError(t, tr.Record("acme", 60))
+	assertExceeded(t, PagesPerDay, tr.Admit("acme", 1))
+
+	tr.policy.Tenants["acme"] = Limits{BytesPerDay: 100}
+	assertExceeded(t, BytesPerDay, tr.Admit("acme", 1))
+}
+
+func TestAllowPagesPerJob(t *testing.T) {
+	tr, d := newTracker(Limits{PagesPerJob: 2})
+
+	msg := queue.NewMessage(queue.UUID(), "http://example.com", 0)
+	msg.Tenant = "acme"
+	d.CreateJob(msg.JobUUID, msg.Tenant)
+
+	assert.NoError(t, tr.Allow(msg))
+	assert.NoError(t, tr.Allow(msg))
+	assertExceeded(t, PagesPerJob, tr.Allow(msg))
+
+	msg.Claimed = true
+	assert.NoError(t, tr.Allow(msg))
+	msg.Claimed = false
+
+	msg.Tenant = "other"
+	assert.NoError(t, tr.Allow(msg))
+}
+
+func TestStatus(t *testing.T) {
+	tr, d := newTracker(Limits{ConcurrentJobs: 5, PagesPerDay: 10})
+
+	d.CreateJob(queue.UUID(), "acme")
+	tr.Record("acme", 1024)
+
+	s, err := tr.Status("acme")
+	assert.NoError(t, err)
+	assert.Equal(t, &Status{
+		Tenant:     "acme",
+		Day:        "2015-06-01",
+		Limits:     Limits{ConcurrentJobs: 5, PagesPerDay: 10},
+		ActiveJobs: 1,
+		Pages:      1,
+		Bytes:      1024,
+	}, s)
+}
+
+func TestWithoutUsageStore(t *testing.T) {
+	d, _ := db.NewMapConn()
+	tr := New(struct{ db.Connection }{d}, Policy{Tenants: map[string]Limits{
+		"acme":  {ConcurrentJobs: 1},
+		"other": {PagesPerDay: 1},
+	}})
+
+	msg := queue.NewMessage(queue.UUID(), "http://example.com", 0)
+	msg.Tenant = "acme"
+	assert.NoError(t, tr.Admit("acme", 1))
+	assert.NoError(t, tr.Allow(msg))
+	assert.NoError(t, tr.Record("acme", 1024))
+
+	s, err := tr.Status("acme")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), s.Pages)
+
+	msg.Tenant = "other"
+	assert.Equal(t, db.ErrUnsupported, tr.Admit("other", 1))
+	assert.Equal(t, db.ErrUnsupported, tr.Allow(msg))
+}
@@ -0,0 +1,73 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func date(month time.Month, day, hour, min int) time.Time {
+	return time.Date(2015, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestCronNext(t *testing.T) {
+	// June 1st 2015 is a monday.
+	from := date(6, 1, 10, 30)
+
+	testCases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", date(6, 1, 10, 31)},
+		{"*/15 * * * *", date(6, 1, 10, 45)},
+		{"0 3 * * *", date(6, 2, 3, 0)},
+		{"@daily", date(6, 2, 0, 0)},
+		{"@hourly", date(6, 1, 11, 0)},
+		{"@monthly", date(7, 1, 0, 0)},
+		{"30 2 * * sat,sun", date(6, 6, 2, 30)},
+		{"0 9-17/4 * * mon-fri", date(6, 1, 13, 0)},
+		{"0 0 * * 7", date(6, 7, 0, 0)},
+		{"0 0 15 * mon", date(6, 8, 0, 0)},
+		{"0 0 15 * *", date(6, 15, 0, 0)},
+		{"0 12 1 jan *", time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		c, err := ParseCron(tc.expr)
+		if assert.NoError(t, err, tc.expr) {
+			assert.Equal(t, tc.next, c.Next(from), tc.expr)
+		}
+	}
+}
+
+func TestCronNextInUTC(t *testing.T) {
+	c, err := ParseCron("0 3 * * *")
+	assert.NoError(t, err)
+
+	from := time.Date(2015, 6, 1, 4, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	// 4:00 in CEST is 2:00 in UTC.
+	assert.Equal(t, date(6, 1, 3, 0), c.Next(from))
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"@often",
+		"0 0 30 2 *",
+	} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,322 @@
+// Package schedule creates jobs from templates when their cron expressions match.
+// Schedules and their runs are kept in the storage, so any node can create the jobs.
+// Nodes elect a leader with a lease in the storage, and only the leader creates jobs.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/logging"
+	"github.com/calavera/crawler/metrics"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/calavera/crawler/tracing"
+)
+
+const (
+	// leaseName is the lease that the schedulers of all the nodes compete for.
+	leaseName = "scheduler"
+	// leaseIntervals is the number of intervals that a lease lasts without renewals.
+	leaseIntervals = 3
+)
+
+// errStillRunning is recorded in the runs skipped because the previous job of the schedule didn't finish.
+var errStillRunning = errors.New("the previous run is still running")
+
+var (
+	scheduledRuns = metrics.NewCounter("crawler_scheduled_runs_total",
+		"Runs of the schedules by result, created, skipped or failed.", "result")
+	schedulerLeader = metrics.NewGauge("crawler_scheduler_leader",
+		"1 when the node holds the scheduler lease.")
+)
+
+// Validate checks that a schedule has everything it needs to create jobs.
+func Validate(sc *db.Schedule) error {
+	if _, err := ParseCron(sc.Cron); err != nil {
+		return err
+	}
+
+	if len(sc.Seeds) == 0 {
+		return errors.New("a schedule needs urls to crawl")
+	}
+	for _, s := range sc.Seeds {
+		if _, err := url.Parse(s); err != nil {
+			return err
+		}
+	}
+
+	_, err := queue.ParsePriority(sc.Priority)
+	return err
+}
+
+// Next returns when a schedule is due, given its last run, nil when it never ran.
+// It returns the zero time when the cron expression is not valid.
+func Next(sc *db.Schedule, last *db.Run) time.Time {
+	c, err := ParseCron(sc.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+
+	from := sc.Updated
+	if last != nil && last.Time.After(from) {
+		from = last.Time
+	}
+	return c.Next(from)
+}
+
+// Storage is a storage that keeps the schedules, their runs and the lease of the leader.
+type Storage interface {
+	db.Connection
+	db.ScheduleStore
+	db.RunStore
+	db.LeaseStore
+}
+
+// StorageOf returns a connection as a Storage when its engine implements the interfaces needed by the scheduler.
+func StorageOf(d db.Connection) (Storage, bool) {
+	_, schedules := db.AsScheduleStore(d)
+	_, runs := db.AsRunStore(d)
+	_, leases := db.AsLeaseStore(d)
+
+	s, ok := d.(Storage)
+	return s, ok && schedules && runs && leases
+}
+
+// Scheduler checks the schedules every interval and creates the jobs that are due.
+// A schedule is due when its cron expression matches a time after its last run,
+// or after it was updated when it never ran.
+// Runs missed while no node was the leader are not created again, only the last one.
+type Scheduler struct {
+	*sync.Mutex
+	db       Storage
+	queue    queue.Connection
+	quota    *quota.Tracker
+	node     string
+	interval time.Duration
+	now      func() time.Time
+	leader   bool
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// New creates a scheduler for a node.
+// The jobs created are admitted with the quotas of the tenants of the schedules.
+func New(d Storage, q queue.Connection, p quota.Policy, node string, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		Mutex:    new(sync.Mutex),
+		db:       d,
+		queue:    q,
+		quota:    quota.New(d, p),
+		node:     node,
+		interval: interval,
+		now:      time.Now,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start checks the schedules in the background until the scheduler is stopped.
+func (s *Scheduler) Start() {
+	go s.loop()
+}
+
+// Stop waits for the check in progress and releases the lease,
+// so another node takes over without waiting for it to expire.
+func (s *Scheduler) Stop() {
+	close(s.quit)
+	<-s.done
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.leader {
+		return
+	}
+	if _, err := s.db.AcquireLease(leaseName, s.node, 0); err != nil {
+		slog.Error("leaseReleaseError", logging.Err(err))
+	}
+	s.setLeader(false)
+}
+
+// Leader returns true when the node holds the lease.
+func (s *Scheduler) Leader() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.leader
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		s.tick()
+
+		select {
+		case <-t.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// tick renews the lease and creates the runs that are due when the node is the leader.
+func (s *Scheduler) tick() {
+	s.Lock()
+	defer s.Unlock()
+
+	ok, err := s.db.AcquireLease(leaseName, s.node, leaseIntervals*s.interval)
+	if err != nil {
+		slog.Error("leaseError", logging.Err(err))
+	}
+	s.setLeader(ok)
+	if !ok {
+		return
+	}
+
+	schedules, err := s.db.Schedules()
+	if err != nil {
+		slog.Error("schedulesError", logging.Err(err))
+		return
+	}
+
+	now := s.now()
+	for _, sc := range schedules {
+		if err := s.check(sc, now); err != nil {
+			slog.Error("scheduleError", logging.ScheduleKey, sc.ID, logging.Err(err))
+		}
+	}
+}
+
+// setLeader records the changes of leadership.
+// It must be called holding the lock.
+func (s *Scheduler) setLeader(leader bool) {
+	if leader == s.leader {
+		return
+	}
+	s.leader = leader
+
+	if leader {
+		slog.Info("schedulerLeaderElected")
+		schedulerLeader.Set(1)
+		return
+	}
+	slog.Info("schedulerLeaderLost")
+	schedulerLeader.Set(0)
+}
+
+// check adds a run to a schedule when it's due.
+func (s *Scheduler) check(sc *db.Schedule, now time.Time) error {
+	runs, err := s.db.Runs(sc.ID)
+	if err != nil {
+		return err
+	}
+
+	var last *db.Run
+	if len(runs) > 0 {
+		last = &runs[0]
+	}
+
+	next := Next(sc, last)
+	if next.IsZero() {
+		return fmt.Errorf("invalid cron expression %q", sc.Cron)
+	}
+	if next.After(now) {
+		return nil
+	}
+	return s.db.AddRun(sc.ID, s.run(sc, last, now))
+}
+
+// run creates a job with the seeds of a schedule.
+// Runs that don't create their job keep the reason in the history.
+func (s *Scheduler) run(sc *db.Schedule, last *db.Run, now time.Time) db.Run {
+	l := slog.Default().With(logging.ScheduleKey, sc.ID)
+	if sc.Tenant != "" {
+		l = l.With(logging.TenantKey, sc.Tenant)
+	}
+
+	r := db.Run{Time: now}
+	if running, err := s.running(last); err != nil || running {
+		if err == nil {
+			err = errStillRunning
+		}
+		r.Error = err.Error()
+		l.Info("scheduledRunSkipped", logging.Err(err))
+		scheduledRuns.Inc("skipped")
+		return r
+	}
+
+	jobUUID, err := s.createJob(sc)
+	if err != nil {
+		r.Error = err.Error()
+		l.Warn("scheduledRunFailed", logging.Err(err))
+		scheduledRuns.Inc("failed")
+		return r
+	}
+
+	r.JobUUID = jobUUID
+	l.Info("scheduledRunCreated", logging.JobKey, jobUUID, "urls", len(sc.Seeds))
+	scheduledRuns.Inc("created")
+	return r
+}
+
+// running returns true when the job of the last run has pages in flight.
+func (s *Scheduler) running(last *db.Run) (bool, error) {
+	if last == nil || last.JobUUID == "" {
+		return false, nil
+	}
+
+	info, err := s.db.Status(last.JobUUID)
+	if err == db.ErrJobNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Processing > 0 && !info.Cancelled, nil
+}
+
+// createJob creates a job and publishes its seeds, like the api does with the jobs submitted.
+func (s *Scheduler) createJob(sc *db.Schedule) (string, error) {
+	priority, err := queue.ParsePriority(sc.Priority)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.quota.Admit(sc.Tenant, len(sc.Seeds)); err != nil {
+		return "", err
+	}
+
+	jobUUID := queue.UUID()
+	span := tracing.Start(tracing.SpanContext{}, "schedule.run", tracing.KindInternal)
+	defer span.End()
+	span.SetAttributes("job.uuid", jobUUID, "schedule.id", sc.ID, "job.priority", priority.String())
+
+	err = tracing.Do(span.Context(), "storage.create_job", tracing.KindClient, func() error {
+		return s.db.CreateJob(jobUUID, sc.Tenant)
+	})
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+
+	for _, u := range sc.Seeds {
+		msg := queue.NewMessage(jobUUID, u, 0)
+		msg.Tenant = sc.Tenant
+		msg.Priority = priority
+		msg.Template = sc.ID
+		msg.Sitemaps = sc.Sitemaps
+		if err := queue.Enqueue(s.queue, s.db, span.Context(), msg); err != nil {
+			logging.Job(jobUUID).Error("publishingError", logging.URLKey, u, logging.Err(err))
+		}
+	}
+	return jobUUID, nil
+}
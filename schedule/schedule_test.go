@@ -0,0 +1,175 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calavera/crawler/db"
+	"github.com/calavera/crawler/queue"
+	"github.com/calavera/crawler/quota"
+	"github.com/stretchr/testify/assert"
+)
+
+func newScheduler(p quota.Policy) (*Scheduler, Storage, chan *queue.Message, func()) {
+	m, _ := db.NewMapConn()
+	d := m.(Storage)
+	q := queue.NewPoolConn(d)
+
+	msgs := make(chan *queue.Message, 10)
+	q.Subscribe(func(q queue.Connection, d db.Connection, msg *queue.Message) {
+		msgs <- msg
+	})
+
+	return New(d, q, p, "node1", time.Minute), d, msgs, func() { q.Close() }
+}
+
+func newSchedule(d Storage, seeds ...string) *db.Schedule {
+	sc := &db.Schedule{
+		ID:       queue.UUID(),
+		Tenant:   "acme",
+		Cron:     "0 3 * * *",
+		Seeds:    seeds,
+		Priority: "high",
+		Sitemaps: true,
+		Updated:  date(6, 1, 2, 0),
+	}
+	d.SaveSchedule(sc)
+	return sc
+}
+
+func (s *Scheduler) tickAt(t time.Time) {
+	s.now = func() time.Time { return t }
+	s.tick()
+}
+
+func lastRun(t *testing.T, d Storage, id string, n int) db.Run {
+	runs, err := d.Runs(id)
+	assert.NoError(t, err)
+	if !assert.Len(t, runs, n) {
+		t.FailNow()
+	}
+	if n == 0 {
+		return db.Run{}
+	}
+	return runs[0]
+}
+
+func TestSchedulerRuns(t *testing.T) {
+	s, d, msgs, stop := newScheduler(quota.Policy{})
+	defer stop()
+	sc := newSchedule(d, "http://example.com")
+
+	s.tickAt(date(6, 1, 2, 59))
+	runs, _ := d.Runs(sc.ID)
+	assert.Empty(t, runs)
+
+	s.tickAt(date(6, 1, 3, 0))
+	r := lastRun(t, d, sc.ID, 1)
+	assert.NotEmpty(t, r.JobUUID)
+	assert.Empty(t, r.Error)
+	assert.Equal(t, date(6, 1, 3, 0), r.Time)
+
+	msg := <-msgs
+	assert.Equal(t, r.JobUUID, msg.JobUUID)
+	assert.Equal(t, "http://example.com", msg.URL)
+	assert.Equal(t, "acme", msg.Tenant)
+	assert.Equal(t, queue.PriorityHigh, msg.Priority)
+	assert.Equal(t, sc.ID, msg.Template)
+	assert.True(t, msg.Sitemaps)
+
+	info, err := d.Status(r.JobUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", info.Tenant)
+
+	s.tickAt(date(6, 1, 3, 1))
+	lastRun(t, d, sc.ID, 1)
+
+	// Runs missed are not created again, only the last one.
+	s.tickAt(date(6, 4, 12, 0))
+	next := lastRun(t, d, sc.ID, 2)
+	assert.NotEqual(t, r.JobUUID, next.JobUUID)
+	assert.Equal(t, date(6, 4, 12, 0), next.Time)
+
+	s.tickAt(date(6, 5, 2, 0))
+	lastRun(t, d, sc.ID, 2)
+}
+
+func TestSchedulerSkipsRunning(t *testing.T) {
+	s, d, _, stop := newScheduler(quota.Policy{})
+	defer stop()
+	sc := newSchedule(d, "http://example.com")
+
+	s.tickAt(date(6, 1, 3, 0))
+	r := lastRun(t, d, sc.ID, 1)
+	d.Processing(r.JobUUID)
+
+	s.tickAt(date(6, 2, 3, 0))
+	skipped := lastRun(t, d, sc.ID, 2)
+	assert.Empty(t, skipped.JobUUID)
+	assert.Equal(t, errStillRunning.Error(), skipped.Error)
+
+	d.Done(r.JobUUID)
+	s.tickAt(date(6, 3, 3, 0))
+	assert.NotEmpty(t, lastRun(t, d, sc.ID, 3).JobUUID)
+}
+
+func TestSchedulerQuotas(t *testing.T) {
+	s, d, _, stop := newScheduler(quota.Policy{Default: quota.Limits{PagesPerJob: 1}})
+	defer stop()
+	sc := newSchedule(d, "http://example.com", "http://example.org")
+
+	s.tickAt(date(6, 1, 3, 0))
+	r := lastRun(t, d, sc.ID, 1)
+	assert.Empty(t, r.JobUUID)
+	assert.Contains(t, r.Error, quota.PagesPerJob)
+}
+
+func TestSchedulerLeader(t *testing.T) {
+	s, d, _, stop := newScheduler(quota.Policy{})
+	defer stop()
+	sc := newSchedule(d, "http://example.com")
+
+	other := New(d, s.queue, quota.Policy{}, "node2", time.Minute)
+	other.now = func() time.Time { return date(6, 1, 2, 0) }
+	other.Start()
+	for i := 0; i < 100 && !other.Leader(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, other.Leader())
+
+	s.tickAt(date(6, 1, 3, 0))
+	assert.False(t, s.Leader())
+	lastRun(t, d, sc.ID, 0)
+
+	other.Stop()
+	assert.False(t, other.Leader())
+
+	s.tickAt(date(6, 1, 3, 0))
+	assert.True(t, s.Leader())
+	lastRun(t, d, sc.ID, 1)
+}
+
+func TestValidate(t *testing.T) {
+	sc := &db.Schedule{Cron: "@daily", Seeds: []string{"http://example.com"}}
+	assert.NoError(t, Validate(sc))
+
+	sc.Priority = "urgent"
+	assert.Error(t, Validate(sc))
+
+	sc.Priority = "low"
+	sc.Cron = "daily"
+	assert.Error(t, Validate(sc))
+
+	sc.Cron = "@daily"
+	sc.Seeds = nil
+	assert.Error(t, Validate(sc))
+}
+
+func TestStorageOf(t *testing.T) {
+	d, _ := db.NewMapConn()
+	_, ok := StorageOf(d)
+	assert.True(t, ok)
+
+	_, ok = StorageOf(struct{ db.Connection }{d})
+	assert.False(t, ok)
+}
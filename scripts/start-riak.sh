@@ -102,10 +102,20 @@ echo "Waiting 30 seconds until the cluster stabilizes"
 echo
 sleep 30
 
+echo "Enabling Riak's strong consistency"
+for index in $(seq -f "%02g" "1" "${DOCKER_RIAK_CLUSTER_SIZE}");
+do
+  docker exec "riak${index}" sh -c "echo 'strong_consistency = on' >> /etc/riak/riak.conf"
+  docker exec "riak${index}" riak restart
+done
+sleep 10
+
 echo "Enabling Riak's CRDTs"
 docker exec riak01 riak-admin bucket-type create counters '{"props":{"datatype":"counter"}}'
 docker exec riak01 riak-admin bucket-type create sets '{"props":{"datatype":"set"}}'
 docker exec riak01 riak-admin bucket-type create maps '{"props":{"datatype":"map"}}'
+docker exec riak01 riak-admin bucket-type create consistent '{"props":{"consistent":true}}'
 docker exec riak01 riak-admin bucket-type activate counters
 docker exec riak01 riak-admin bucket-type activate sets
 docker exec riak01 riak-admin bucket-type activate maps
+docker exec riak01 riak-admin bucket-type activate consistent
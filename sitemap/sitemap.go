@@ -0,0 +1,215 @@
+// Package sitemap discovers the pages of a site in its sitemaps.
+// Sitemaps are found in the Sitemap lines of robots.txt, or in /sitemap.xml when robots.txt has none.
+// It follows sitemap indexes and reads sitemaps compressed with gzip.
+package sitemap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxURLs is the number of urls that a site returns at most, the limit of a single sitemap in the protocol.
+	MaxURLs = 50000
+	// maxBytes is the size of a sitemap after decompressing it, the limit in the protocol.
+	maxBytes = 50 << 20
+	// maxDepth is the number of sitemap indexes followed from the sitemaps in robots.txt.
+	maxDepth = 2
+)
+
+// lastModLayouts are the formats of the W3C datetimes used in lastmod.
+var lastModLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"}
+
+// errNotFound is returned when a sitemap doesn't exist.
+var errNotFound = errors.New("sitemap not found")
+
+// URL is a page listed in a sitemap.
+type URL struct {
+	Loc     string
+	LastMod time.Time // zero when the sitemap doesn't say when the page changed.
+}
+
+// Fetcher downloads the sitemaps of sites.
+type Fetcher struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+// document is a sitemap, with urls, or a sitemap index, with sitemaps.
+type document struct {
+	URLs     []entry `xml:"url"`
+	Sitemaps []entry `xml:"sitemap"`
+}
+
+type entry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// Discover returns the pages of the site of a url listed in its sitemaps, up to MaxURLs.
+// Pages and sitemaps in other hosts are ignored, sitemaps are never downloaded from them. It returns the pages found
+// and the last error when some sitemaps listed in robots.txt can't be read.
+func (f Fetcher) Discover(site *url.URL) ([]URL, error) {
+	root := &url.URL{Scheme: site.Scheme, Host: site.Host, Path: "/"}
+
+	locs, err := f.robots(root)
+	if err != nil {
+		return nil, err
+	}
+
+	optional := len(locs) == 0
+	if optional {
+		locs = []string{root.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String()}
+	}
+
+	d := discovery{Fetcher: f, host: site.Host, seen: map[string]bool{}}
+	for _, loc := range locs {
+		if err := d.sitemap(loc, 0); err != nil && !(optional && err == errNotFound) {
+			d.err = err
+		}
+	}
+	return d.urls, d.err
+}
+
+// discovery holds the state of a site being discovered.
+type discovery struct {
+	Fetcher
+	host string
+	seen map[string]bool // sitemaps and urls already read.
+	urls []URL
+	err  error
+}
+
+// sitemap reads the urls of a sitemap in the host of the site, following the sitemaps of an index.
+func (d *discovery) sitemap(loc string, depth int) error {
+	if d.seen[loc] || len(d.urls) >= MaxURLs {
+		return nil
+	}
+	d.seen[loc] = true
+
+	if u, err := url.Parse(loc); err != nil || u.Host != d.host {
+		return nil
+	}
+
+	doc, err := d.fetch(loc)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range doc.URLs {
+		u, err := url.Parse(strings.TrimSpace(e.Loc))
+		if err != nil || u.Host != d.host || d.seen[u.String()] {
+			continue
+		}
+		if len(d.urls) >= MaxURLs {
+			break
+		}
+		d.seen[u.String()] = true
+		d.urls = append(d.urls, URL{Loc: u.String(), LastMod: parseLastMod(e.LastMod)})
+	}
+
+	if depth >= maxDepth {
+		return nil
+	}
+	for _, e := range doc.Sitemaps {
+		if err := d.sitemap(strings.TrimSpace(e.Loc), depth+1); err != nil {
+			d.err = err
+		}
+	}
+	return nil
+}
+
+// fetch downloads and parses a sitemap, decompressing it when it's gzipped.
+func (f Fetcher) fetch(loc string) (*document, error) {
+	res, err := f.get(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sitemap %s: %s", loc, res.Status)
+	}
+
+	r := bufio.NewReader(res.Body)
+	var body io.Reader = r
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("sitemap %s: %v", loc, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var doc document
+	if err := xml.NewDecoder(io.LimitReader(body, maxBytes)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("sitemap %s: %v", loc, err)
+	}
+	return &doc, nil
+}
+
+// robots returns the sitemaps listed in the robots.txt of a site.
+// Sites without robots.txt have no sitemaps listed.
+func (f Fetcher) robots(root *url.URL) ([]string, error) {
+	res, err := f.get(root.ResolveReference(&url.URL{Path: "/robots.txt"}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	var locs []string
+	s := bufio.NewScanner(io.LimitReader(res.Body, maxBytes))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "sitemap") {
+			continue
+		}
+		if loc := strings.TrimSpace(line[i+1:]); loc != "" {
+			locs = append(locs, loc)
+		}
+	}
+	return locs, s.Err()
+}
+
+func (f Fetcher) get(loc string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", loc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+
+	c := f.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return c.Do(req)
+}
+
+func parseLastMod(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, l := range lastModLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,128 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSite serves the files of a site, gzipping the ones that end in .gz.
+func startSite(files map[string]string) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		body := []byte(fmt.Sprintf(f, s.URL))
+		if strings.HasSuffix(r.URL.Path, ".gz") {
+			var b bytes.Buffer
+			gz := gzip.NewWriter(&b)
+			gz.Write(body)
+			gz.Close()
+			body = b.Bytes()
+		}
+		w.Write(body)
+	}))
+	return s
+}
+
+func discover(t *testing.T, s *httptest.Server) ([]URL, error) {
+	u, err := url.Parse(s.URL + "/blog")
+	assert.NoError(t, err)
+	return Fetcher{}.Discover(u)
+}
+
+func TestDiscoverRobots(t *testing.T) {
+	s := startSite(map[string]string{
+		"/robots.txt": "User-agent: *\nDisallow: /private\nSitemap: %[1]s/index.xml\nsitemap: %[1]s/missing.xml\n",
+		"/index.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/pages.xml.gz</loc></sitemap>
+  <sitemap><loc>%[1]s/posts.xml</loc></sitemap>
+</sitemapindex>`,
+		"/pages.xml.gz": `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/</loc><lastmod>2015-06-01</lastmod></url>
+  <url><loc>%[1]s/about</loc><lastmod>2015-06-01T03:00:00+02:00</lastmod></url>
+  <url><loc>http://example.com/elsewhere</loc></url>
+</urlset>`,
+		"/posts.xml": `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> %[1]s/posts/1 </loc></url>
+  <url><loc>%[1]s/about</loc></url>
+</urlset>`,
+	})
+	defer s.Close()
+
+	urls, err := discover(t, s)
+	assert.Error(t, err)
+	assert.Equal(t, []URL{
+		{Loc: s.URL + "/", LastMod: time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{Loc: s.URL + "/about", LastMod: time.Date(2015, 6, 1, 1, 0, 0, 0, time.UTC)},
+		{Loc: s.URL + "/posts/1"},
+	}, urls)
+}
+
+func TestDiscoverOtherHosts(t *testing.T) {
+	var requests int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer other.Close()
+
+	s := startSite(map[string]string{
+		"/robots.txt": "Sitemap: " + other.URL + "/sitemap.xml\nSitemap: %[1]s/index.xml\n",
+		"/index.xml": `<sitemapindex>
+  <sitemap><loc>` + other.URL + `/sitemap.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/pages.xml</loc></sitemap>
+</sitemapindex>`,
+		"/pages.xml": `<urlset><url><loc>%[1]s/</loc></url></urlset>`,
+	})
+	defer s.Close()
+
+	urls, err := discover(t, s)
+	assert.NoError(t, err)
+	assert.Equal(t, []URL{{Loc: s.URL + "/"}}, urls)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
+
+func TestDiscoverDefaultSitemap(t *testing.T) {
+	s := startSite(map[string]string{
+		"/sitemap.xml": `<urlset><url><loc>%[1]s/</loc></url></urlset>`,
+	})
+	defer s.Close()
+
+	urls, err := discover(t, s)
+	assert.NoError(t, err)
+	assert.Equal(t, []URL{{Loc: s.URL + "/"}}, urls)
+}
+
+func TestDiscoverWithoutSitemaps(t *testing.T) {
+	s := startSite(map[string]string{})
+	defer s.Close()
+
+	urls, err := discover(t, s)
+	assert.NoError(t, err)
+	assert.Empty(t, urls)
+}
+
+func TestDiscoverInvalidSitemap(t *testing.T) {
+	s := startSite(map[string]string{
+		"/sitemap.xml": `<urlset><url>`,
+	})
+	defer s.Close()
+
+	_, err := discover(t, s)
+	assert.Error(t, err)
+}
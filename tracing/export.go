@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	// ExportSpan receives a span when it ends. It must not block.
+	ExportSpan(SpanData)
+	// Shutdown sends the spans that are still buffered and releases the exporter.
+	Shutdown(time.Duration) error
+}
+
+var (
+	exporterMu = new(sync.RWMutex)
+	exporter   Exporter
+)
+
+// Setup sends the spans to the exporter for the url, replacing the previous one.
+// Spans are not exported when the url is empty,
+// but span contexts are still propagated, so traces started by other nodes are not broken.
+func Setup(rawurl, nodeID string) error {
+	e, err := Open(rawurl, nodeID)
+	if err != nil {
+		return err
+	}
+
+	if prev := SetExporter(e); prev != nil {
+		return prev.Shutdown(otlpTimeout)
+	}
+	return nil
+}
+
+// SetExporter replaces the exporter that receives the spans, nil to stop exporting them.
+// It returns the previous exporter.
+func SetExporter(e Exporter) Exporter {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	prev := exporter
+	exporter = e
+	return prev
+}
+
+// Shutdown stops exporting spans and waits up to the timeout
+// for the exporter to send the spans that are still buffered.
+func Shutdown(timeout time.Duration) error {
+	if e := SetExporter(nil); e != nil {
+		return e.Shutdown(timeout)
+	}
+	return nil
+}
+
+// Open creates the exporter for a url.
+// The url stdout:// writes the spans to the standard output as json lines.
+// Http urls send the spans to an OTLP/HTTP collector using json,
+// to the path /v1/traces unless the url has a path,
+// for instance http://127.0.0.1:4318.
+// The node id identifies the service instance in the collector.
+// It returns a nil exporter when the url is empty.
+func Open(rawurl, nodeID string) (Exporter, error) {
+	if rawurl == "" {
+		return nil, nil
+	}
+
+	u, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "stdout" {
+		return NewWriterExporter(os.Stdout), nil
+	}
+	return newOTLPExporter(u.String(), nodeID), nil
+}
+
+// ValidateURL checks that a url can be used to open an exporter.
+func ValidateURL(rawurl string) error {
+	if rawurl == "" {
+		return nil
+	}
+	_, err := parseURL(rawurl)
+	return err
+}
+
+func parseURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: invalid url %q", rawurl)
+	}
+
+	switch u.Scheme {
+	case "stdout":
+		return u, nil
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("tracing: missing collector host in url %q", rawurl)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpTracesPath
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("tracing: unknown exporter %q, supported exporters: stdout, http, https", u.Scheme)
+}
+
+func export(d SpanData) {
+	exporterMu.RLock()
+	e := exporter
+	exporterMu.RUnlock()
+
+	if e != nil {
+		e.ExportSpan(d)
+	}
+}
+
+// WriterExporter writes every span as a json line.
+type WriterExporter struct {
+	*sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriterExporter creates an exporter that writes the spans in w.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{Mutex: new(sync.Mutex), enc: json.NewEncoder(w)}
+}
+
+// ExportSpan writes the span.
+func (w *WriterExporter) ExportSpan(d SpanData) {
+	w.Lock()
+	defer w.Unlock()
+	w.enc.Encode(d)
+}
+
+// Shutdown does nothing, spans are written when they end.
+func (w *WriterExporter) Shutdown(time.Duration) error {
+	return nil
+}
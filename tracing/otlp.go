@@ -0,0 +1,250 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/calavera/crawler/logging"
+)
+
+const (
+	otlpTracesPath = "/v1/traces"
+	otlpBatchSize  = 512               // spans sent in a request when the batch is full.
+	otlpMaxQueue   = 8 * otlpBatchSize // spans buffered while the collector is unavailable, the rest are dropped.
+	otlpInterval   = 5 * time.Second   // time between requests when the batch is not full.
+	otlpTimeout    = 10 * time.Second
+
+	serviceName = "crawler"
+)
+
+// otlpExporter sends the spans in batches to an OTLP/HTTP collector, encoded in json.
+type otlpExporter struct {
+	*sync.Mutex
+	endpoint string
+	resource otlpResource
+	client   *http.Client
+	spans    []SpanData
+	dropped  int
+
+	flush chan struct{}
+	quit  chan struct{}
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func newOTLPExporter(endpoint, nodeID string) *otlpExporter {
+	e := &otlpExporter{
+		Mutex:    new(sync.Mutex),
+		endpoint: endpoint,
+		resource: otlpResource{Attributes: []otlpAttribute{
+			newOTLPAttribute("service.name", serviceName),
+			newOTLPAttribute("service.instance.id", nodeID),
+		}},
+		client: &http.Client{Timeout: otlpTimeout},
+		flush:  make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		once:   new(sync.Once),
+	}
+	go e.loop()
+	return e
+}
+
+// ExportSpan buffers the span until the next batch is sent.
+func (e *otlpExporter) ExportSpan(d SpanData) {
+	e.Lock()
+	defer e.Unlock()
+
+	if len(e.spans) >= otlpMaxQueue {
+		e.dropped++
+		return
+	}
+
+	e.spans = append(e.spans, d)
+	if len(e.spans) >= otlpBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown sends the spans buffered and stops the exporter.
+func (e *otlpExporter) Shutdown(timeout time.Duration) error {
+	e.once.Do(func() {
+		close(e.quit)
+	})
+
+	select {
+	case <-e.done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("tracing: timeout sending the spans to the collector")
+	}
+}
+
+func (e *otlpExporter) loop() {
+	defer close(e.done)
+
+	t := time.NewTicker(otlpInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-e.flush:
+		case <-e.quit:
+			for e.send() {
+			}
+			return
+		}
+		e.send()
+	}
+}
+
+// send posts a batch of spans to the collector.
+// It returns whether there are spans left to send.
+func (e *otlpExporter) send() bool {
+	e.Lock()
+	n := len(e.spans)
+	if n > otlpBatchSize {
+		n = otlpBatchSize
+	}
+	batch := e.spans[:n]
+	e.spans = e.spans[n:]
+	dropped := e.dropped
+	e.dropped = 0
+	left := len(e.spans) > 0
+	e.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("traceSpansDropped", "spans", dropped)
+	}
+	if len(batch) == 0 {
+		return false
+	}
+
+	if err := e.post(batch); err != nil {
+		slog.Warn("traceExportError", "endpoint", e.endpoint, "spans", len(batch), logging.Err(err))
+	}
+	return left
+}
+
+func (e *otlpExporter) post(batch []SpanData) error {
+	b, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status from the collector: %s", res.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) request(batch []SpanData) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, d := range batch {
+		spans[i] = newOTLPSpan(d)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: serviceName}, Spans: spans}},
+	}}}
+}
+
+// Types of the OTLP/HTTP json encoding.
+// Ids are hex strings and timestamps are nanoseconds encoded as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 for errors.
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPSpan(d SpanData) otlpSpan {
+	s := otlpSpan{
+		TraceID:           d.TraceID,
+		SpanID:            d.SpanID,
+		ParentSpanID:      d.ParentID,
+		Name:              d.Name,
+		Kind:              d.Kind,
+		StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+	}
+
+	keys := make([]string, 0, len(d.Attributes))
+	for k := range d.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s.Attributes = append(s.Attributes, newOTLPAttribute(k, d.Attributes[k]))
+	}
+
+	if d.Error != "" {
+		s.Status = otlpStatus{Code: 2, Message: d.Error}
+	}
+	return s
+}
+
+func newOTLPAttribute(k, v string) otlpAttribute {
+	return otlpAttribute{Key: k, Value: otlpValue{StringValue: v}}
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	paths := make(chan string, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		paths <- r.URL.Path
+		requests <- req
+	}))
+	defer s.Close()
+
+	e, err := Open(s.URL, "node01")
+	assert.NoError(t, err)
+
+	span := Start(SpanContext{}, "crawl", KindConsumer)
+	span.SetAttributes("job.uuid", "job")
+	span.SetError(errHTTP)
+	e.ExportSpan(span.data)
+
+	assert.NoError(t, e.Shutdown(time.Second))
+	assert.Equal(t, otlpTracesPath, <-paths)
+
+	req := <-requests
+	if assert.Len(t, req.ResourceSpans, 1) {
+		rs := req.ResourceSpans[0]
+		assert.Contains(t, rs.Resource.Attributes, newOTLPAttribute("service.instance.id", "node01"))
+
+		spans := rs.ScopeSpans[0].Spans
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, span.Context().TraceID.String(), spans[0].TraceID)
+			assert.Equal(t, "crawl", spans[0].Name)
+			assert.Equal(t, KindConsumer, spans[0].Kind)
+			assert.Equal(t, []otlpAttribute{newOTLPAttribute("job.uuid", "job")}, spans[0].Attributes)
+			assert.Equal(t, otlpStatus{Code: 2, Message: errHTTP.Error()}, spans[0].Status)
+		}
+	}
+}
+
+func TestOTLPExporterShutdownTimeout(t *testing.T) {
+	block := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer s.Close()
+	defer close(block)
+
+	e, _ := Open(s.URL+"/traces", "node01")
+	e.ExportSpan(Start(SpanContext{}, "crawl", KindConsumer).data)
+
+	assert.Error(t, e.Shutdown(10*time.Millisecond))
+}
+
+var errHTTP = http.ErrHandlerTimeout
@@ -0,0 +1,227 @@
+// Package tracing records spans of the work done for a job across nodes.
+// Span contexts are propagated between nodes in the W3C traceparent format,
+// and finished spans are sent to the exporter configured with Setup.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind describes the relationship between a span and its parent, like in OpenTelemetry.
+type Kind int
+
+// Span kinds.
+const (
+	KindInternal Kind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+const traceparentVersion = "00"
+
+// ErrInvalidTraceparent is returned when a traceparent cannot be parsed.
+var ErrInvalidTraceparent = errors.New("tracing: invalid traceparent")
+
+// TraceID identifies all the spans of a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span inside a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid returns whether the trace id is not all zeros.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid returns whether the span id is not all zeros.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is the part of a span that is propagated to its children.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid returns whether the context belongs to a span.
+// Spans started with an invalid parent start a new trace.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID.IsValid() && c.SpanID.IsValid()
+}
+
+// Traceparent formats the context as a W3C traceparent header,
+// like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+// It returns an empty string for invalid contexts.
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-01", traceparentVersion, c.TraceID, c.SpanID)
+}
+
+// ParseTraceparent parses a W3C traceparent header.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var c SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return c, ErrInvalidTraceparent
+	}
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return c, ErrInvalidTraceparent
+	}
+
+	if err := decodeID(c.TraceID[:], parts[1]); err != nil {
+		return c, err
+	}
+	if err := decodeID(c.SpanID[:], parts[2]); err != nil {
+		return c, err
+	}
+
+	if !c.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return c, nil
+}
+
+// Span is an operation in a trace.
+// Spans are exported when they end.
+type Span struct {
+	*sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanData is a finished span, as received by the exporters.
+type SpanData struct {
+	Name       string            `json:"name"`
+	Kind       Kind              `json:"kind"`
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	ctx SpanContext
+}
+
+// Start starts a span as a child of the parent context.
+// It starts a new trace when the parent is not valid.
+func Start(parent SpanContext, name string, kind Kind) *Span {
+	ctx := SpanContext{TraceID: parent.TraceID}
+	if !parent.IsValid() {
+		ctx.TraceID = newTraceID()
+	}
+	ctx.SpanID = newSpanID()
+
+	d := SpanData{
+		Name:    name,
+		Kind:    kind,
+		TraceID: ctx.TraceID.String(),
+		SpanID:  ctx.SpanID.String(),
+		Start:   time.Now(),
+		ctx:     ctx,
+	}
+	if parent.IsValid() {
+		d.ParentID = parent.SpanID.String()
+	}
+
+	return &Span{Mutex: new(sync.Mutex), data: d}
+}
+
+// Do runs an operation inside a span, child of the parent context.
+// The span fails when the operation returns an error.
+func Do(parent SpanContext, name string, kind Kind, fn func() error) error {
+	s := Start(parent, name, kind)
+	defer s.End()
+
+	err := fn()
+	s.SetError(err)
+	return err
+}
+
+// Context returns the context to propagate to the children of the span.
+func (s *Span) Context() SpanContext {
+	return s.data.ctx
+}
+
+// SetAttributes adds attributes to the span, given as key and value pairs.
+func (s *Span) SetAttributes(kv ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ended {
+		return
+	}
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.data.Attributes[kv[i]] = kv[i+1]
+	}
+}
+
+// SetError marks the span as failed when the error is not nil.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.Lock()
+	if !s.ended {
+		s.data.Error = err.Error()
+	}
+	s.Unlock()
+}
+
+// End finishes the span and sends it to the exporter.
+// Calls after the first one are ignored.
+func (s *Span) End() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	d := s.data
+	s.Unlock()
+
+	export(d)
+}
+
+func decodeID(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return ErrInvalidTraceparent
+	}
+	return nil
+}
+
+func newTraceID() (t TraceID) {
+	randomID(t[:])
+	return t
+}
+
+func newSpanID() (s SpanID) {
+	randomID(s[:])
+	return s
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	c, err := ParseTraceparent(tp)
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", c.SpanID.String())
+	assert.Equal(t, tp, c.Traceparent())
+
+	assert.Equal(t, "", SpanContext{}.Traceparent())
+}
+
+func TestParseTraceparentErrors(t *testing.T) {
+	testCases := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	}
+
+	for _, tp := range testCases {
+		_, err := ParseTraceparent(tp)
+		assert.Error(t, err, tp)
+	}
+}
+
+func TestStart(t *testing.T) {
+	root := Start(SpanContext{}, "root", KindServer)
+	assert.True(t, root.Context().IsValid())
+
+	child := Start(root.Context(), "child", KindInternal)
+	assert.Equal(t, root.Context().TraceID, child.Context().TraceID)
+	assert.NotEqual(t, root.Context().SpanID, child.Context().SpanID)
+	assert.Equal(t, root.Context().SpanID.String(), child.data.ParentID)
+	assert.Equal(t, "", root.data.ParentID)
+}
+
+func TestExport(t *testing.T) {
+	var b bytes.Buffer
+	prev := SetExporter(NewWriterExporter(&b))
+	defer SetExporter(prev)
+
+	root := Start(SpanContext{}, "root", KindServer)
+	err := Do(root.Context(), "child", KindClient, func() error {
+		return errors.New("boom")
+	})
+	assert.Error(t, err)
+
+	root.SetAttributes("job.uuid", "job")
+	root.End()
+	root.End()
+	root.SetAttributes("ignored", "true")
+
+	var spans []SpanData
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var d SpanData
+		assert.NoError(t, dec.Decode(&d))
+		spans = append(spans, d)
+	}
+
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "child", spans[0].Name)
+		assert.Equal(t, "boom", spans[0].Error)
+		assert.Equal(t, spans[1].SpanID, spans[0].ParentID)
+
+		assert.Equal(t, "root", spans[1].Name)
+		assert.Equal(t, map[string]string{"job.uuid": "job"}, spans[1].Attributes)
+		assert.False(t, spans[1].End.Before(spans[1].Start))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	e, err := Open("", "node01")
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+
+	e, err = Open("stdout://", "node01")
+	assert.NoError(t, err)
+	assert.IsType(t, &WriterExporter{}, e)
+
+	for _, u := range []string{"udp://127.0.0.1:6831", "http://", "://"} {
+		_, err := Open(u, "node01")
+		assert.Error(t, err, u)
+		assert.Error(t, ValidateURL(u), u)
+	}
+}
@@ -0,0 +1,174 @@
+// Package urlnorm normalizes urls, so the different ways of writing the url of a page
+// are crawled only once by a job.
+package urlnorm
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultTrackingParams are the query parameters that analytics tools add to links.
+// Names ending in * match every parameter with that prefix.
+var DefaultTrackingParams = []string{"utm_*", "gclid", "dclid", "fbclid", "msclkid", "mc_cid", "mc_eid", "_ga"}
+
+// defaultPorts are the ports that are implicit in every scheme.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Rules say what is normalized in the urls. The zero value leaves them as they are.
+type Rules struct {
+	LowercaseHost     bool     `json:"lowercaseHost"`
+	StripDefaultPort  bool     `json:"stripDefaultPort"`  // removes :80 from http urls and :443 from https urls.
+	StripFragment     bool     `json:"stripFragment"`     // removes everything after #.
+	SortQuery         bool     `json:"sortQuery"`         // sorts the query parameters by name.
+	RemoveDotSegments bool     `json:"removeDotSegments"` // resolves . and .. in the path, and uses / for empty paths.
+	TrackingParams    []string `json:"trackingParams"`    // query parameters removed, case insensitive.
+	Canonical         bool     `json:"canonical"`         // pages are crawled once per <link rel=canonical>.
+}
+
+// DefaultRules returns rules that apply every normalization.
+func DefaultRules() Rules {
+	return Rules{
+		LowercaseHost:     true,
+		StripDefaultPort:  true,
+		StripFragment:     true,
+		SortQuery:         true,
+		RemoveDotSegments: true,
+		TrackingParams:    append([]string(nil), DefaultTrackingParams...),
+		Canonical:         true,
+	}
+}
+
+// String normalizes a url. Urls that can't be parsed are returned as they are.
+func (r Rules) String(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return r.URL(u).String()
+}
+
+// URL returns a normalized copy of a url.
+func (r Rules) URL(u *url.URL) *url.URL {
+	n := *u
+	if n.User != nil {
+		user := *n.User
+		n.User = &user
+	}
+
+	if r.LowercaseHost {
+		n.Host = strings.ToLower(n.Host)
+	}
+	if r.StripDefaultPort && n.Port() != "" && defaultPorts[strings.ToLower(n.Scheme)] == n.Port() {
+		n.Host = hostWithoutPort(n.Hostname())
+	}
+	if r.StripFragment {
+		n.Fragment = ""
+		n.RawFragment = ""
+	}
+	if r.RemoveDotSegments && n.Opaque == "" {
+		cleanPath(&n)
+	}
+	if r.SortQuery || len(r.TrackingParams) > 0 {
+		n.RawQuery = r.query(n.RawQuery)
+		if n.RawQuery == "" {
+			n.ForceQuery = false
+		}
+	}
+	return &n
+}
+
+// cleanPath removes the dot segments of the path of a url.
+func cleanPath(u *url.URL) {
+	if u.Path == "" {
+		if u.Host != "" {
+			u.Path = "/"
+			u.RawPath = ""
+		}
+		return
+	}
+
+	p := removeDotSegments(u.Path)
+	if p == u.Path {
+		return
+	}
+	// The escaped path keeps the escaping of the original one, like %2F.
+	// url.URL ignores it when it's not a valid encoding of the path.
+	u.RawPath = removeDotSegments(u.EscapedPath())
+	u.Path = p
+}
+
+// query removes the tracking parameters from a query and sorts it.
+// Parameters with the same name keep their order.
+func (r Rules) query(raw string) string {
+	var params []string
+	for _, p := range strings.Split(raw, "&") {
+		if p == "" || r.isTracking(paramName(p)) {
+			continue
+		}
+		params = append(params, p)
+	}
+
+	if r.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return paramName(params[i]) < paramName(params[j])
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func (r Rules) isTracking(name string) bool {
+	name = strings.ToLower(name)
+	for _, t := range r.TrackingParams {
+		t = strings.ToLower(t)
+		if strings.HasSuffix(t, "*") {
+			if strings.HasPrefix(name, t[:len(t)-1]) {
+				return true
+			}
+		} else if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// paramName returns the unescaped name of a query parameter.
+func paramName(p string) string {
+	if i := strings.IndexByte(p, '='); i >= 0 {
+		p = p[:i]
+	}
+	if name, err := url.QueryUnescape(p); err == nil {
+		return name
+	}
+	return p
+}
+
+func hostWithoutPort(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// removeDotSegments resolves the . and .. segments of a path, as described in RFC 3986, section 5.2.4.
+func removeDotSegments(p string) string {
+	segs := strings.Split(p, "/")
+	out := make([]string, 0, len(segs))
+	for i, s := range segs {
+		last := i == len(segs)-1
+		switch s {
+		case ".":
+		case "..":
+			if len(out) > 1 || (len(out) == 1 && out[0] != "") {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+			continue
+		}
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
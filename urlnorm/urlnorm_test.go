@@ -0,0 +1,59 @@
+package urlnorm
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRules(t *testing.T) {
+	r := DefaultRules()
+
+	for raw, want := range map[string]string{
+		"http://a.com/x":                             "http://a.com/x",
+		"http://A.com/x#top":                         "http://a.com/x",
+		"http://a.com/x?utm_source=foo":              "http://a.com/x",
+		"http://a.com:80/x":                          "http://a.com/x",
+		"https://a.com:443/x":                        "https://a.com/x",
+		"https://a.com:80/x":                         "https://a.com:80/x",
+		"http://a.com:8080/x":                        "http://a.com:8080/x",
+		"http://a.com":                               "http://a.com/",
+		"http://a.com/a/./b/../c/":                   "http://a.com/a/c/",
+		"http://a.com/../../x":                       "http://a.com/x",
+		"http://a.com/a/..":                          "http://a.com/",
+		"http://a.com/x?b=2&a=1&b=1":                 "http://a.com/x?a=1&b=2&b=1",
+		"http://a.com/x?UTM_Campaign=y&q=1&fbclid=z": "http://a.com/x?q=1",
+		"http://a.com/x?":                            "http://a.com/x",
+		"http://a.com/a%2Fb/./c":                     "http://a.com/a%2Fb/c",
+		"http://[::1]:80/x":                          "http://[::1]/x",
+		"mailto:someone@a.com":                       "mailto:someone@a.com",
+	} {
+		assert.Equal(t, want, r.String(raw), raw)
+	}
+}
+
+func TestZeroRules(t *testing.T) {
+	var r Rules
+	for _, raw := range []string{"http://A.com:80/a/../x?utm_source=foo&b=1&a=2#top", "http://a.com"} {
+		assert.Equal(t, raw, r.String(raw))
+	}
+}
+
+func TestTrackingParams(t *testing.T) {
+	r := Rules{TrackingParams: []string{"ref", "pk_*"}}
+	assert.Equal(t, "http://a.com/x?z=1&a=2", r.String("http://a.com/x?ref=x&z=1&pk_campaign=y&a=2"))
+}
+
+func TestURLCopies(t *testing.T) {
+	u, err := url.Parse("http://user@A.com/x#top")
+	assert.NoError(t, err)
+
+	n := DefaultRules().URL(u)
+	assert.Equal(t, "http://user@a.com/x", n.String())
+	assert.Equal(t, "http://user@A.com/x#top", u.String())
+}
+
+func TestInvalidURL(t *testing.T) {
+	assert.Equal(t, "http://a.com/%zz", DefaultRules().String("http://a.com/%zz"))
+}